@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"execution-service/internal/coordinator"
 	"execution-service/internal/node"
 	"execution-service/internal/worker"
@@ -12,6 +13,11 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"execution-service/internal/database"
+	"execution-service/internal/logging"
+	"execution-service/internal/storage"
+	"execution-service/internal/tracing"
+	"time"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var logger *zap.Logger
@@ -27,28 +33,32 @@ func main() {
 	}
 
 	// Initialize logger
-	logger, _ = zap.NewProduction()
-	// if err != nil {
-	// 	panic(err)
-	// }
+	var err error
+	logger, err = logging.New(viper.GetViper())
+	if err != nil {
+		panic(err)
+	}
+	logger = logger.With(zap.String("node_id", viper.GetString("node.id")), zap.String("node_type", viper.GetString("node.type")))
 	defer logger.Sync() // flushes buffer, if any
 	logger.Info("Logger initialized")
 
-	// Setup Database Connection
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		logger.Fatal("MONGO_URI environment variable is not set")
+	// Setup job storage
+	db, jobs, closeStorage, err := openStorage(viper.GetViper())
+	if err != nil {
+		logger.Fatal("Failed to open job storage", zap.Error(err))
 	}
-	if err := database.ConnectMongoDB(mongoURI); err != nil {
-		logger.Fatal("Failed to connect to MongoDB", zap.Error(err))
+	defer closeStorage()
+
+	// Setup tracing
+	shutdownTracing, err := tracing.Setup(viper.GetViper(), viper.GetString("node.type"), viper.GetString("node.id"))
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
 	}
-	defer database.DisconnectMongoDB()
-	logger.Info("Connected to MongoDB")
 
 	// Start node
 	// TODO: Every node starts as a worker and then only one node becomes a coordinator through some consensus algorithm. Also, let the cluster owner decide the coordinator as a config
 	logger.Info("Starting node...")
-	node,err:= NewNode(viper.GetViper())
+	node,err:= NewNode(viper.GetViper(), db, jobs)
 	if err != nil {
 		logger.Fatal("Failed to create node", zap.Error(err))
 	}
@@ -68,20 +78,83 @@ func main() {
 
 	// Implement graceful shutdown logic here
 	node.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Failed to flush traces", zap.Error(err))
+	}
 	logger.Info("Coordinator stopped")
 }
 
 // NewNode creates a new Node instance based on the configuration provided by viper.
 // It initializes either a Worker or Coordinator node based on the "node.type" configuration.
-func NewNode(config *viper.Viper) (node.NodeInterface, error) {
+func NewNode(config *viper.Viper, db *mongo.Database, jobs storage.JobRepository) (node.NodeInterface, error) {
 	nodeType := config.GetString("node.type")
 	logger.Info("Node type", zap.String("type", nodeType))
 	switch nodeType {
 		case "worker":
-			return worker.NewWorker(config), nil
+			return worker.NewWorker(config, jobs, logger.Named("worker")), nil
 		case "coordinator":
-			return coordinator.NewCoordinator(config), nil
+			c, err := coordinator.NewCoordinator(config, db, jobs, logger.Named("coordinator"))
+			if err != nil {
+				return nil, err
+			}
+			return c, nil
 		default:
 			return nil, fmt.Errorf("unknown node type: %s", nodeType)
 	}
-}
\ No newline at end of file
+}
+
+// openStorage opens the job repository selected by storage.backend: "mongo"
+// (the default), "sqlite", "memory" or "none". db is only set for MongoDB,
+// which the coordinator also uses for idempotency keys, webhooks and job
+// events. Workers run in their own processes and cannot share a sqlite or
+// memory repository with the coordinator, so they refuse those backends.
+func openStorage(config *viper.Viper) (*mongo.Database, storage.JobRepository, func(), error) {
+	backend := config.GetString("storage.backend")
+	if config.GetString("node.type") == "worker" && (backend == "sqlite" || backend == "memory") {
+		return nil, nil, nil, fmt.Errorf("storage.backend %s cannot be shared with the coordinator process; use mongo, or none to run the worker without storage", backend)
+	}
+	switch backend {
+	case "", "mongo":
+		mongoURI := os.Getenv("MONGO_URI")
+		if mongoURI == "" {
+			return nil, nil, nil, fmt.Errorf("MONGO_URI environment variable is not set")
+		}
+		mongoConfig, err := storage.MongoConfigFromViper(config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mongoClient, err := database.ConnectMongoDB(mongoURI)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Info("Connected to MongoDB")
+		db := mongoClient.Database(mongoConfig.Database)
+		jobs := storage.NewMongoJobRepository(db, mongoConfig)
+		if err := database.JobStorageMigrator(db, mongoConfig, logger.Named("migrations")).Migrate(context.Background()); err != nil {
+			database.DisconnectMongoDB(mongoClient, logger)
+			return nil, nil, nil, fmt.Errorf("failed to migrate job storage: %w", err)
+		}
+		return db, jobs, func() { database.DisconnectMongoDB(mongoClient, logger) }, nil
+	case "sqlite":
+		path := config.GetString("storage.sqlite.path")
+		if path == "" {
+			path = "execution-service.db"
+		}
+		jobs, err := storage.OpenSQLiteJobRepository(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		logger.Info("Opened SQLite job storage", zap.String("path", path))
+		return nil, jobs, func() { jobs.Close() }, nil
+	case "memory":
+		logger.Info("Using in-memory job storage; jobs are lost on restart")
+		return nil, storage.NewMemoryJobRepository(), func() {}, nil
+	case "none":
+		logger.Warn("Running without job storage")
+		return nil, nil, func() {}, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown storage.backend %q", backend)
+	}
+}
@@ -0,0 +1,151 @@
+// Package archive writes records to gzip-compressed JSON Lines files on the
+// local filesystem or in an S3-compatible object store.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/spf13/viper"
+)
+
+// Store keeps archive files under slash-separated keys.
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// EncodeJSONL encodes records as gzip-compressed JSON Lines, one record per
+// line.
+func EncodeJSONL[T any](records []T) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(zw)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewStoreFromConfig creates the store configured under key: "file" writes
+// below <key>.directory, "s3" uploads to the bucket configured in <key>.s3.
+func NewStoreFromConfig(config *viper.Viper, key string) (Store, error) {
+	switch backend := config.GetString(key + ".store"); backend {
+	case "", "file":
+		dir := config.GetString(key + ".directory")
+		if dir == "" {
+			return nil, fmt.Errorf("%s.directory is not set", key)
+		}
+		return NewFileStore(dir), nil
+	case "s3":
+		var cfg S3Config
+		if err := config.UnmarshalKey(key+".s3", &cfg); err != nil {
+			return nil, fmt.Errorf("invalid %s.s3 configuration: %w", key, err)
+		}
+		if secret := os.Getenv("ARCHIVE_S3_SECRET_ACCESS_KEY"); secret != "" {
+			cfg.SecretAccessKey = secret
+		}
+		return NewS3Store(cfg)
+	default:
+		return nil, fmt.Errorf("unknown %s.store %q", key, backend)
+	}
+}
+
+// FileStore writes archive files below a directory.
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Put writes data to a temporary file and renames it into place, so readers
+// never see a partial archive.
+func (s *FileStore) Put(ctx context.Context, key string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".archive-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// S3Config configures an S3Store. Without an access key, credentials are
+// taken from the AWS environment variables, the shared credentials file or
+// the instance role.
+type S3Config struct {
+	Endpoint        string `mapstructure:"endpoint"`
+	Region          string `mapstructure:"region"`
+	Bucket          string `mapstructure:"bucket"`
+	Prefix          string `mapstructure:"prefix"`
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	// Insecure uses plain HTTP, e.g. for a local MinIO.
+	Insecure bool `mapstructure:"insecure"`
+}
+
+// S3Store uploads archive files to a bucket of an S3-compatible object store.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 archive store needs a bucket")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "s3.amazonaws.com"
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+	if cfg.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, "")
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Store{client: client, bucket: cfg.Bucket, prefix: cfg.Prefix}, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/gzip"})
+	return err
+}
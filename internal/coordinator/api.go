@@ -0,0 +1,436 @@
+package coordinator
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"execution-service/internal/logging"
+	"execution-service/internal/metrics"
+	"execution-service/internal/models"
+	"execution-service/internal/queue"
+	"execution-service/internal/storage"
+	"execution-service/internal/tracing"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// startAPI starts the coordinator's HTTP API on the configured node address.
+func (c *Coordinator) startAPI() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", c.handleSubmitJob)
+	mux.HandleFunc("GET /jobs", c.handleListJobs)
+	mux.HandleFunc("GET /jobs/{job_id}", c.handleGetJob)
+	mux.HandleFunc("GET /jobs/{job_id}/logs", c.handleGetJobLogs)
+	mux.HandleFunc("GET /jobs/updates", c.handleJobUpdates)
+	mux.HandleFunc("GET /jobs/{job_id}/updates", c.handleJobUpdates)
+	mux.HandleFunc("GET /intake/stats", c.handleIntakeStats)
+	mux.HandleFunc("GET /quotas", c.handleListQuotas)
+	mux.HandleFunc("GET /quotas/{tenant}", c.handleGetQuota)
+	mux.HandleFunc("GET /ratelimits", c.handleListRateLimits)
+	mux.HandleFunc("GET /retention/stats", c.handleRetentionStats)
+	mux.HandleFunc("GET /scheduler/decisions", c.handleListDecisions)
+	mux.HandleFunc("POST /workers/{worker}/jobs/{job}/complete", c.requireWorkerToken(c.handleJobComplete))
+	mux.HandleFunc("POST /workflows", c.handleCreateWorkflow)
+	mux.HandleFunc("GET /workflows", c.handleListWorkflows)
+	mux.HandleFunc("GET /workflows/{id}", c.handleGetWorkflow)
+	mux.HandleFunc("GET /webhooks/deliveries", c.handleListDeliveries)
+	mux.HandleFunc("GET /webhooks/deliveries/{id}", c.handleGetDelivery)
+	mux.HandleFunc("POST /webhooks/deliveries/{id}/redeliver", c.requireWorkerToken(c.handleRedeliver))
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	c.server = &http.Server{Addr: c.address, Handler: metrics.InstrumentHandler(tracing.Handler(mux))}
+	go func() {
+		c.logger.Info("Coordinator API listening", zap.String("address", c.address))
+		if err := c.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			c.logger.Fatal("Failed to start HTTP server", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// requireWorkerToken rejects requests that do not carry the worker token as
+// "Authorization: Bearer <token>". Without a token every request passes.
+func (c *Coordinator) requireWorkerToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(wr http.ResponseWriter, req *http.Request) {
+		if c.workerToken != "" {
+			token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.workerToken)) != 1 {
+				wr.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(wr, "Invalid worker token", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler(wr, req)
+	}
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func (c *Coordinator) writeJSON(wr http.ResponseWriter, status int, v any) {
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	if err := json.NewEncoder(wr).Encode(v); err != nil {
+		c.logger.Warn("Failed to encode response", zap.Error(err))
+	}
+}
+
+// writeInvalidJob responds 400 with the reasons a job submission was rejected.
+func (c *Coordinator) writeInvalidJob(wr http.ResponseWriter, err error) {
+	reasons := []string{err.Error()}
+	var invalid *queue.InvalidMessageError
+	if errors.As(err, &invalid) {
+		reasons = invalid.Reasons
+	}
+	c.writeJSON(wr, http.StatusBadRequest, map[string]interface{}{
+		"error":   "invalid job submission",
+		"reasons": reasons,
+	})
+}
+
+func (c *Coordinator) handleSubmitJob(wr http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(wr, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	job, err := parseJob(body)
+	if err == nil {
+		err = c.checkSubmission(job)
+	}
+	if err != nil {
+		c.writeInvalidJob(wr, err)
+		return
+	}
+	if key := req.Header.Get(idempotencyKeyHeader); key != "" {
+		job.IdempotencyKey = key
+	}
+
+	// Continue the trace of the request, or without trace headers the trace
+	// context in the envelope.
+	ctx := req.Context()
+	if req.Header.Get("traceparent") == "" {
+		ctx = tracing.Extract(ctx, job.TraceContext)
+	}
+	ctx, span := tracing.Start(ctx, "job.intake",
+		trace.WithAttributes(tracing.JobIDKey.String(job.JobID), tracing.TenantIDKey.String(job.TenantID)))
+	defer span.End()
+	job.TraceContext = tracing.Inject(ctx)
+
+	if err := c.persistJob(ctx, job, body); err != nil {
+		var duplicate *DuplicateSubmissionError
+		if errors.As(err, &duplicate) {
+			// Replay the response of the original submission.
+			wr.Header().Set("Idempotent-Replayed", "true")
+			c.writeJSON(wr, http.StatusOK, map[string]string{
+				"job_id":    duplicate.Original.JobID,
+				"tenant_id": duplicate.Original.TenantID,
+				"status":    duplicate.Original.Status,
+			})
+			return
+		}
+		if errors.Is(err, storage.ErrDuplicateJob) {
+			http.Error(wr, "Job "+job.JobID+" already exists", http.StatusConflict)
+			return
+		}
+		http.Error(wr, "Failed to store job", http.StatusInternalServerError)
+		return
+	}
+	c.Submit(job)
+	c.writeJSON(wr, http.StatusAccepted, map[string]string{
+		"job_id":    job.JobID,
+		"tenant_id": job.TenantID,
+		"status":    job.JobStatus,
+	})
+}
+
+func (c *Coordinator) handleIntakeStats(wr http.ResponseWriter, req *http.Request) {
+	c.writeJSON(wr, http.StatusOK, c.IntakeStats(req.Context()))
+}
+
+func (c *Coordinator) handleRetentionStats(wr http.ResponseWriter, req *http.Request) {
+	if c.retention == nil {
+		c.writeJSON(wr, http.StatusOK, RetentionStats{Mode: "disabled"})
+		return
+	}
+	c.writeJSON(wr, http.StatusOK, c.retention.Stats())
+}
+
+func (c *Coordinator) handleListQuotas(wr http.ResponseWriter, req *http.Request) {
+	c.writeJSON(wr, http.StatusOK, c.tenants.Usage())
+}
+
+func (c *Coordinator) handleGetQuota(wr http.ResponseWriter, req *http.Request) {
+	c.writeJSON(wr, http.StatusOK, c.tenants.TenantUsage(req.PathValue("tenant")))
+}
+
+func (c *Coordinator) handleListRateLimits(wr http.ResponseWriter, req *http.Request) {
+	c.writeJSON(wr, http.StatusOK, c.rateLimits.Status())
+}
+
+func (c *Coordinator) handleListDecisions(wr http.ResponseWriter, req *http.Request) {
+	c.writeJSON(wr, http.StatusOK, c.decisions.List(req.URL.Query().Get("job_id")))
+}
+
+// handleJobComplete is called by workers when a job finishes so its slot can
+// be reused immediately instead of after the next health check.
+func (c *Coordinator) handleJobComplete(wr http.ResponseWriter, req *http.Request) {
+	var result JobResult
+	if err := json.NewDecoder(req.Body).Decode(&result); err != nil && err != io.EOF {
+		http.Error(wr, "Failed to parse job result", http.StatusBadRequest)
+		return
+	}
+	c.CompleteJob(req.Context(), req.PathValue("worker"), req.PathValue("job"), result)
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+func (c *Coordinator) handleCreateWorkflow(wr http.ResponseWriter, req *http.Request) {
+	var spec WorkflowSpec
+	if err := json.NewDecoder(req.Body).Decode(&spec); err != nil {
+		http.Error(wr, "Failed to parse workflow", http.StatusBadRequest)
+		return
+	}
+	wf, jobs, err := c.workflows.Create(req.Context(), spec, c.checkWorkflowStep(req.Context()))
+	if errors.Is(err, errWorkflowStore) {
+		c.logger.Error("Failed to create workflow", zap.Error(err))
+		http.Error(wr, "Failed to store workflow", http.StatusInternalServerError)
+		return
+	}
+	if errors.Is(err, ErrWorkflowExists) || errors.Is(err, storage.ErrDuplicateJob) {
+		http.Error(wr, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	snapshot, _ := c.workflows.Get(req.Context(), wf.ID)
+	go c.submitWorkflowJobs(jobs)
+	c.writeJSON(wr, http.StatusAccepted, snapshot)
+}
+
+func (c *Coordinator) handleListWorkflows(wr http.ResponseWriter, req *http.Request) {
+	workflows, err := c.workflows.List(req.Context())
+	if err != nil {
+		c.logger.Error("Failed to list workflows", zap.Error(err))
+		http.Error(wr, "Failed to list workflows", http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(wr, http.StatusOK, workflows)
+}
+
+func (c *Coordinator) handleGetWorkflow(wr http.ResponseWriter, req *http.Request) {
+	wf, err := c.workflows.Get(req.Context(), req.PathValue("id"))
+	if errors.Is(err, ErrWorkflowNotFound) {
+		http.Error(wr, "Workflow not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to get workflow", zap.String("workflow_id", req.PathValue("id")), zap.Error(err))
+		http.Error(wr, "Failed to get workflow", http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(wr, http.StatusOK, wf)
+}
+
+func (c *Coordinator) handleListDeliveries(wr http.ResponseWriter, req *http.Request) {
+	deliveries, err := c.webhooks.List(req.Context(), req.URL.Query().Get("job_id"))
+	if err != nil {
+		c.logger.Error("Failed to list webhook deliveries", zap.Error(err))
+		http.Error(wr, "Failed to list webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []models.WebhookDelivery{}
+	}
+	c.writeJSON(wr, http.StatusOK, deliveries)
+}
+
+func (c *Coordinator) handleGetDelivery(wr http.ResponseWriter, req *http.Request) {
+	delivery, err := c.webhooks.Get(req.Context(), req.PathValue("id"))
+	if errors.Is(err, ErrDeliveryNotFound) {
+		http.Error(wr, "Webhook delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to get webhook delivery", zap.String("delivery_id", req.PathValue("id")), zap.Error(err))
+		http.Error(wr, "Failed to get webhook delivery", http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(wr, http.StatusOK, delivery)
+}
+
+// handleRedeliver sends a webhook again, e.g. after the receiver was fixed.
+func (c *Coordinator) handleRedeliver(wr http.ResponseWriter, req *http.Request) {
+	delivery, err := c.webhooks.Redeliver(req.Context(), req.PathValue("id"))
+	if errors.Is(err, ErrDeliveryNotFound) {
+		http.Error(wr, "Webhook delivery not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errWebhooksDisabled) {
+		http.Error(wr, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to redeliver webhook", zap.String("delivery_id", req.PathValue("id")), zap.Error(err))
+		http.Error(wr, "Failed to redeliver webhook", http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(wr, http.StatusAccepted, delivery)
+}
+
+// jobHistory is a job with its attempts, oldest first.
+type jobHistory struct {
+	Job      models.Job           `json:"job"`
+	Attempts []models.ExecutedJob `json:"attempts"`
+}
+
+// handleListJobs searches stored jobs. See parseJobQuery for the parameters.
+func (c *Coordinator) handleListJobs(wr http.ResponseWriter, req *http.Request) {
+	if c.jobs == nil {
+		http.Error(wr, "Job storage is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	filter, page, err := parseJobQuery(req.URL.Query())
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := c.jobs.List(req.Context(), filter, page)
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to list jobs", zap.Error(err))
+		http.Error(wr, "Failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+	if result.Jobs == nil {
+		result.Jobs = []models.Job{}
+	}
+	c.writeJSON(wr, http.StatusOK, result)
+}
+
+func (c *Coordinator) handleGetJob(wr http.ResponseWriter, req *http.Request) {
+	if c.jobs == nil {
+		http.Error(wr, "Job storage is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	jobID := req.PathValue("job_id")
+	job, err := c.jobs.Get(req.Context(), jobID)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(wr, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to get job", logging.JobID(jobID), zap.Error(err))
+		http.Error(wr, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+	attempts, err := c.jobs.Attempts(req.Context(), jobID)
+	if err != nil {
+		c.logger.Error("Failed to get job attempts", logging.JobID(jobID), zap.Error(err))
+		http.Error(wr, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+	if attempts == nil {
+		attempts = []models.ExecutedJob{}
+	}
+	c.writeJSON(wr, http.StatusOK, jobHistory{Job: job, Attempts: attempts})
+}
+
+func (c *Coordinator) handleGetJobLogs(wr http.ResponseWriter, req *http.Request) {
+	if c.jobs == nil {
+		http.Error(wr, "Job storage is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	jobID := req.PathValue("job_id")
+	if _, err := c.jobs.Get(req.Context(), jobID); errors.Is(err, storage.ErrNotFound) {
+		http.Error(wr, "Job not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		c.logger.Error("Failed to get job", logging.JobID(jobID), zap.Error(err))
+		http.Error(wr, "Failed to get job logs", http.StatusInternalServerError)
+		return
+	}
+	chunks, err := c.jobs.Logs(req.Context(), jobID)
+	if err != nil {
+		c.logger.Error("Failed to get job logs", logging.JobID(jobID), zap.Error(err))
+		http.Error(wr, "Failed to get job logs", http.StatusInternalServerError)
+		return
+	}
+	if chunks == nil {
+		chunks = []models.LogChunk{}
+	}
+	c.writeJSON(wr, http.StatusOK, chunks)
+}
+
+// parseJobQuery reads the job search parameters: status, tenant_id,
+// worker_id, dockerfile_reference, label (key:value, repeatable), error,
+// created_after, created_before, updated_after, updated_before (RFC 3339),
+// sort, limit and cursor.
+func parseJobQuery(query url.Values) (storage.JobFilter, storage.Page, error) {
+	filter := storage.JobFilter{
+		Status:              query.Get("status"),
+		TenantID:            query.Get("tenant_id"),
+		WorkerID:            query.Get("worker_id"),
+		DockerfileReference: query.Get("dockerfile_reference"),
+		ErrorText:           query.Get("error"),
+	}
+	for _, label := range query["label"] {
+		key, value, ok := strings.Cut(label, ":")
+		if !ok || key == "" {
+			return filter, storage.Page{}, fmt.Errorf("label %q is not of the form key:value", label)
+		}
+		// MongoDB would read such keys as a path or an operator.
+		if strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			return filter, storage.Page{}, fmt.Errorf("label key %q must not contain '.' or start with '$'", key)
+		}
+		if filter.Labels == nil {
+			filter.Labels = make(map[string]string)
+		}
+		filter.Labels[key] = value
+	}
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"updated_after", &filter.UpdatedAfter},
+		{"updated_before", &filter.UpdatedBefore},
+	}
+	for _, t := range times {
+		value := query.Get(t.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, storage.Page{}, fmt.Errorf("%s is not an RFC 3339 time: %q", t.name, value)
+		}
+		*t.dst = parsed
+	}
+
+	page := storage.Page{Cursor: query.Get("cursor")}
+	sort, err := storage.ParseSort(query.Get("sort"))
+	if err != nil {
+		return filter, page, err
+	}
+	page.Sort = sort
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return filter, page, fmt.Errorf("limit must be a positive number")
+		}
+		page.Limit = limit
+	}
+	return filter, page, nil
+}
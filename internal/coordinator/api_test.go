@@ -0,0 +1,71 @@
+package coordinator
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRequireWorkerToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", "", http.StatusNoContent},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusNoContent},
+		{"missing header", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer other", http.StatusUnauthorized},
+		{"wrong scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Coordinator{workerToken: tt.token}
+			handler := c.requireWorkerToken(func(wr http.ResponseWriter, req *http.Request) {
+				wr.WriteHeader(http.StatusNoContent)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/workers/w/jobs/j/complete", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJobQueryLabels(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"label=source:ci", map[string]string{"source": "ci"}, false},
+		{"label=source:ci&label=team:a:b", map[string]string{"source": "ci", "team": "a:b"}, false},
+		{"label=source", nil, true},
+		{"label=:ci", nil, true},
+		{"label=a.b:ci", nil, true},
+		{"label=$where:ci", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter, _, err := parseJobQuery(query)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJobQuery error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(filter.Labels, tt.want) {
+				t.Fatalf("Labels = %v, want %v", filter.Labels, tt.want)
+			}
+		})
+	}
+}
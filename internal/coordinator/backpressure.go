@@ -0,0 +1,181 @@
+package coordinator
+
+import (
+	"context"
+	"execution-service/internal/queue"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// IntakeStats describes how far the coordinator is behind its intake and
+// whether backpressure is being applied.
+type IntakeStats struct {
+	Paused      bool `json:"paused"`
+	Spilling    bool `json:"spilling"`
+	PendingJobs int  `json:"pending_jobs"`
+	FreeSlots   int  `json:"free_slots"`
+	// Lag is the number of messages waiting in the intake, or -1 if the
+	// backend cannot tell.
+	Lag int64 `json:"lag"`
+	// LagSeconds is the age of the last received message when it was received.
+	LagSeconds    float64 `json:"lag_seconds"`
+	Received      int64   `json:"received"`
+	Spilled       int64   `json:"spilled"`
+	SpillDepth    int64   `json:"spill_depth"`
+	Pauses        int64   `json:"pauses"`
+	PausedSeconds float64 `json:"paused_seconds"`
+}
+
+// backpressure decides when the coordinator stops taking jobs from its
+// intake. It pauses once the backlog, the pending jobs that the workers'
+// free slots cannot absorb, reaches maxPending and resumes once it has
+// drained to resumePending.
+type backpressure struct {
+	maxPending    int // 0 disables backpressure
+	resumePending int
+	checkInterval time.Duration
+	logger        *zap.Logger
+
+	mu          sync.Mutex
+	paused      bool
+	pausedSince time.Time
+	pausedTotal time.Duration
+	pauses      int64
+	received    int64
+	spilled     int64
+	spillDepth  int64
+	lastLag     time.Duration
+}
+
+// newBackpressureFromConfig reads the backpressure section. max_pending
+// defaults to 1000 and resume_pending to half of it.
+func newBackpressureFromConfig(config *viper.Viper, logger *zap.Logger) (*backpressure, error) {
+	maxPending := 1000
+	if config.IsSet("backpressure.max_pending") {
+		maxPending = config.GetInt("backpressure.max_pending")
+	}
+	resumePending := maxPending / 2
+	if config.IsSet("backpressure.resume_pending") {
+		resumePending = min(config.GetInt("backpressure.resume_pending"), maxPending)
+	}
+	checkInterval, err := configDuration(config, "backpressure.check_interval", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &backpressure{
+		maxPending:    maxPending,
+		resumePending: resumePending,
+		checkInterval: checkInterval,
+		logger:        logger,
+	}, nil
+}
+
+// update records the current backlog and reports whether intake is paused.
+func (b *backpressure) update(pending, freeSlots int) bool {
+	if b.maxPending <= 0 {
+		return false
+	}
+	backlog := pending - freeSlots
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.paused && backlog >= b.maxPending:
+		b.paused = true
+		b.pausedSince = time.Now()
+		b.pauses++
+		b.logger.Warn("Pausing job intake", zap.Int("pending_jobs", pending), zap.Int("free_slots", freeSlots))
+	case b.paused && backlog <= b.resumePending:
+		b.paused = false
+		b.pausedTotal += time.Since(b.pausedSince)
+		b.logger.Info("Resuming job intake", zap.Int("pending_jobs", pending), zap.Int("free_slots", freeSlots))
+	}
+	return b.paused
+}
+
+// receivedMessage records a message taken from the intake.
+func (b *backpressure) receivedMessage(produced time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.received++
+	if !produced.IsZero() {
+		b.lastLag = time.Since(produced)
+	}
+}
+
+// addSpilled adjusts the number of messages waiting in spill storage.
+func (b *backpressure) addSpilled(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > 0 {
+		b.spilled += n
+	}
+	b.spillDepth = max(b.spillDepth+n, 0)
+}
+
+func (b *backpressure) setSpillDepth(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spillDepth = n
+}
+
+func (b *backpressure) hasSpilled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.spillDepth > 0
+}
+
+func (b *backpressure) stats() IntakeStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	paused := b.pausedTotal
+	if b.paused {
+		paused += time.Since(b.pausedSince)
+	}
+	return IntakeStats{
+		Paused:        b.paused,
+		Lag:           -1,
+		LagSeconds:    b.lastLag.Seconds(),
+		Received:      b.received,
+		Spilled:       b.spilled,
+		SpillDepth:    b.spillDepth,
+		Pauses:        b.pauses,
+		PausedSeconds: paused.Seconds(),
+	}
+}
+
+// backlog returns the number of jobs waiting for dispatch and the free slots
+// on active workers.
+func (c *Coordinator) backlog() (pending, freeSlots int) {
+	pending = c.tenants.Len()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, w := range c.workers.ListWorkers() {
+		if w.Status != "inactive" {
+			freeSlots += max(w.FreeSlots(), 0)
+		}
+	}
+	return pending, freeSlots
+}
+
+// intakePaused reports whether backpressure currently holds back the intake.
+func (c *Coordinator) intakePaused() bool {
+	return c.backpressure.update(c.backlog())
+}
+
+// IntakeStats returns intake lag and backpressure state.
+func (c *Coordinator) IntakeStats(ctx context.Context) IntakeStats {
+	stats := c.backpressure.stats()
+	stats.PendingJobs, stats.FreeSlots = c.backlog()
+	stats.Spilling = stats.Paused && c.spill != nil
+	if reporter, ok := c.intake.(queue.LagReporter); ok {
+		if lag, err := reporter.Lag(ctx); err == nil {
+			stats.Lag = lag
+		} else {
+			c.logger.Warn("Failed to get intake lag", zap.Error(err))
+		}
+	}
+	return stats
+}
@@ -2,43 +2,169 @@ package coordinator
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"execution-service/internal/jobstream"
+	"execution-service/internal/logging"
+	"execution-service/internal/metrics"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
 	"execution-service/internal/queue"
+	"execution-service/internal/storage"
+	"execution-service/internal/tracing"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type Job struct {
-	ID        string
-	JobID     string
-	WorkerID  string
+	ID                  string
+	JobID               string
+	WorkerID            string
 	DockerfileReference string
-	JobStatus string
+	JobStatus           string
+	TenantID            string
+	NodeSelector        map[string]string
+	Affinity            []AffinityTerm
+	AntiAffinity        []AffinityTerm
+	Resources           Resources
+	Env                 map[string]string
+	IdempotencyKey      string
+	Metadata            map[string]string
+	TraceContext        map[string]string
+	Callback            *Callback
+	JobType             string
+	// NotBefore is when the job is released for dispatch; until then it
+	// waits in the delay queue. Delay is kept so workflow steps can start
+	// their delay when they become ready.
+	NotBefore time.Time
+	Delay     time.Duration
+	// Attempt counts how often the job was sent to a worker, including the
+	// current assignment.
+	Attempt int
+
+	// queuedAt is when the job entered the pending queue, for the
+	// time-in-queue metric.
+	queuedAt time.Time
+}
+
+// jobContext returns a context carrying the job's trace context, so spans of
+// the job's later stages join its trace.
+func jobContext(job Job) context.Context {
+	return tracing.Extract(context.Background(), job.TraceContext)
+}
+
+// jobLogger returns the coordinator's logger with the fields of job: its ID,
+// trace and, once it was sent to a worker, the worker and attempt.
+func (c *Coordinator) jobLogger(job Job) *zap.Logger {
+	logger := logging.ForJob(c.logger, jobContext(job), job.JobID)
+	if job.WorkerID != "" {
+		logger = logger.With(logging.WorkerID(job.WorkerID))
+	}
+	if job.Attempt > 0 {
+		logger = logger.With(logging.Attempt(job.Attempt))
+	}
+	return logger
 }
 
+// maxUpdateAttempts bounds how often a job state update is retried after
+// losing to a concurrent update.
+const maxUpdateAttempts = 5
+
+// idempotencyKeyHeader carries an idempotency key on API requests and Kafka messages.
+const idempotencyKeyHeader = "Idempotency-Key"
+
 type Config struct {
 	JobQueueSize        int
 	WorkerTimeout       time.Duration
 	HealthCheckInterval time.Duration
 }
 
+// workerTokenEnv overrides workers.token so the token can be kept out of
+// the config file.
+const workerTokenEnv = "WORKER_TOKEN"
+
 type Coordinator struct {
 	logger        *zap.Logger
-	workers       WorkerManager
+	workers       *WorkerManager
 	mu            sync.Mutex
 	healthCheck   time.Duration
-	jobQueue      chan Job
 	workerTimeout time.Duration
-	kafkaClient   *queue.KafkaClient
+	// lostTimeout is how long a worker may be unreachable before its jobs
+	// fail.
+	lostTimeout time.Duration
+	// workerToken must be sent by workers reporting finished jobs and by
+	// callers of the redeliver endpoint. Empty disables the check.
+	workerToken string
+	// intake is where jobs are received from, besides the API. kafkaClient
+	// is also used to publish job events.
+	intake      queue.Intake
+	kafkaClient *queue.KafkaClient
+	// spill takes messages off the intake while backpressure pauses it. It
+	// is nil when spilling is disabled.
+	spill        *queue.MongoIntake
+	backpressure *backpressure
+	tenants      *FairShareQueue
+	scheduler    Scheduler
+	decisions    *decisionLog
+	workflows    *WorkflowManager
+	// delayed holds jobs until their NotBefore time.
+	delayed    *queue.InMemoryQueue
+	rateLimits *jobRateLimiter
+	webhooks   *WebhookDispatcher
+	// jobs is nil when the coordinator runs without storage.
+	jobs storage.JobRepository
+	// retention removes expired jobs. It is nil when retention is disabled.
+	retention *retentionSweeper
+	// idempotencyKeys maps submission idempotency keys to the jobs they
+	// created for idempotencyRetention.
+	idempotencyKeys      *mongo.Collection
+	idempotencyRetention time.Duration
+	// outbox holds job events until they are published to eventsTopic. It
+	// is nil when events are disabled.
+	outbox             *mongo.Collection
+	eventsTopic        string
+	eventsPollInterval time.Duration
+	eventsRetention    time.Duration
+	eventsWake         chan struct{}
+	// updates streams job changes to API clients. It is nil when job
+	// updates are disabled.
+	updates          *jobstream.Watcher
+	updatesKeepalive time.Duration
+	address          string
+	server           *http.Server
+	wake             chan struct{}
+	done             chan struct{}
 }
 
 func (c *Coordinator) Stop() error {
-	panic("unimplemented")
+	close(c.done)
+	if c.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.server.Shutdown(ctx); err != nil {
+			c.logger.Error("Failed to shut down coordinator API", zap.Error(err))
+		}
+	}
+	if c.intake != nil {
+		if err := c.intake.Close(); err != nil {
+			return err
+		}
+	}
+	if c.kafkaClient != nil {
+		return c.kafkaClient.Close()
+	}
+	return nil
 }
 
 func (c *Coordinator) GetID() string {
@@ -46,118 +172,795 @@ func (c *Coordinator) GetID() string {
 }
 
 func (c *Coordinator) Start() error {
-	fmt.Printf("Coordinator started\n")
-	go c.monitorWorkers()
+	c.logger.Info("Coordinator starting")
+	ctx := context.Background()
+	if c.idempotencyKeys != nil {
+		if err := queries.EnsureIdempotencyIndexes(ctx, c.idempotencyKeys); err != nil {
+			return fmt.Errorf("failed to create idempotency key indexes: %w", err)
+		}
+	}
+	if c.webhooks.collection != nil {
+		if err := queries.EnsureWebhookIndexes(ctx, c.webhooks.collection); err != nil {
+			return fmt.Errorf("failed to create webhook delivery indexes: %w", err)
+		}
+	}
+	if c.workflows.collection != nil {
+		if err := queries.EnsureWorkflowIndexes(ctx, c.workflows.collection); err != nil {
+			return fmt.Errorf("failed to create workflow indexes: %w", err)
+		}
+	}
+	if c.jobs != nil {
+		if err := c.webhooks.Resume(ctx); err != nil {
+			return fmt.Errorf("failed to resume webhook deliveries: %w", err)
+		}
+		// Workflows are restored first, so jobs that recovery finishes
+		// advance them.
+		pendingSteps, err := c.workflows.Restore(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to restore workflows: %w", err)
+		}
+		if err := c.recoverJobs(ctx); err != nil {
+			return fmt.Errorf("failed to recover jobs: %w", err)
+		}
+		if err := c.resumeWorkflowSteps(ctx, pendingSteps); err != nil {
+			return fmt.Errorf("failed to resume workflows: %w", err)
+		}
+	}
+	if c.outbox != nil {
+		replicaSet, err := queries.IsReplicaSet(ctx, c.outbox.Database())
+		if err != nil {
+			return fmt.Errorf("failed to check the MongoDB deployment: %w", err)
+		}
+		if !replicaSet {
+			return fmt.Errorf("events.enabled needs MongoDB to run as a replica set, because the job event outbox uses transactions")
+		}
+		if err := queries.EnsureOutboxIndexes(ctx, c.outbox, c.eventsRetention); err != nil {
+			return fmt.Errorf("failed to create job event outbox indexes: %w", err)
+		}
+		go c.publishEvents()
+	}
+	if c.updates != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-c.done
+			cancel()
+		}()
+		go c.updates.Run(ctx)
+	}
+	if err := metrics.Register(metricsCollector{c}); err != nil {
+		c.logger.Warn("Failed to register coordinator metrics", zap.Error(err))
+	}
+	if err := c.startAPI(); err != nil {
+		return err
+	}
+	go c.healthLoop()
+	go c.delayLoop()
+	if c.retention != nil {
+		go c.retention.run(c.done)
+	}
+	go c.dispatchLoop()
 
-	// Start fetching jobs from Kafka
-	go c.fetchJobsFromKafka()
+	if c.spill != nil {
+		c.refreshSpillDepth(context.Background())
+	}
+	if c.intake != nil {
+		go c.receiveJobs()
+	}
 
 	return nil
 }
 
-func (c *Coordinator) fetchJobsFromKafka() {
+// receiveJobs consumes job messages from the intake. A message is only
+// acknowledged once its job is stored in MongoDB, and the unique job_id index
+// turns redelivered messages into no-ops, so every job is queued exactly once
+// even if the coordinator crashes mid-way.
+//
+// While backpressure pauses the intake, messages are moved to the spill queue
+// if one is configured and otherwise left in the intake. Spilled messages are
+// taken before new ones once the backlog has drained.
+func (c *Coordinator) receiveJobs() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.done
+		cancel()
+	}()
+
 	for {
-		// time.Sleep(10 * time.Second)
-		jobMessage, err := c.kafkaClient.ConsumeMessage(context.TODO())
-		if err != nil {
-			c.logger.Error("Failed to fetch job from Kafka", zap.Error(err))
-			continue
+		paused := c.intakePaused()
+		if paused && c.spill == nil {
+			select {
+			case <-time.After(c.backpressure.checkInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
 		}
 
-		// Parse the job message
-		var jobJson any
-		if err := json.Unmarshal([]byte(jobMessage), &jobJson); err != nil {
-			log.Print("Failed to unmarshal job message", err)
+		var from queue.Intake = c.intake
+		var message queue.Message
+		var err error
+		if !paused && c.spill != nil && c.backpressure.hasSpilled() {
+			// Another coordinator may have drained the spill queue, so do not
+			// wait on it for long.
+			from = c.spill
+			spillCtx, cancelSpill := context.WithTimeout(ctx, c.backpressure.checkInterval)
+			message, err = c.spill.Receive(spillCtx)
+			cancelSpill()
+		} else {
+			message, err = c.intake.Receive(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return // coordinator stopped or intake closed
+			}
+			if from == c.spill {
+				c.refreshSpillDepth(ctx)
+				continue
+			}
+			c.logger.Error("Failed to receive job", zap.Error(err))
+			time.Sleep(time.Second)
 			continue
 		}
 
-		jobMap, ok := jobJson.(map[string]interface{})
-		if !ok {
-			log.Print("Failed to cast job message to map[string]interface{}")
+		if from == c.intake && paused {
+			c.spillMessage(ctx, message)
 			continue
 		}
-		
-		job := Job{
-			ID: "1",
-			JobID: jobMap["job_id"].(string),
-			WorkerID: "",
-			DockerfileReference: jobMap["dockerfile_reference"].(string),
-			JobStatus: "pending",
+		if from == c.intake {
+			c.backpressure.receivedMessage(message.Time)
+		}
+		if !c.acceptMessage(ctx, from, message) {
+			return
+		}
+		if from == c.spill {
+			c.backpressure.addSpilled(-1)
+		}
+	}
+}
+
+// acceptMessage parses, stores and queues the job in message, then
+// acknowledges it. It returns false if the coordinator stopped first.
+func (c *Coordinator) acceptMessage(ctx context.Context, from queue.Intake, message queue.Message) bool {
+	job, err := parseJob(message.Value)
+	if err == nil {
+		err = c.checkSubmission(job)
+	}
+	if err != nil {
+		// Redelivering an invalid message would fail the same way, so
+		// acknowledge it and move on.
+		c.logger.Warn("Rejected job message", zap.String("source", message.Source), zap.Error(err))
+		c.ackMessage(ctx, from, message)
+		return true
+	}
+	if job.IdempotencyKey == "" {
+		for key, value := range message.Headers {
+			if strings.EqualFold(key, idempotencyKeyHeader) {
+				job.IdempotencyKey = value
+			}
 		}
+	}
 
-		// // Enqueue the job into the jobQueue
-		c.jobQueue <- job
-		log.Print("Job enqueued", job.JobID, job.DockerfileReference)
+	// Continue the trace of the producer: trace headers on the message take
+	// precedence over the trace context in the envelope.
+	spanCtx := tracing.Extract(tracing.Extract(ctx, job.TraceContext), message.Headers)
+	spanCtx, span := tracing.Start(spanCtx, "job.intake", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(tracing.JobIDKey.String(job.JobID), tracing.TenantIDKey.String(job.TenantID)))
+	job.TraceContext = tracing.Inject(spanCtx)
+
+	err = c.persistJobWithRetry(spanCtx, job, message.Value)
+	if isDuplicate(err) {
+		c.jobLogger(job).Info("Job was already accepted, skipping duplicate message", zap.String("source", message.Source), zap.Error(err))
+		span.End()
+		c.ackMessage(ctx, from, message)
+		return true
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return false // coordinator stopped before the job could be stored
 	}
+	c.ackMessage(ctx, from, message)
+	c.Submit(job)
+	c.jobLogger(job).Info("Job enqueued", zap.String("dockerfile_reference", job.DockerfileReference))
+	return true
 }
 
-func NewCoordinator(config *viper.Viper) *Coordinator {
-	kafkaClient := queue.NewKafkaClient(
-		config.GetStringSlice("kafka.brokers"),
-		config.GetString("kafka.topic"),
-	)
+// spillMessage moves a message from the intake to the spill queue. If the
+// spill fails, the message is left unacknowledged and will be redelivered.
+func (c *Coordinator) spillMessage(ctx context.Context, message queue.Message) {
+	if err := c.spill.Publish(ctx, message.Value, message.Headers); err != nil {
+		c.logger.Error("Failed to spill job message", zap.String("source", message.Source), zap.Error(err))
+		time.Sleep(time.Second)
+		return
+	}
+	c.backpressure.receivedMessage(message.Time)
+	c.backpressure.addSpilled(1)
+	c.ackMessage(ctx, c.intake, message)
+}
 
-	return &Coordinator{
-		workers: InitializeWorkersFromConfig(config),
-		mu:      sync.Mutex{},
-		healthCheck: func() time.Duration {
-			duration, err := time.ParseDuration(config.GetString("workers.heartbeat_interval"))
+// refreshSpillDepth recounts the messages waiting in the spill queue.
+func (c *Coordinator) refreshSpillDepth(ctx context.Context) {
+	lag, err := c.spill.Lag(ctx)
+	if err != nil {
+		c.logger.Warn("Failed to count spilled job messages", zap.Error(err))
+		return
+	}
+	c.backpressure.setSpillDepth(lag)
+}
+
+func (c *Coordinator) ackMessage(ctx context.Context, from queue.Intake, message queue.Message) {
+	if err := from.Ack(ctx, message); err != nil {
+		c.logger.Error("Failed to acknowledge job message", zap.String("source", message.Source), zap.Error(err))
+	}
+}
+
+// Intake returns the queue the coordinator receives jobs from, or nil if
+// jobs are only accepted over the API.
+func (c *Coordinator) Intake() queue.Intake {
+	return c.intake
+}
+
+// DuplicateSubmissionError is returned when a submission reuses an
+// idempotency key. Original is the job the key first created.
+type DuplicateSubmissionError struct {
+	Original models.Job
+}
+
+func (e *DuplicateSubmissionError) Error() string {
+	return fmt.Sprintf("duplicate submission of job %s", e.Original.JobID)
+}
+
+// persistJob stores a newly accepted job. It returns storage.ErrDuplicateJob
+// if a job with the same ID was accepted before, and a
+// *DuplicateSubmissionError if the job's idempotency key was already used
+// within the retention window.
+func (c *Coordinator) persistJob(ctx context.Context, job Job, payload []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "job.persist", trace.WithAttributes(tracing.JobIDKey.String(job.JobID)))
+	defer func() {
+		if isDuplicate(err) {
+			span.SetAttributes(attribute.Bool("job.duplicate", true))
+			span.End()
+			return
+		}
+		tracing.End(span, err)
+	}()
+	if c.jobs == nil {
+		c.jobAccepted(job)
+		return nil
+	}
+
+	if job.IdempotencyKey != "" && c.idempotencyKeys != nil {
+		existing, err := queries.ClaimIdempotencyKey(ctx, c.idempotencyKeys, job.TenantID, job.IdempotencyKey, job.JobID, c.idempotencyRetention)
+		if err != nil {
+			return err
+		}
+		// A claim for this very job was made by an earlier delivery that
+		// stopped before storing the job, e.g. because the coordinator
+		// crashed. Create is idempotent on the job ID, so carry on.
+		if existing != nil && existing.JobID != job.JobID {
+			original, err := c.jobs.Get(ctx, existing.JobID)
 			if err != nil {
-				panic(fmt.Sprintf("invalid duration for workers.heartbeat_interval: %v", err))
+				// The first submission claimed the key but has not stored its job yet.
+				original = models.Job{JobID: existing.JobID, TenantID: existing.TenantID, Status: models.JobStatusPending}
 			}
-			return duration
-		}(),
-		jobQueue:    make(chan Job, config.GetInt("workers.max_concurrent_jobs")),
-		kafkaClient: kafkaClient,
+			return &DuplicateSubmissionError{Original: original}
+		}
+	}
+
+	stored := models.Job{
+		JobID:               job.JobID,
+		TenantID:            job.TenantID,
+		DockerfileReference: job.DockerfileReference,
+		Status:              models.JobStatusPending,
+		Payload:             string(payload),
+		Labels:              job.Metadata,
+	}
+	if !job.NotBefore.IsZero() {
+		stored.NotBefore = &job.NotBefore
 	}
+	err = c.jobs.Create(ctx, stored)
+	if err == nil {
+		c.jobAccepted(job)
+		c.notifyEvents()
+	}
+	if err != nil && !errors.Is(err, storage.ErrDuplicateJob) && job.IdempotencyKey != "" && c.idempotencyKeys != nil {
+		if releaseErr := queries.ReleaseIdempotencyKey(ctx, c.idempotencyKeys, job.TenantID, job.IdempotencyKey, job.JobID); releaseErr != nil {
+			c.jobLogger(job).Error("Failed to release idempotency key", zap.Error(releaseErr))
+		}
+	}
+	return err
 }
 
-func (c *Coordinator) monitorWorkers() {
+// jobAccepted sends the pending webhook of a newly accepted job.
+func (c *Coordinator) jobAccepted(job Job) {
+	metrics.JobsAccepted.WithLabelValues(job.TenantID).Inc()
+	c.webhooks.Register(job)
+	c.webhooks.Notify(models.JobEvent{JobID: job.JobID, TenantID: job.TenantID, Status: models.JobStatusPending})
+}
+
+// isDuplicate reports whether err means the submission was accepted before.
+func isDuplicate(err error) bool {
+	var duplicate *DuplicateSubmissionError
+	return errors.Is(err, storage.ErrDuplicateJob) || errors.As(err, &duplicate)
+}
+
+// persistJobWithRetry retries persistJob with backoff until it succeeds, the
+// job turns out to be a duplicate, or the coordinator stops.
+func (c *Coordinator) persistJobWithRetry(ctx context.Context, job Job, payload []byte) error {
+	backoff := time.Second
 	for {
-		time.Sleep(c.healthCheck)
-		c.mu.Lock()
-		for id, worker := range c.workers.workers {
-			if !worker.IsHealthy() {
-				log.Printf("Worker %s is unhealthy, removing from the list\n", id)
-				c.workers.RemoveWorker(id)
-			} else {
-				// fmt.Printf("Worker %s is healthy\n", id)
+		err := c.persistJob(ctx, job, payload)
+		if err == nil || isDuplicate(err) {
+			return err
+		}
+		c.jobLogger(job).Warn("Failed to store job, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return err
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// setJobStatus records a job's status change in storage and, once it is
+// stored, sends the job's webhook if it subscribed to the new status.
+func (c *Coordinator) setJobStatus(ctx context.Context, jobID, status, workerID, errorMessage string) {
+	ctx, span := tracing.Start(ctx, "job.status", trace.WithAttributes(tracing.JobIDKey.String(jobID), tracing.StatusKey.String(status)))
+	metrics.JobStatusChanges.WithLabelValues(status).Inc()
+	if c.jobs != nil {
+		err := c.updateJobState(ctx, jobID, status, workerID, errorMessage)
+		tracing.End(span, err)
+		if err != nil {
+			logging.ForJob(c.logger, ctx, jobID).Error("Failed to update job status", zap.String("status", status), zap.Error(err))
+			return
+		}
+		c.notifyEvents()
+	} else {
+		span.End()
+	}
+	// Webhooks only announce changes that were stored.
+	c.webhooks.Notify(models.JobEvent{
+		JobID:        jobID,
+		Status:       status,
+		WorkerID:     workerID,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// updateJobState reads the stored job and updates its status at the version
+// it read, retrying when another update got there first.
+func (c *Coordinator) updateJobState(ctx context.Context, jobID, status, workerID, errorMessage string) error {
+	for attempt := 0; ; attempt++ {
+		job, err := c.jobs.Get(ctx, jobID)
+		if err != nil {
+			return err
+		}
+		if job.Status == status && (workerID == "" || workerID == job.WorkerID) && (errorMessage == "" || errorMessage == job.ErrorMessage) {
+			return nil
+		}
+		_, err = c.jobs.UpdateState(ctx, jobID, storage.StateUpdate{
+			Status:          status,
+			WorkerID:        workerID,
+			ErrorMessage:    errorMessage,
+			ExpectedVersion: job.Version,
+		})
+		if !errors.Is(err, storage.ErrVersionConflict) || attempt == maxUpdateAttempts-1 {
+			return err
+		}
+	}
+}
+
+// checkSubmission returns an error if job cannot be accepted with the
+// current configuration, e.g. because webhooks cannot be sent to its callback.
+func (c *Coordinator) checkSubmission(job Job) error {
+	if job.Callback == nil {
+		return nil
+	}
+	if err := c.webhooks.CheckCallback(job.Callback); err != nil {
+		return fmt.Errorf("/job/callback: %w", err)
+	}
+	return nil
+}
+
+// checkWorkflowStep returns a check for the jobs of a new workflow's steps.
+// Besides checkSubmission, it rejects job IDs that are already stored: the
+// step's job could never be stored and the step would stay pending forever.
+func (c *Coordinator) checkWorkflowStep(ctx context.Context) func(Job) error {
+	return func(job Job) error {
+		if err := c.checkSubmission(job); err != nil {
+			return err
+		}
+		if c.jobs == nil {
+			return nil
+		}
+		_, err := c.jobs.Get(ctx, job.JobID)
+		if err == nil {
+			return fmt.Errorf("%w: %s", storage.ErrDuplicateJob, job.JobID)
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("%w: looking up job %s: %v", errWorkflowStore, job.JobID, err)
+		}
+		return nil
+	}
+}
+
+// parseJob decodes a job submission as published on the jobs topic or posted
+// to the API. Messages are validated against the schema of their envelope
+// version; invalid ones fail with a *queue.InvalidMessageError listing the
+// reasons. Jobs without a tenant fall back to the default tenant.
+func parseJob(data []byte) (Job, error) {
+	envelope, err := queue.DecodeJobEnvelope(data)
+	if err != nil {
+		return Job{}, err
+	}
+	spec := envelope.Job
+	tenantID := spec.TenantID
+	if tenantID == "" {
+		tenantID = defaultTenant
+	}
+
+	job := Job{
+		ID:                  spec.JobID,
+		JobID:               spec.JobID,
+		WorkerID:            "",
+		DockerfileReference: spec.DockerfileReference,
+		JobStatus:           "pending",
+		TenantID:            tenantID,
+		JobType:             spec.JobType,
+		NodeSelector:        spec.NodeSelector,
+		Resources:           Resources(spec.Resources),
+		Env:                 spec.Env,
+		IdempotencyKey:      spec.IdempotencyKey,
+		Metadata:            envelope.Metadata,
+		TraceContext:        envelope.TraceContext,
+	}
+	if spec.NotBefore != "" && spec.Delay != "" {
+		return Job{}, &queue.InvalidMessageError{SchemaVersion: envelope.SchemaVersion, Reasons: []string{"/job: not_before and delay are mutually exclusive"}}
+	}
+	if spec.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, spec.NotBefore)
+		if err != nil {
+			return Job{}, &queue.InvalidMessageError{SchemaVersion: envelope.SchemaVersion, Reasons: []string{"/job/not_before: must be an RFC 3339 time"}}
+		}
+		job.NotBefore = notBefore
+	}
+	if spec.Delay != "" {
+		delay, err := time.ParseDuration(spec.Delay)
+		if err != nil || delay < 0 {
+			return Job{}, &queue.InvalidMessageError{SchemaVersion: envelope.SchemaVersion, Reasons: []string{"/job/delay: must be a non-negative duration such as \"90s\""}}
+		}
+		job.Delay = delay
+		job.NotBefore = time.Now().Add(delay)
+	}
+	if spec.Callback != nil {
+		job.Callback = &Callback{URL: spec.Callback.URL, Events: spec.Callback.Events}
+	}
+	for _, term := range spec.Affinity {
+		job.Affinity = append(job.Affinity, AffinityTerm(term))
+	}
+	for _, term := range spec.AntiAffinity {
+		job.AntiAffinity = append(job.AntiAffinity, AffinityTerm(term))
+	}
+	for _, term := range append(slices.Clone(job.Affinity), job.AntiAffinity...) {
+		if err := term.Validate(); err != nil {
+			return Job{}, &queue.InvalidMessageError{SchemaVersion: envelope.SchemaVersion, Reasons: []string{err.Error()}}
+		}
+	}
+	return job, nil
+}
+
+// envelope returns job as a submission that parseJob turns back into it.
+func (job Job) envelope() queue.JobEnvelope {
+	spec := queue.JobSpec{
+		JobID:               job.JobID,
+		DockerfileReference: job.DockerfileReference,
+		TenantID:            job.TenantID,
+		JobType:             job.JobType,
+		IdempotencyKey:      job.IdempotencyKey,
+		NodeSelector:        job.NodeSelector,
+		Resources:           queue.Resources(job.Resources),
+		Env:                 job.Env,
+	}
+	if !job.NotBefore.IsZero() {
+		spec.NotBefore = job.NotBefore.Format(time.RFC3339)
+	}
+	if job.Callback != nil {
+		spec.Callback = &queue.Callback{URL: job.Callback.URL, Events: job.Callback.Events}
+	}
+	for _, term := range job.Affinity {
+		spec.Affinity = append(spec.Affinity, queue.AffinityTerm(term))
+	}
+	for _, term := range job.AntiAffinity {
+		spec.AntiAffinity = append(spec.AntiAffinity, queue.AffinityTerm(term))
+	}
+	envelope := queue.NewJobEnvelope(spec)
+	envelope.Metadata = job.Metadata
+	envelope.TraceContext = job.TraceContext
+	return envelope
+}
+
+// NewCoordinator creates a coordinator that stores jobs in jobs and keeps
+// idempotency keys, webhook deliveries, job events and MongoDB intake queues
+// in db. Either may be nil to run without them. It returns an error if the
+// configuration is invalid.
+func NewCoordinator(config *viper.Viper, db *mongo.Database, jobs storage.JobRepository, logger *zap.Logger) (*Coordinator, error) {
+	// Kafka is optional; it is used for job intake and job events when brokers are configured.
+	var kafkaClient *queue.KafkaClient
+	if brokers := config.GetStringSlice("kafka.brokers"); len(brokers) > 0 {
+		client, err := queue.NewKafkaClientFromConfig(config, logger.Named("kafka"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure Kafka: %w", err)
+		}
+		kafkaClient = client
+	}
+
+	var idempotencyKeys, webhookDeliveries, workflows *mongo.Collection
+	if db != nil {
+		idempotencyKeys = db.Collection(configString(config, "idempotency.collection", "idempotency_keys"))
+		webhookDeliveries = db.Collection(configString(config, "webhooks.collection", "webhook_deliveries"))
+		workflows = db.Collection(configString(config, "workflows.collection", "workflows"))
+	}
+	idempotencyRetention, err := configDuration(config, "idempotency.retention", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	intake, err := newIntake(config, db, kafkaClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure job intake: %w", err)
+	}
+	spill, err := newSpill(config, db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure intake spill: %w", err)
+	}
+
+	// Job events need both the outbox and a Kafka producer, and the outbox
+	// has to live next to the jobs to be written in the same transaction.
+	var outbox *mongo.Collection
+	if kafkaClient != nil && config.GetBool("events.enabled") {
+		if mongoJobs, ok := jobs.(*storage.MongoJobRepository); ok && db != nil {
+			outbox = db.Collection(configString(config, "events.outbox_collection", "job_events_outbox"))
+			mongoJobs.SetOutbox(outbox)
+		} else {
+			logger.Warn("Job events need MongoDB job storage, disabling them")
+		}
+	}
+	eventsPollInterval, err := configDuration(config, "events.poll_interval", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	eventsRetention, err := configDuration(config, "events.retention", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates *jobstream.Watcher
+	if config.GetBool("job_updates.enabled") {
+		if mongoJobs, ok := jobs.(*storage.MongoJobRepository); ok {
+			historySize := config.GetInt("job_updates.history_size")
+			if historySize <= 0 {
+				historySize = 1000
 			}
-			if worker.IsFree() {
-				select {
-				case job := <-c.jobQueue:
-					worker.AssignJob(job)
-				default:
-					// No job available in the queue
-				}
+			bufferSize := config.GetInt("job_updates.buffer_size")
+			if bufferSize <= 0 {
+				bufferSize = 256
 			}
+			updates = jobstream.NewWatcher(mongoJobs, historySize, bufferSize, logger.Named("jobstream"))
+		} else {
+			logger.Warn("Job updates need MongoDB job storage, disabling them")
+		}
+	}
+	updatesKeepalive, err := configDuration(config, "job_updates.keepalive", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheck, err := time.ParseDuration(config.GetString("workers.heartbeat_interval"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration for workers.heartbeat_interval: %w", err)
+	}
+	lostTimeout, err := configDuration(config, "workers.lost_timeout", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	workerToken := config.GetString("workers.token")
+	if env := os.Getenv(workerTokenEnv); env != "" {
+		workerToken = env
+	}
+	if workerToken == "" {
+		logger.Warn("No workers.token configured, job completion reports are not authenticated")
+	}
+	pressure, err := newBackpressureFromConfig(config, logger.Named("backpressure"))
+	if err != nil {
+		return nil, err
+	}
+	tenants, err := NewFairShareQueueFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	scheduler, err := NewScheduler(config.GetString("scheduler.strategy"))
+	if err != nil {
+		return nil, err
+	}
+	rateLimits, err := newJobRateLimiterFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := newRetentionSweeperFromConfig(config, jobs, webhookDeliveries, logger.Named("retention"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure retention: %w", err)
+	}
+	done := make(chan struct{})
+	webhooks, err := NewWebhookDispatcherFromConfig(config, webhookDeliveries, done, logger.Named("webhooks"))
+	if err != nil {
+		return nil, err
+	}
+	workers, err := InitializeWorkersFromConfig(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Coordinator{
+		logger:               logger,
+		workers:              workers,
+		mu:                   sync.Mutex{},
+		healthCheck:          healthCheck,
+		lostTimeout:          lostTimeout,
+		workerToken:          workerToken,
+		intake:               intake,
+		kafkaClient:          kafkaClient,
+		spill:                spill,
+		backpressure:         pressure,
+		tenants:              tenants,
+		scheduler:            scheduler,
+		decisions:            newDecisionLog(config.GetInt("scheduler.trace_size")),
+		workflows:            NewWorkflowManager(workflows, logger.Named("workflows")),
+		delayed:              queue.NewInMemoryQueue(0),
+		rateLimits:           rateLimits,
+		webhooks:             webhooks,
+		jobs:                 jobs,
+		retention:            retention,
+		idempotencyKeys:      idempotencyKeys,
+		idempotencyRetention: idempotencyRetention,
+		outbox:               outbox,
+		eventsTopic:          configString(config, "events.topic", "job-events"),
+		eventsPollInterval:   eventsPollInterval,
+		eventsRetention:      eventsRetention,
+		eventsWake:           make(chan struct{}, 1),
+		updates:              updates,
+		updatesKeepalive:     updatesKeepalive,
+		address:              config.GetString("node.address"),
+		wake:                 make(chan struct{}, 1),
+		done:                 done,
+	}, nil
+}
+
+// newIntake creates the job intake selected by intake.backend: "kafka",
+// "mongo" or "memory". Without a backend, Kafka is used when brokers are
+// configured; otherwise jobs are only accepted over the API and nil is
+// returned.
+func newIntake(config *viper.Viper, db *mongo.Database, kafkaClient *queue.KafkaClient) (queue.Intake, error) {
+	backend := config.GetString("intake.backend")
+	if backend == "" && kafkaClient != nil {
+		backend = "kafka"
+	}
+	switch backend {
+	case "":
+		return nil, nil
+	case "kafka":
+		if kafkaClient == nil {
+			return nil, fmt.Errorf("intake.backend is kafka but no kafka.brokers are configured")
+		}
+		return queue.NewKafkaIntake(kafkaClient), nil
+	case "mongo":
+		if db == nil {
+			return nil, fmt.Errorf("intake.backend is mongo but MongoDB is not connected")
+		}
+		visibilityTimeout, err := configDuration(config, "intake.mongo.visibility_timeout", 30*time.Second)
+		if err != nil {
+			return nil, err
 		}
-		c.mu.Unlock()
+		pollInterval, err := configDuration(config, "intake.mongo.poll_interval", time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return queue.NewMongoIntake(db.Collection(configString(config, "intake.mongo.collection", "job_queue")), visibilityTimeout, pollInterval)
+	case "memory":
+		visibilityTimeout, err := configDuration(config, "intake.memory.visibility_timeout", queue.DefaultVisibilityTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return queue.NewMemoryIntake(visibilityTimeout), nil
+	}
+	return nil, fmt.Errorf("unknown intake.backend %q", backend)
+}
+
+// newSpill creates the MongoDB queue that messages are moved to while
+// backpressure pauses the intake, or returns nil when
+// backpressure.spill.enabled is off.
+func newSpill(config *viper.Viper, db *mongo.Database) (*queue.MongoIntake, error) {
+	if !config.GetBool("backpressure.spill.enabled") {
+		return nil, nil
+	}
+	if db == nil {
+		return nil, fmt.Errorf("backpressure.spill.enabled is set but MongoDB is not connected")
+	}
+	visibilityTimeout, err := configDuration(config, "backpressure.spill.visibility_timeout", 30*time.Second)
+	if err != nil {
+		return nil, err
 	}
+	return queue.NewMongoIntake(db.Collection(configString(config, "backpressure.spill.collection", "job_spill")), visibilityTimeout, time.Second)
 }
 
-func InitializeWorkersFromConfig(config *viper.Viper) WorkerManager {
+// InitializeWorkersFromConfig returns a WorkerManager with the workers listed
+// in workers.list. Each entry needs a string id and address.
+func InitializeWorkersFromConfig(config *viper.Viper, logger *zap.Logger) (*WorkerManager, error) {
 	workerManager := NewWorkerManager()
 
-	workers := config.Get("workers.list").([]interface{})
+	workers, ok := config.Get("workers.list").([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("workers.list must be a list of workers")
+	}
 
-	for _, worker := range workers {
-		workerMap := worker.(map[string]interface{}) // Convert to map[string]interface{}
-		id := workerMap["id"].(string)
-		name := workerMap["name"].(string)
-		address := workerMap["address"].(string)
+	for i, worker := range workers {
+		workerMap, ok := worker.(map[string]interface{}) // Convert to map[string]interface{}
+		if !ok {
+			return nil, fmt.Errorf("workers.list[%d] must be a map", i)
+		}
+		id, ok := workerMap["id"].(string)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("workers.list[%d].id must be a non-empty string", i)
+		}
+		address, ok := workerMap["address"].(string)
+		if !ok || address == "" {
+			return nil, fmt.Errorf("workers.list[%d].address must be a non-empty string", i)
+		}
+		name, _ := workerMap["name"].(string)
+		slots := 1
+		if configSlots, ok := workerMap["slots"].(int); ok && configSlots > 0 {
+			slots = configSlots
+		}
+		var capacity Resources
+		if configCapacity, ok := workerMap["capacity"].(map[string]interface{}); ok {
+			capacity.CPU = toFloat(configCapacity["cpu"])
+			capacity.MemoryMB = int(toFloat(configCapacity["memory_mb"]))
+		}
+		labels := make(map[string]string)
+		if configLabels, ok := workerMap["labels"].(map[string]interface{}); ok {
+			for key, value := range configLabels {
+				labels[key] = fmt.Sprint(value)
+			}
+		}
 		// // Create a new worker and add it to the WorkerManager
-		log.Print("Adding worker to manager", id, name, address)
+		logger.Info("Adding worker to manager", logging.WorkerID(id), zap.String("name", name), zap.String("address", address))
 		newWorker := Worker{
-			ID:          id,
-			Name:        name,
-			Address:     address,
-			AssignedJob: nil,
+			ID:           id,
+			Name:         name,
+			Address:      address,
+			AssignedJobs: make(map[string]Job),
+			Slots:        slots,
+			Capacity:     capacity,
+			CachedImages: make(map[string]bool),
+			StaticLabels: labels,
+			Labels:       labels,
+			assignedAt:   make(map[string]time.Time),
 		}
 		// newWorker.updateHealth()
 		// newWorker.UpdateJobStatus()
 		workerManager.AddWorker(&newWorker)
 	}
-	log.Print("Initializing workers from config")
-	return *workerManager
+	logger.Info("Initialized workers from config", zap.Int("workers", len(workers)))
+	return workerManager, nil
+}
+
+// toFloat converts a numeric config value to float64, returning 0 for anything else.
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
 }
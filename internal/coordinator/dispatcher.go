@@ -0,0 +1,421 @@
+package coordinator
+
+import (
+	"context"
+	"execution-service/internal/logging"
+	"execution-service/internal/metrics"
+	"execution-service/internal/models"
+	"execution-service/internal/queue"
+	"execution-service/internal/storage"
+	"execution-service/internal/tracing"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// assignment is a job reserved on a worker that still has to be sent to it.
+type assignment struct {
+	job    Job
+	worker *Worker
+}
+
+// Submit adds a job to the pending queue and wakes the dispatcher. Jobs with
+// a NotBefore time in the future wait in the delay queue until then.
+func (c *Coordinator) Submit(job Job) {
+	c.webhooks.Register(job)
+	if wait := time.Until(job.NotBefore); wait > 0 {
+		c.delayed.EnqueueAfter(context.Background(), queue.Job{ID: job.JobID, Payload: job}, wait)
+		return
+	}
+	job.queuedAt = time.Now()
+	c.tenants.Push(job)
+	c.notify()
+}
+
+// delayLoop releases delayed jobs into the pending queue once they are due.
+func (c *Coordinator) delayLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-c.done
+		cancel()
+	}()
+	for {
+		lease, err := c.delayed.Dequeue(ctx)
+		if err != nil {
+			return // coordinator stopped
+		}
+		c.delayed.Ack(ctx, lease.ID)
+		job := lease.Job.Payload.(Job)
+		job.queuedAt = time.Now()
+		c.tenants.Push(job)
+		c.notify()
+	}
+}
+
+// CompleteJob records that a worker finished a job, freeing its slot and the
+// tenant's quota, queues any workflow steps that were waiting on it, and
+// wakes the dispatcher. Unknown workers, and jobs not assigned to the worker,
+// are ignored: the health check or recovery has already finished them.
+func (c *Coordinator) CompleteJob(ctx context.Context, workerID, jobID string, result JobResult) {
+	worker, ok := c.workers.GetWorker(workerID)
+	if !ok {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "job.complete", trace.WithAttributes(tracing.JobIDKey.String(jobID),
+		tracing.WorkerIDKey.String(workerID), tracing.StatusKey.String(result.Status)))
+	defer span.End()
+	c.mu.Lock()
+	job, ok := worker.AssignedJobs[jobID]
+	if ok {
+		worker.unreserve(jobID)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	c.tenants.Release(job.TenantID)
+	c.finishJob(ctx, workerID, jobID, job.Attempt, result)
+}
+
+// finishJob stores the final status of a job that is no longer reserved on
+// its worker, queues the workflow steps that were waiting on it and wakes the
+// dispatcher.
+func (c *Coordinator) finishJob(ctx context.Context, workerID, jobID string, attempt int, result JobResult) {
+	logger := logging.ForJob(c.logger, ctx, jobID).With(logging.WorkerID(workerID))
+	if attempt > 0 {
+		logger = logger.With(logging.Attempt(attempt))
+	}
+	logger.Info("Job finished", zap.String("status", result.Status), zap.String("error", result.Error))
+	if result.Succeeded() {
+		c.setJobStatus(ctx, jobID, models.JobStatusSucceeded, workerID, "")
+	} else {
+		c.setJobStatus(ctx, jobID, models.JobStatusFailed, workerID, result.Error)
+	}
+	if next := c.workflows.JobFinished(jobID, result); len(next) > 0 {
+		go c.submitWorkflowJobs(next)
+	}
+	c.notify()
+}
+
+// notify wakes the dispatch loop without blocking. Events that arrive while a
+// wake-up is already pending are coalesced into it.
+func (c *Coordinator) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchLoop assigns pending jobs whenever a job arrives or a slot frees up.
+// The heartbeat tick is only a safety net for missed events, e.g. rate limits
+// whose tokens have refilled.
+func (c *Coordinator) dispatchLoop() {
+	ticker := time.NewTicker(c.healthCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.wake:
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+		for _, a := range c.schedule() {
+			go c.send(a)
+		}
+	}
+}
+
+// schedule picks workers for as many pending jobs as possible and reserves
+// their slots. It only holds the scheduling lock for in-memory work; the
+// returned assignments are sent to the workers afterwards.
+func (c *Coordinator) schedule() []assignment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	workers := make([]*Worker, 0, len(c.workers.workers))
+	now := time.Now()
+	for _, w := range c.workers.ListWorkers() {
+		if w.Status != "inactive" && !now.Before(w.backoffUntil) {
+			workers = append(workers, w)
+		}
+	}
+
+	var assignments []assignment
+	for {
+		// Without a free slot no job fits, so the pending queue is not
+		// scanned at all.
+		free := make([]*Worker, 0, len(workers))
+		for _, w := range workers {
+			if w.FreeSlots() > 0 {
+				free = append(free, w)
+			}
+		}
+		if len(free) == 0 {
+			return assignments
+		}
+
+		job, ok := c.tenants.Next(func(job Job) bool {
+			if !c.rateLimits.Allow(job, now) {
+				return false
+			}
+			for _, w := range free {
+				if ok, _ := canRun(job, w); ok {
+					return true
+				}
+			}
+			return false
+		})
+		if !ok {
+			return assignments
+		}
+
+		decision := Decision{
+			JobID:    job.JobID,
+			TenantID: job.TenantID,
+			Strategy: c.scheduler.Name(),
+			Time:     time.Now(),
+		}
+		candidates := make([]*Worker, 0, len(workers))
+		for _, w := range workers {
+			if ok, reason := canRun(job, w); ok {
+				candidates = append(candidates, w)
+			} else {
+				decision.Rejected = append(decision.Rejected, CandidateScore{WorkerID: w.ID, Reason: reason})
+			}
+		}
+		worker, scores := c.scheduler.Select(job, candidates)
+		decision.WorkerID = worker.ID
+		decision.Candidates = scores
+		c.decisions.Record(decision)
+
+		c.rateLimits.Take(job, now)
+		job.WorkerID = worker.ID
+		job.Attempt++
+		worker.reserve(job)
+		assignments = append(assignments, assignment{job: job, worker: worker})
+	}
+}
+
+// send delivers a reserved job to its worker. If the worker rejects it, the
+// reservation is dropped, the job goes back to the front of its queue and the
+// worker gets no jobs for a backoff that grows with every refusal in a row,
+// up to the heartbeat interval. Other workers may take the job meanwhile.
+func (c *Coordinator) send(a assignment) {
+	start := time.Now()
+	ctx := jobContext(a.job)
+	if !a.job.queuedAt.IsZero() {
+		_, queued := tracing.Start(ctx, "job.queue", trace.WithTimestamp(a.job.queuedAt),
+			trace.WithAttributes(tracing.JobIDKey.String(a.job.JobID), tracing.TenantIDKey.String(a.job.TenantID)))
+		queued.End(trace.WithTimestamp(start))
+	}
+	ctx, span := tracing.Start(ctx, "job.dispatch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.JobIDKey.String(a.job.JobID), tracing.WorkerIDKey.String(a.worker.ID)))
+	defer span.End()
+
+	err := a.worker.AssignJob(ctx, a.job)
+	metrics.DispatchDuration.WithLabelValues(a.worker.ID, metrics.Outcome(err)).Observe(time.Since(start).Seconds())
+	if err != nil {
+		tracing.End(span, err)
+		c.jobLogger(a.job).Warn("Failed to assign job to worker", zap.Error(err))
+		metrics.JobRetries.WithLabelValues("rejected").Inc()
+		c.mu.Lock()
+		a.worker.unreserve(a.job.JobID)
+		backoff := a.worker.rejected(time.Now(), max(c.healthCheck, initialRejectBackoff))
+		c.mu.Unlock()
+		c.tenants.Requeue(a.job)
+		c.rateLimits.Refund(a.job)
+		c.notify()
+		time.AfterFunc(backoff, c.notify)
+		return
+	}
+
+	if !a.job.queuedAt.IsZero() {
+		metrics.QueueWait.WithLabelValues(a.job.TenantID).Observe(start.Sub(a.job.queuedAt).Seconds())
+	}
+	c.mu.Lock()
+	a.worker.CachedImages[a.job.DockerfileReference] = true
+	a.worker.rejections = 0
+	sent := a.worker.markSent(a.job.JobID)
+	c.mu.Unlock()
+	if !sent {
+		return // the worker already reported the job finished
+	}
+	c.setJobStatus(ctx, a.job.JobID, models.JobStatusAssigned, a.worker.ID, "")
+	c.jobLogger(a.job).Info("Assigned job to worker", zap.String("scheduler", c.scheduler.Name()))
+}
+
+// healthLoop probes every worker once per heartbeat interval.
+func (c *Coordinator) healthLoop() {
+	ticker := time.NewTicker(c.healthCheck)
+	defer ticker.Stop()
+	for {
+		c.checkWorkers()
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// checkWorkers probes all workers concurrently without holding the scheduling
+// lock, then applies the results:
+//
+//   - Unhealthy workers are marked inactive. Their jobs stay reserved, as
+//     they may still be running, until the worker has been unreachable for
+//     lostTimeout; then the jobs fail.
+//   - Jobs a worker stopped running without reporting their result are
+//     finished from the attempt the worker recorded, or queued again if there
+//     is none.
+func (c *Coordinator) checkWorkers() {
+	workers := c.workers.ListWorkers()
+	probes := probeWorkers(workers)
+
+	freed := false
+	var returned []int
+	var lost []*Worker
+	missing := make(map[*Worker][]Job)
+	c.mu.Lock()
+	for i, w := range workers {
+		probe := probes[i]
+		if !probe.healthy {
+			if w.Status != "inactive" {
+				c.logger.Warn("Worker is unhealthy, marking it inactive", logging.WorkerID(w.ID))
+				w.inactiveSince = probe.startedAt
+			}
+			w.Status = "inactive"
+			if !w.lost && time.Since(w.inactiveSince) >= c.lostTimeout {
+				w.lost = true
+				lost = append(lost, w)
+			}
+			continue
+		}
+		if w.Status == "inactive" {
+			c.logger.Info("Worker is healthy again", logging.WorkerID(w.ID))
+			w.Status = "active"
+			w.lost = false
+			freed = true
+			returned = append(returned, i)
+		}
+		if probe.err != nil {
+			c.logger.Warn("Error probing worker", logging.WorkerID(w.ID), zap.Error(probe.err))
+		}
+		if jobs := w.applyProbe(probe); len(jobs) > 0 {
+			missing[w] = jobs
+		}
+	}
+	c.mu.Unlock()
+
+	for _, w := range lost {
+		c.failLostJobs(context.TODO(), w)
+	}
+	for w, jobs := range missing {
+		for _, job := range jobs {
+			c.finishMissingJob(context.TODO(), w, job)
+		}
+		freed = true
+	}
+
+	// Jobs assigned to a worker were dropped while it was unreachable; it
+	// may have finished them, still be running them or have lost them.
+	for _, i := range returned {
+		if c.jobs == nil || probes[i].running == nil {
+			continue
+		}
+		if err := c.recoverWorker(context.TODO(), workers[i], probes[i].running); err != nil {
+			c.logger.Error("Failed to recover jobs of worker", logging.WorkerID(workers[i].ID), zap.Error(err))
+		}
+	}
+
+	if freed {
+		c.notify()
+	}
+}
+
+// failLostJobs fails the jobs assigned to w once it has been unreachable for
+// lostTimeout, including jobs stored as assigned to it that the coordinator
+// did not track since a restart.
+func (c *Coordinator) failLostJobs(ctx context.Context, w *Worker) {
+	c.logger.Warn("Worker was lost, failing its jobs", logging.WorkerID(w.ID), zap.Duration("unreachable_for", time.Since(w.inactiveSince)))
+	result := JobResult{Status: "error", Error: fmt.Sprintf("worker %s was lost", w.ID)}
+	c.mu.Lock()
+	jobIDs := make([]string, 0, len(w.AssignedJobs))
+	for jobID := range w.AssignedJobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	c.mu.Unlock()
+	for _, jobID := range jobIDs {
+		c.CompleteJob(ctx, w.ID, jobID, result)
+	}
+	if c.jobs == nil {
+		return
+	}
+	stored, err := c.listStoredJobs(ctx, storage.JobFilter{Status: models.JobStatusAssigned, WorkerID: w.ID})
+	if err != nil {
+		c.logger.Error("Failed to list jobs of lost worker", logging.WorkerID(w.ID), zap.Error(err))
+		return
+	}
+	for _, job := range stored {
+		if !slices.Contains(jobIDs, job.JobID) {
+			c.finishJob(ctx, w.ID, job.JobID, 0, result)
+		}
+	}
+}
+
+// finishMissingJob handles a job w stopped running without reporting its
+// result: it is finished from the attempt w recorded for it, or queued again
+// if w never ran it, e.g. because it restarted.
+func (c *Coordinator) finishMissingJob(ctx context.Context, w *Worker, job Job) {
+	ctx = tracing.Extract(ctx, job.TraceContext)
+	c.mu.Lock()
+	sentAt := w.assignedAt[job.JobID]
+	c.mu.Unlock()
+	if c.jobs != nil {
+		attempts, err := c.jobs.Attempts(ctx, job.JobID)
+		if err != nil {
+			c.jobLogger(job).Error("Failed to read attempts of job", zap.Error(err))
+			return // try again at the next probe
+		}
+		if n := len(attempts); n > 0 && attempts[n-1].WorkerID == w.ID && attempts[n-1].ExecutionCompletionTime.After(sentAt) {
+			c.CompleteJob(ctx, w.ID, job.JobID, attemptResult(attempts[n-1]))
+			return
+		}
+	}
+
+	c.mu.Lock()
+	_, tracked := w.AssignedJobs[job.JobID]
+	if tracked {
+		w.unreserve(job.JobID)
+	}
+	c.mu.Unlock()
+	if !tracked {
+		return
+	}
+	c.jobLogger(job).Warn("Worker is no longer running job, queueing it again")
+	c.tenants.Release(job.TenantID)
+	c.setJobStatus(ctx, job.JobID, models.JobStatusPending, "", "")
+	job.WorkerID = ""
+	c.Submit(job)
+	metrics.JobRetries.WithLabelValues("lost").Inc()
+}
+
+// probeWorkers probes workers concurrently without holding the scheduling
+// lock.
+func probeWorkers(workers []*Worker) []workerProbe {
+	probes := make([]workerProbe, len(workers))
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probes[i] = w.Probe()
+		}()
+	}
+	wg.Wait()
+	return probes
+}
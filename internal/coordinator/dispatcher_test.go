@@ -0,0 +1,102 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// BenchmarkDispatch measures how many jobs per second the coordinator
+// dispatches to fake workers that accept every job and report it finished
+// straight away, so the numbers reflect scheduling and HTTP dispatch
+// overhead rather than job execution.
+func BenchmarkDispatch(b *testing.B) {
+	for _, strategy := range []string{"round-robin", "least-loaded", "bin-packing", "locality"} {
+		b.Run(strategy, func(b *testing.B) {
+			benchmarkDispatch(b, strategy, 50, 4, 4)
+		})
+	}
+}
+
+func benchmarkDispatch(b *testing.B, strategy string, workers, slots, tenants int) {
+	// Every finished job is signalled here; the channel holds zero-size
+	// values so a large buffer is cheap.
+	completed := make(chan struct{}, b.N)
+	var c *Coordinator
+
+	list := make([]interface{}, 0, workers)
+	for i := 0; i < workers; i++ {
+		id := fmt.Sprintf("fake-worker-%d", i)
+		server := httptest.NewServer(fakeWorker(slots, func(jobID string) {
+			c.CompleteJob(context.Background(), id, jobID, JobResult{Status: "success"})
+			completed <- struct{}{}
+		}))
+		b.Cleanup(server.Close)
+		list = append(list, map[string]interface{}{
+			"id":      id,
+			"name":    id,
+			"address": server.URL,
+			"slots":   slots,
+		})
+	}
+
+	config := viper.New()
+	config.Set("node.address", "127.0.0.1:0")
+	config.Set("workers.heartbeat_interval", "1s")
+	config.Set("workers.list", list)
+	config.Set("scheduler.strategy", strategy)
+	var err error
+	c, err = NewCoordinator(config, nil, nil, zap.NewNop())
+	if err != nil {
+		b.Fatalf("NewCoordinator: %v", err)
+	}
+	if err := c.Start(); err != nil {
+		b.Fatalf("Start: %v", err)
+	}
+	b.Cleanup(func() { c.Stop() })
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Submit(Job{
+			ID:                  fmt.Sprintf("bench-%d", i),
+			JobID:               fmt.Sprintf("bench-%d", i),
+			DockerfileReference: fmt.Sprintf("https://example.com/%d/Dockerfile", i%16),
+			JobStatus:           "pending",
+			TenantID:            fmt.Sprintf("tenant-%d", i%tenants),
+		})
+	}
+	for i := 0; i < b.N; i++ {
+		<-completed
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "dispatches/s")
+}
+
+// fakeWorker serves the worker API and finishes every job as soon as it is accepted.
+func fakeWorker(slots int, finish func(jobID string)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(wr http.ResponseWriter, req *http.Request) {
+		wr.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/info", func(wr http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(wr).Encode(map[string]interface{}{"Slots": slots})
+	})
+	mux.HandleFunc("/job", func(wr http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(wr).Encode(map[string]interface{}{"JobID": "", "JobIDs": []string{}})
+	})
+	mux.HandleFunc("/execute", func(wr http.ResponseWriter, req *http.Request) {
+		var job Job
+		if err := json.NewDecoder(req.Body).Decode(&job); err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wr.WriteHeader(http.StatusOK)
+		go finish(job.JobID)
+	})
+	return mux
+}
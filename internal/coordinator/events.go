@@ -0,0 +1,80 @@
+package coordinator
+
+import (
+	"context"
+	"execution-service/internal/logging"
+	"execution-service/internal/queries"
+	"execution-service/internal/tracing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// eventBatchSize is the number of outbox events read per publishing round.
+const eventBatchSize = 100
+
+// notifyEvents wakes the event publisher after a job event was written.
+func (c *Coordinator) notifyEvents() {
+	if c.outbox == nil {
+		return
+	}
+	select {
+	case c.eventsWake <- struct{}{}:
+	default:
+	}
+}
+
+// publishEvents relays job events from the outbox to the events topic. Events
+// are published in the order they were written, keyed by job ID so each
+// job's events stay ordered within a partition. An event is only marked
+// published after Kafka acknowledged it, so delivery is at-least-once;
+// consumers deduplicate on event_id.
+func (c *Coordinator) publishEvents() {
+	ticker := time.NewTicker(c.eventsPollInterval)
+	defer ticker.Stop()
+	for {
+		for c.publishEventBatch() {
+		}
+		select {
+		case <-c.eventsWake:
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// publishEventBatch publishes the oldest unpublished events and reports
+// whether a full batch was published, i.e. more events may be waiting.
+func (c *Coordinator) publishEventBatch() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	events, err := queries.FindUnpublishedEvents(ctx, c.outbox, eventBatchSize)
+	cancel()
+	if err != nil {
+		c.logger.Error("Failed to read job events from the outbox", zap.Error(err))
+		return false
+	}
+	for _, event := range events {
+		ctx, cancel := context.WithTimeout(tracing.Extract(context.Background(), event.TraceContext), 30*time.Second)
+		ctx, span := tracing.Start(ctx, "job.event.publish", trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(tracing.JobIDKey.String(event.JobID), tracing.StatusKey.String(event.Status)))
+		err := c.kafkaClient.ProduceMessage(ctx, c.eventsTopic, event.JobID, event)
+		tracing.End(span, err)
+		if err != nil {
+			// Stop at the first failure so later events of the same job are
+			// not published ahead of this one.
+			c.logger.Error("Failed to publish job event", zap.String("event_id", event.EventID),
+				logging.JobID(event.JobID), logging.TraceID(ctx), zap.Error(err))
+			cancel()
+			return false
+		}
+		err = queries.MarkEventPublished(ctx, c.outbox, event.ID)
+		cancel()
+		if err != nil {
+			c.logger.Error("Failed to mark job event as published", zap.String("event_id", event.EventID), logging.JobID(event.JobID), zap.Error(err))
+			return false
+		}
+	}
+	return len(events) == eventBatchSize
+}
@@ -0,0 +1,106 @@
+package coordinator
+
+import (
+	"context"
+	"execution-service/internal/models"
+	"execution-service/internal/queue"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	queueDepthDesc = prometheus.NewDesc("execution_queue_depth",
+		"Jobs waiting for dispatch, by tenant.", []string{"tenant_id"}, nil)
+	delayedJobsDesc = prometheus.NewDesc("execution_delayed_jobs",
+		"Jobs waiting for their not_before time.", nil, nil)
+	jobsDesc = prometheus.NewDesc("execution_jobs",
+		"Jobs the coordinator is tracking, by status.", []string{"status"}, nil)
+	workerUpDesc = prometheus.NewDesc("execution_worker_up",
+		"Whether the worker passed its last health check.", []string{"worker_id"}, nil)
+	workerSlotsDesc = prometheus.NewDesc("execution_worker_slots",
+		"Jobs the worker runs concurrently.", []string{"worker_id"}, nil)
+	workerAssignedDesc = prometheus.NewDesc("execution_worker_assigned_jobs",
+		"Jobs assigned to the worker that have not finished.", []string{"worker_id"}, nil)
+	intakeLagDesc = prometheus.NewDesc("execution_intake_lag",
+		"Messages waiting in the intake, e.g. Kafka consumer lag.", []string{"intake"}, nil)
+	intakeLagSecondsDesc = prometheus.NewDesc("execution_intake_lag_seconds",
+		"Age of the last message received from the intake when it was received.", []string{"intake"}, nil)
+	intakePausedDesc = prometheus.NewDesc("execution_intake_paused",
+		"Whether backpressure holds back the intake.", []string{"intake"}, nil)
+	spillDepthDesc = prometheus.NewDesc("execution_intake_spill_depth",
+		"Messages waiting in the spill queue.", nil, nil)
+)
+
+// metricsCollector reads queue depths and worker state when metrics are
+// scraped.
+type metricsCollector struct {
+	c *Coordinator
+}
+
+func (m metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{queueDepthDesc, delayedJobsDesc, jobsDesc, workerUpDesc, workerSlotsDesc,
+		workerAssignedDesc, intakeLagDesc, intakeLagSecondsDesc, intakePausedDesc, spillDepthDesc} {
+		ch <- desc
+	}
+}
+
+func (m metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c := m.c
+	pending := 0
+	for _, usage := range c.tenants.Usage() {
+		pending += usage.Pending
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(usage.Pending), usage.TenantID)
+	}
+	delayed, _ := c.delayed.Len(context.Background())
+	ch <- prometheus.MustNewConstMetric(delayedJobsDesc, prometheus.GaugeValue, float64(delayed))
+
+	assigned := 0
+	c.mu.Lock()
+	for _, w := range c.workers.ListWorkers() {
+		up := 0.0
+		if w.Status != "inactive" {
+			up = 1
+		}
+		assigned += len(w.AssignedJobs)
+		ch <- prometheus.MustNewConstMetric(workerUpDesc, prometheus.GaugeValue, up, w.ID)
+		ch <- prometheus.MustNewConstMetric(workerSlotsDesc, prometheus.GaugeValue, float64(w.Slots), w.ID)
+		ch <- prometheus.MustNewConstMetric(workerAssignedDesc, prometheus.GaugeValue, float64(len(w.AssignedJobs)), w.ID)
+	}
+	c.mu.Unlock()
+	ch <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(pending+delayed), models.JobStatusPending)
+	ch <- prometheus.MustNewConstMetric(jobsDesc, prometheus.GaugeValue, float64(assigned), models.JobStatusAssigned)
+
+	if c.intake == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stats := c.IntakeStats(ctx)
+	intake := intakeName(c.intake)
+	if stats.Lag >= 0 {
+		ch <- prometheus.MustNewConstMetric(intakeLagDesc, prometheus.GaugeValue, float64(stats.Lag), intake)
+	}
+	ch <- prometheus.MustNewConstMetric(intakeLagSecondsDesc, prometheus.GaugeValue, stats.LagSeconds, intake)
+	paused := 0.0
+	if stats.Paused {
+		paused = 1
+	}
+	ch <- prometheus.MustNewConstMetric(intakePausedDesc, prometheus.GaugeValue, paused, intake)
+	if c.spill != nil {
+		ch <- prometheus.MustNewConstMetric(spillDepthDesc, prometheus.GaugeValue, float64(stats.SpillDepth))
+	}
+}
+
+// intakeName returns the intake backend, for the intake label.
+func intakeName(intake queue.Intake) string {
+	switch intake.(type) {
+	case *queue.KafkaIntake:
+		return "kafka"
+	case *queue.MongoIntake:
+		return "mongo"
+	case *queue.MemoryIntake:
+		return "memory"
+	}
+	return "other"
+}
@@ -0,0 +1,89 @@
+package coordinator
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Supported AffinityTerm operators.
+const (
+	OperatorIn           = "In"
+	OperatorNotIn        = "NotIn"
+	OperatorExists       = "Exists"
+	OperatorDoesNotExist = "DoesNotExist"
+)
+
+// AffinityTerm matches worker labels. As a preferred affinity it adds Weight
+// to the score of workers it matches; as an anti-affinity it subtracts it.
+type AffinityTerm struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+	Weight   int      `json:"weight,omitempty"`
+}
+
+// Validate checks that the term uses a known operator with suitable values.
+func (t AffinityTerm) Validate() error {
+	if t.Key == "" {
+		return fmt.Errorf("affinity term is missing key")
+	}
+	switch t.Operator {
+	case OperatorIn, OperatorNotIn:
+		if len(t.Values) == 0 {
+			return fmt.Errorf("affinity term %q with operator %s requires values", t.Key, t.Operator)
+		}
+	case OperatorExists, OperatorDoesNotExist:
+	default:
+		return fmt.Errorf("affinity term %q has unknown operator %q", t.Key, t.Operator)
+	}
+	return nil
+}
+
+// Matches reports whether labels satisfy the term.
+func (t AffinityTerm) Matches(labels map[string]string) bool {
+	value, ok := labels[t.Key]
+	switch t.Operator {
+	case OperatorIn:
+		return ok && slices.Contains(t.Values, value)
+	case OperatorNotIn:
+		return !ok || !slices.Contains(t.Values, value)
+	case OperatorExists:
+		return ok
+	case OperatorDoesNotExist:
+		return !ok
+	}
+	return false
+}
+
+func (t AffinityTerm) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// matchesNodeSelector reports whether labels contain every key/value pair of selector.
+func matchesNodeSelector(selector, labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// affinityScore scores labels against a job's preferred affinity and anti-affinity terms.
+func affinityScore(job Job, labels map[string]string) int {
+	score := 0
+	for _, term := range job.Affinity {
+		if term.Matches(labels) {
+			score += term.weight()
+		}
+	}
+	for _, term := range job.AntiAffinity {
+		if term.Matches(labels) {
+			score -= term.weight()
+		}
+	}
+	return score
+}
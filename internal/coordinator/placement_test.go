@@ -0,0 +1,117 @@
+package coordinator
+
+import "testing"
+
+func TestAffinityTermValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		term    AffinityTerm
+		wantErr bool
+	}{
+		{"in with values", AffinityTerm{Key: "region", Operator: OperatorIn, Values: []string{"eu"}}, false},
+		{"not in with values", AffinityTerm{Key: "region", Operator: OperatorNotIn, Values: []string{"eu"}}, false},
+		{"exists", AffinityTerm{Key: "gpu", Operator: OperatorExists}, false},
+		{"does not exist", AffinityTerm{Key: "gpu", Operator: OperatorDoesNotExist}, false},
+		{"missing key", AffinityTerm{Operator: OperatorExists}, true},
+		{"in without values", AffinityTerm{Key: "region", Operator: OperatorIn}, true},
+		{"not in without values", AffinityTerm{Key: "region", Operator: OperatorNotIn}, true},
+		{"unknown operator", AffinityTerm{Key: "region", Operator: "Gt", Values: []string{"1"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.term.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAffinityTermMatches(t *testing.T) {
+	labels := map[string]string{"region": "eu", "gpu": "a100"}
+	tests := []struct {
+		name string
+		term AffinityTerm
+		want bool
+	}{
+		{"in matching value", AffinityTerm{Key: "region", Operator: OperatorIn, Values: []string{"us", "eu"}}, true},
+		{"in other value", AffinityTerm{Key: "region", Operator: OperatorIn, Values: []string{"us"}}, false},
+		{"in missing label", AffinityTerm{Key: "zone", Operator: OperatorIn, Values: []string{"a"}}, false},
+		{"not in matching value", AffinityTerm{Key: "region", Operator: OperatorNotIn, Values: []string{"eu"}}, false},
+		{"not in other value", AffinityTerm{Key: "region", Operator: OperatorNotIn, Values: []string{"us"}}, true},
+		{"not in missing label", AffinityTerm{Key: "zone", Operator: OperatorNotIn, Values: []string{"a"}}, true},
+		{"exists", AffinityTerm{Key: "gpu", Operator: OperatorExists}, true},
+		{"exists missing label", AffinityTerm{Key: "zone", Operator: OperatorExists}, false},
+		{"does not exist", AffinityTerm{Key: "zone", Operator: OperatorDoesNotExist}, true},
+		{"does not exist present label", AffinityTerm{Key: "gpu", Operator: OperatorDoesNotExist}, false},
+		{"unknown operator", AffinityTerm{Key: "gpu", Operator: "Gt"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.term.Matches(labels); got != tt.want {
+				t.Fatalf("Matches(%v) = %v, want %v", labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesNodeSelector(t *testing.T) {
+	labels := map[string]string{"arch": "amd64", "os": "linux"}
+	tests := []struct {
+		name     string
+		selector map[string]string
+		want     bool
+	}{
+		{"no selector", nil, true},
+		{"subset", map[string]string{"arch": "amd64"}, true},
+		{"all labels", map[string]string{"arch": "amd64", "os": "linux"}, true},
+		{"other value", map[string]string{"arch": "arm64"}, false},
+		{"missing label", map[string]string{"gpu": "true"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesNodeSelector(tt.selector, labels); got != tt.want {
+				t.Fatalf("matchesNodeSelector(%v) = %v, want %v", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAffinityScore(t *testing.T) {
+	labels := map[string]string{"region": "eu", "disk": "ssd"}
+	tests := []struct {
+		name string
+		job  Job
+		want int
+	}{
+		{"no terms", Job{}, 0},
+		{
+			name: "weight defaults to one",
+			job:  Job{Affinity: []AffinityTerm{{Key: "disk", Operator: OperatorExists}}},
+			want: 1,
+		},
+		{
+			name: "matching terms add up",
+			job: Job{Affinity: []AffinityTerm{
+				{Key: "disk", Operator: OperatorExists, Weight: 5},
+				{Key: "region", Operator: OperatorIn, Values: []string{"eu"}, Weight: 2},
+				{Key: "gpu", Operator: OperatorExists, Weight: 10},
+			}},
+			want: 7,
+		},
+		{
+			name: "anti-affinity subtracts",
+			job: Job{
+				Affinity:     []AffinityTerm{{Key: "disk", Operator: OperatorExists, Weight: 5}},
+				AntiAffinity: []AffinityTerm{{Key: "region", Operator: OperatorIn, Values: []string{"eu"}, Weight: 8}},
+			},
+			want: -3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := affinityScore(tt.job, labels); got != tt.want {
+				t.Fatalf("affinityScore = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// tokenBucket is a token-bucket rate limiter that refills continuously.
+// A nil *tokenBucket never limits.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a bucket allowing perMinute takes per minute with the
+// given burst. It returns nil (unlimited) when perMinute is not positive.
+func newTokenBucket(perMinute int, burst int) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+	return &tokenBucket{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Allow reports whether a token is available without consuming it.
+func (b *tokenBucket) Allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// Take consumes a token if one is available.
+func (b *tokenBucket) Take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Refund returns a token taken for a job that was not dispatched after all.
+func (b *tokenBucket) Refund() {
+	if b == nil {
+		return
+	}
+	b.tokens = min(b.tokens+1, b.burst)
+}
+
+// Available returns the number of tokens currently in the bucket, or -1 when
+// the bucket is unlimited.
+func (b *tokenBucket) Available(now time.Time) float64 {
+	if b == nil {
+		return -1
+	}
+	b.refill(now)
+	return b.tokens
+}
+
+// RateLimit caps how often jobs of a type, or jobs building a Dockerfile,
+// are released for dispatch, e.g. to protect an external API they call.
+// Exactly one of JobType and DockerfileReference is set.
+type RateLimit struct {
+	JobType             string `mapstructure:"job_type" json:"job_type,omitempty"`
+	DockerfileReference string `mapstructure:"dockerfile_reference" json:"dockerfile_reference,omitempty"`
+	RatePerMinute       int    `mapstructure:"rate_per_minute" json:"rate_per_minute"`
+	Burst               int    `mapstructure:"burst" json:"burst"`
+}
+
+// RateLimitStatus is a point-in-time view of a rate limit.
+type RateLimitStatus struct {
+	RateLimit
+	Dispatched      int64   `json:"dispatched"`
+	Throttled       int64   `json:"throttled"`
+	AvailableTokens float64 `json:"available_tokens"`
+}
+
+type rateLimitState struct {
+	limit      RateLimit
+	bucket     *tokenBucket
+	dispatched int64
+	throttled  int64
+	// blocked is set while the limit holds jobs back, so each time it runs
+	// out of tokens is counted once rather than on every scan.
+	blocked bool
+}
+
+// jobRateLimiter enforces the configured RateLimits. A job is only released
+// when every limit that applies to it has a token.
+type jobRateLimiter struct {
+	mu           sync.Mutex
+	byJobType    map[string]*rateLimitState
+	byDockerfile map[string]*rateLimitState
+}
+
+// newJobRateLimiterFromConfig builds a jobRateLimiter from the "rate_limits" config list.
+func newJobRateLimiterFromConfig(config *viper.Viper) (*jobRateLimiter, error) {
+	var limits []RateLimit
+	if err := config.UnmarshalKey("rate_limits", &limits); err != nil {
+		return nil, fmt.Errorf("invalid rate_limits configuration: %w", err)
+	}
+	l := &jobRateLimiter{
+		byJobType:    make(map[string]*rateLimitState),
+		byDockerfile: make(map[string]*rateLimitState),
+	}
+	for _, limit := range limits {
+		if (limit.JobType == "") == (limit.DockerfileReference == "") {
+			return nil, fmt.Errorf("rate limit must set exactly one of job_type and dockerfile_reference")
+		}
+		if limit.RatePerMinute <= 0 {
+			return nil, fmt.Errorf("rate limit for %s%s needs a positive rate_per_minute", limit.JobType, limit.DockerfileReference)
+		}
+		// Unlike tenant quotas, whose burst defaults to rate_per_minute, these
+		// limits spread jobs evenly unless a burst is configured.
+		if limit.Burst <= 0 {
+			limit.Burst = 1
+		}
+		state := &rateLimitState{limit: limit, bucket: newTokenBucket(limit.RatePerMinute, limit.Burst)}
+		if limit.JobType != "" {
+			l.byJobType[limit.JobType] = state
+		} else {
+			l.byDockerfile[limit.DockerfileReference] = state
+		}
+	}
+	return l, nil
+}
+
+// limitsFor returns the states of the limits that apply to job. The caller
+// must hold l.mu.
+func (l *jobRateLimiter) limitsFor(job Job) []*rateLimitState {
+	var states []*rateLimitState
+	if state, ok := l.byJobType[job.JobType]; ok && job.JobType != "" {
+		states = append(states, state)
+	}
+	if state, ok := l.byDockerfile[job.DockerfileReference]; ok {
+		states = append(states, state)
+	}
+	return states
+}
+
+// Allow reports whether job may be released now.
+func (l *jobRateLimiter) Allow(job Job, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, state := range l.limitsFor(job) {
+		if !state.bucket.Allow(now) {
+			if !state.blocked {
+				state.blocked = true
+				state.throttled++
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Take consumes a token from every limit that applies to job.
+func (l *jobRateLimiter) Take(job Job, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, state := range l.limitsFor(job) {
+		state.bucket.Take(now)
+		state.blocked = false
+		state.dispatched++
+	}
+}
+
+// Refund returns the tokens Take consumed for job when it could not be
+// dispatched.
+func (l *jobRateLimiter) Refund(job Job) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, state := range l.limitsFor(job) {
+		state.bucket.Refund()
+		state.dispatched--
+	}
+}
+
+// Status returns the state of every rate limit.
+func (l *jobRateLimiter) Status() []RateLimitStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	statuses := make([]RateLimitStatus, 0, len(l.byJobType)+len(l.byDockerfile))
+	for _, states := range []map[string]*rateLimitState{l.byJobType, l.byDockerfile} {
+		for _, state := range states {
+			statuses = append(statuses, RateLimitStatus{
+				RateLimit:       state.limit,
+				Dispatched:      state.dispatched,
+				Throttled:       state.throttled,
+				AvailableTokens: state.bucket.Available(now),
+			})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].JobType != statuses[j].JobType {
+			return statuses[i].JobType < statuses[j].JobType
+		}
+		return statuses[i].DockerfileReference < statuses[j].DockerfileReference
+	})
+	return statuses
+}
@@ -0,0 +1,200 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name      string
+		perMinute int
+		burst     int
+		// takes are made at these offsets from start; want is the result of
+		// each.
+		takes []time.Duration
+		want  []bool
+	}{
+		{
+			name:      "burst then empty",
+			perMinute: 60,
+			burst:     2,
+			takes:     []time.Duration{0, 0, 0},
+			want:      []bool{true, true, false},
+		},
+		{
+			name:      "refills at the rate",
+			perMinute: 60,
+			burst:     1,
+			takes:     []time.Duration{0, 500 * time.Millisecond, time.Second},
+			want:      []bool{true, false, true},
+		},
+		{
+			name:      "burst defaults to the rate",
+			perMinute: 3,
+			takes:     []time.Duration{0, 0, 0, 0},
+			want:      []bool{true, true, true, false},
+		},
+		{
+			name:      "refill is capped at the burst",
+			perMinute: 60,
+			burst:     2,
+			takes:     []time.Duration{0, 0, time.Hour, time.Hour, time.Hour},
+			want:      []bool{true, true, true, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.perMinute, tt.burst)
+			b.last = start
+			for i, offset := range tt.takes {
+				if got := b.Take(start.Add(offset)); got != tt.want[i] {
+					t.Fatalf("take %d at +%s = %v, want %v", i+1, offset, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketRefund(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(60, 2)
+	b.last = now
+	b.Take(now)
+	b.Refund()
+	if got := b.Available(now); got != 2 {
+		t.Fatalf("Available after Refund = %v, want 2", got)
+	}
+	b.Refund()
+	if got := b.Available(now); got != 2 {
+		t.Fatalf("Available after a second Refund = %v, want it capped at the burst of 2", got)
+	}
+}
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	b := newTokenBucket(0, 5)
+	if b != nil {
+		t.Fatalf("newTokenBucket(0, 5) = %+v, want nil", b)
+	}
+	now := time.Now()
+	if !b.Allow(now) || !b.Take(now) || b.Available(now) != -1 {
+		t.Fatal("a nil bucket limited a take")
+	}
+	b.Refund()
+}
+
+func newTestRateLimiter(t *testing.T, limits ...map[string]interface{}) *jobRateLimiter {
+	t.Helper()
+	config := viper.New()
+	list := make([]interface{}, len(limits))
+	for i, limit := range limits {
+		list[i] = limit
+	}
+	config.Set("rate_limits", list)
+	l, err := newJobRateLimiterFromConfig(config)
+	if err != nil {
+		t.Fatalf("newJobRateLimiterFromConfig: %v", err)
+	}
+	return l
+}
+
+func TestJobRateLimiterConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   map[string]interface{}
+		wantErr bool
+	}{
+		{"job type", map[string]interface{}{"job_type": "build", "rate_per_minute": 6}, false},
+		{"dockerfile", map[string]interface{}{"dockerfile_reference": "https://example.com/Dockerfile", "rate_per_minute": 6}, false},
+		{"neither", map[string]interface{}{"rate_per_minute": 6}, true},
+		{"both", map[string]interface{}{"job_type": "build", "dockerfile_reference": "https://example.com/Dockerfile", "rate_per_minute": 6}, true},
+		{"no rate", map[string]interface{}{"job_type": "build"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := viper.New()
+			config.Set("rate_limits", []interface{}{tt.limit})
+			if _, err := newJobRateLimiterFromConfig(config); (err != nil) != tt.wantErr {
+				t.Fatalf("newJobRateLimiterFromConfig error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJobRateLimiterDelay(t *testing.T) {
+	const dockerfile = "https://example.com/heavy/Dockerfile"
+	l := newTestRateLimiter(t,
+		map[string]interface{}{"job_type": "build", "rate_per_minute": 6},
+		map[string]interface{}{"dockerfile_reference": dockerfile, "rate_per_minute": 60, "burst": 2},
+	)
+	start := time.Now()
+	tests := []struct {
+		name  string
+		job   Job
+		after time.Duration
+		want  bool
+	}{
+		{"unlimited job", Job{JobType: "test"}, 0, true},
+		{"first build", Job{JobType: "build"}, 0, true},
+		// burst defaults to 1, so the next build waits 60s / 6.
+		{"second build right away", Job{JobType: "build"}, 0, false},
+		{"second build too early", Job{JobType: "build"}, 9 * time.Second, false},
+		{"second build after refill", Job{JobType: "build"}, 10 * time.Second, true},
+		{"heavy dockerfile within burst", Job{DockerfileReference: dockerfile}, 10 * time.Second, true},
+		{"heavy dockerfile burst", Job{DockerfileReference: dockerfile}, 10 * time.Second, true},
+		{"heavy dockerfile over burst", Job{DockerfileReference: dockerfile}, 10 * time.Second, false},
+		{"heavy dockerfile refilled", Job{DockerfileReference: dockerfile}, 20500 * time.Millisecond, true},
+		{"heavy dockerfile refilled burst", Job{DockerfileReference: dockerfile}, 20500 * time.Millisecond, true},
+		// Every limit that applies must have a token: build has one, the
+		// Dockerfile does not.
+		{"build of heavy dockerfile", Job{JobType: "build", DockerfileReference: dockerfile}, 20500 * time.Millisecond, false},
+		{"build of heavy dockerfile after refill", Job{JobType: "build", DockerfileReference: dockerfile}, 22 * time.Second, true},
+	}
+	for _, state := range []*rateLimitState{l.byJobType["build"], l.byDockerfile[dockerfile]} {
+		state.bucket.last = start
+	}
+	for _, tt := range tests {
+		now := start.Add(tt.after)
+		if got := l.Allow(tt.job, now); got != tt.want {
+			t.Fatalf("%s: Allow at +%s = %v, want %v", tt.name, tt.after, got, tt.want)
+		}
+		if tt.want {
+			l.Take(tt.job, now)
+		}
+	}
+
+	statuses := l.Status()
+	if len(statuses) != 2 {
+		t.Fatalf("Status = %+v, want both limits", statuses)
+	}
+	// Status sorts the Dockerfile limit, without a job type, first.
+	want := []struct{ dispatched, throttled int64 }{{5, 2}, {3, 1}}
+	for i, status := range statuses {
+		if status.Dispatched != want[i].dispatched || status.Throttled != want[i].throttled {
+			t.Errorf("status of %s%s = %+v, want %d dispatched and %d throttled",
+				status.JobType, status.DockerfileReference, status, want[i].dispatched, want[i].throttled)
+		}
+	}
+}
+
+func TestJobRateLimiterRefund(t *testing.T) {
+	l := newTestRateLimiter(t, map[string]interface{}{"job_type": "build", "rate_per_minute": 1})
+	now := time.Now()
+	l.byJobType["build"].bucket.last = now
+	job := Job{JobType: "build"}
+
+	l.Take(job, now)
+	if l.Allow(job, now) {
+		t.Fatal("Allow with an empty bucket")
+	}
+	l.Refund(job)
+	if !l.Allow(job, now) {
+		t.Fatal("Refund did not return the token")
+	}
+	if status := l.Status()[0]; status.Dispatched != 0 || status.AvailableTokens < 1 {
+		t.Fatalf("status after Refund = %+v, want nothing dispatched and a token available", status)
+	}
+}
@@ -0,0 +1,300 @@
+package coordinator
+
+import (
+	"context"
+	"execution-service/internal/logging"
+	"execution-service/internal/metrics"
+	"execution-service/internal/models"
+	"execution-service/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// recoveryCounts tallies what recovery did with the jobs it looked at.
+type recoveryCounts struct {
+	adopted  int // still running on their worker, reserved again
+	finished int // finished while the coordinator was not watching
+	requeued int // queued again
+	orphans  int // untracked containers removed
+}
+
+// fields returns the counts as log fields.
+func (r recoveryCounts) fields() []zap.Field {
+	return []zap.Field{
+		zap.Int("adopted", r.adopted),
+		zap.Int("finished", r.finished),
+		zap.Int("requeued", r.requeued),
+		zap.Int("orphans_removed", r.orphans),
+	}
+}
+
+func (r *recoveryCounts) add(other recoveryCounts) {
+	r.adopted += other.adopted
+	r.finished += other.finished
+	r.requeued += other.requeued
+	r.orphans += other.orphans
+}
+
+// recoverJobs rebuilds the coordinator's view of jobs and workers after a
+// restart, from storage and from what the workers report:
+//
+//   - Workers are probed for their running jobs. Jobs still running are
+//     reserved on their worker again, and count against their tenant's quota.
+//   - Job containers a worker no longer tracks, e.g. because the worker
+//     restarted, are removed, so their jobs do not run twice.
+//   - Assigned jobs that a worker is not running either finished while the
+//     coordinator was down and get the status of their last attempt, or were
+//     never started and go back to the queue.
+//   - Jobs assigned to unreachable workers stay assigned until the worker is
+//     healthy again, when the same reconciliation runs for it, or fail once
+//     it has been unreachable for workers.lost_timeout. Jobs assigned to
+//     workers that are no longer configured are queued again.
+//   - Pending jobs are queued again, unless they were sent to a worker just
+//     before the coordinator stopped.
+func (c *Coordinator) recoverJobs(ctx context.Context) error {
+	workers := c.workers.ListWorkers()
+	probes := probeWorkers(workers)
+	c.mu.Lock()
+	for i, w := range workers {
+		if probes[i].healthy && probes[i].running != nil {
+			w.applyProbe(probes[i])
+		} else {
+			w.Status = "inactive"
+			w.inactiveSince = probes[i].startedAt
+		}
+	}
+	c.mu.Unlock()
+
+	assigned, err := c.listStoredJobs(ctx, storage.JobFilter{Status: models.JobStatusAssigned})
+	if err != nil {
+		return err
+	}
+	byWorker := make(map[string][]models.Job)
+	for _, stored := range assigned {
+		byWorker[stored.WorkerID] = append(byWorker[stored.WorkerID], stored)
+	}
+
+	var counts recoveryCounts
+	running := make(map[string]*Worker)
+	for i, w := range workers {
+		jobs := byWorker[w.ID]
+		delete(byWorker, w.ID)
+		if w.Status == "inactive" {
+			if len(jobs) > 0 {
+				c.logger.Warn("Worker is unreachable, recovering its assigned jobs once it is back",
+					logging.WorkerID(w.ID), zap.Int("jobs", len(jobs)))
+			}
+			continue
+		}
+		for jobID := range probes[i].running {
+			running[jobID] = w
+		}
+		n, err := c.recoverWorkerJobs(ctx, w, probes[i].running, jobs)
+		counts.add(n)
+		if err != nil {
+			return err
+		}
+	}
+	for workerID, jobs := range byWorker {
+		c.logger.Warn("Jobs assigned to unknown worker are queued again", logging.WorkerID(workerID), zap.Int("jobs", len(jobs)))
+		for _, stored := range jobs {
+			if c.requeueStoredJob(stored) {
+				counts.requeued++
+			}
+		}
+	}
+
+	pending, err := c.listStoredJobs(ctx, storage.JobFilter{Status: models.JobStatusPending})
+	if err != nil {
+		return err
+	}
+	for _, stored := range pending {
+		job, err := parseJob([]byte(stored.Payload))
+		if err != nil {
+			c.logger.Error("Failed to rebuild stored job", logging.JobID(stored.JobID), zap.Error(err))
+			continue
+		}
+		if w, ok := running[stored.JobID]; ok {
+			// Sent to the worker, but the coordinator stopped before
+			// recording the assignment.
+			if c.adoptJob(w, job) {
+				counts.adopted++
+			}
+			c.setJobStatus(jobContext(job), job.JobID, models.JobStatusAssigned, w.ID, "")
+			continue
+		}
+		// A delay counts from when the job was accepted, not from the restart.
+		if stored.NotBefore != nil {
+			job.NotBefore = *stored.NotBefore
+		}
+		c.Submit(job)
+		counts.requeued++
+	}
+
+	if counts != (recoveryCounts{}) {
+		c.logger.Info("Recovered jobs", counts.fields()...)
+	}
+	return nil
+}
+
+// recoverWorker reconciles the jobs stored as assigned to w with the jobs w
+// reports running, e.g. after w was unreachable.
+func (c *Coordinator) recoverWorker(ctx context.Context, w *Worker, running map[string]bool) error {
+	assigned, err := c.listStoredJobs(ctx, storage.JobFilter{Status: models.JobStatusAssigned, WorkerID: w.ID})
+	if err != nil {
+		return err
+	}
+	counts, err := c.recoverWorkerJobs(ctx, w, running, assigned)
+	if counts != (recoveryCounts{}) {
+		c.logger.Info("Recovered jobs of worker", append(counts.fields(), logging.WorkerID(w.ID))...)
+	}
+	return err
+}
+
+// recoverWorkerJobs removes w's untracked job containers, then reserves the
+// assigned jobs w is running again and finishes or requeues the others.
+// Jobs the coordinator has assigned to w in the meantime are left alone.
+func (c *Coordinator) recoverWorkerJobs(ctx context.Context, w *Worker, running map[string]bool, assigned []models.Job) (recoveryCounts, error) {
+	var counts recoveryCounts
+	containers, err := w.fetchContainers()
+	if err != nil {
+		c.logger.Warn("Failed to list containers of worker", logging.WorkerID(w.ID), zap.Error(err))
+	}
+	// running is from an earlier probe. Jobs are reserved before they are
+	// sent, so containers started since then belong to reserved jobs.
+	c.mu.Lock()
+	reserved := make(map[string]bool, len(w.AssignedJobs))
+	for jobID := range w.AssignedJobs {
+		reserved[jobID] = true
+	}
+	c.mu.Unlock()
+	for _, container := range containers {
+		if running[container.JobID] || reserved[container.JobID] {
+			continue
+		}
+		logger := c.logger.With(zap.String("container_id", container.ID), logging.JobID(container.JobID), logging.WorkerID(w.ID))
+		logger.Info("Removing orphaned container")
+		if err := w.removeContainer(container.ID); err != nil {
+			logger.Error("Failed to remove orphaned container", zap.Error(err))
+			continue
+		}
+		counts.orphans++
+	}
+
+	for _, stored := range assigned {
+		c.mu.Lock()
+		_, tracked := w.AssignedJobs[stored.JobID]
+		c.mu.Unlock()
+		if tracked {
+			continue
+		}
+		if running[stored.JobID] {
+			job, err := parseJob([]byte(stored.Payload))
+			if err != nil {
+				c.logger.Error("Failed to rebuild stored job", logging.JobID(stored.JobID), zap.Error(err))
+				continue
+			}
+			if c.adoptJob(w, job) {
+				counts.adopted++
+			}
+			continue
+		}
+		finished, err := c.finishFromAttempt(ctx, stored)
+		if err != nil {
+			return counts, err
+		}
+		if finished {
+			counts.finished++
+			continue
+		}
+		if c.requeueStoredJob(stored) {
+			counts.requeued++
+		}
+	}
+	return counts, nil
+}
+
+// adoptJob reserves a job that w is already running, as if it had just been
+// assigned. It returns false if the job was already reserved.
+func (c *Coordinator) adoptJob(w *Worker, job Job) bool {
+	job.WorkerID = w.ID
+	c.mu.Lock()
+	_, tracked := w.AssignedJobs[job.JobID]
+	if !tracked {
+		w.reserve(job)
+		w.markSent(job.JobID)
+	}
+	c.mu.Unlock()
+	if tracked {
+		return false
+	}
+	c.tenants.Acquire(job.TenantID)
+	c.webhooks.Register(job)
+	return true
+}
+
+// finishFromAttempt sets the final status of an assigned job whose worker
+// recorded an attempt after the assignment but could not report it. It
+// returns false if there is no such attempt. An attempt that ended before the
+// assignment was stored cannot be told apart from an earlier assignment's, so
+// that job runs again.
+func (c *Coordinator) finishFromAttempt(ctx context.Context, stored models.Job) (bool, error) {
+	attempts, err := c.jobs.Attempts(ctx, stored.JobID)
+	if err != nil {
+		return false, err
+	}
+	if len(attempts) == 0 {
+		return false, nil
+	}
+	last := attempts[len(attempts)-1]
+	if last.WorkerID != stored.WorkerID || !last.ExecutionCompletionTime.After(stored.UpdatedAt) {
+		return false, nil
+	}
+	if job, err := parseJob([]byte(stored.Payload)); err == nil {
+		c.webhooks.Register(job)
+	}
+	c.finishJob(ctx, stored.WorkerID, stored.JobID, 0, attemptResult(last))
+	return true, nil
+}
+
+// attemptResult returns the result a worker would have reported for attempt.
+func attemptResult(attempt models.ExecutedJob) JobResult {
+	if attempt.Status == "success" {
+		return JobResult{Status: "success", Outputs: attempt.Outputs}
+	}
+	return JobResult{Status: "error", Error: attempt.ErrorMessage, Outputs: attempt.Outputs}
+}
+
+// requeueStoredJob sets an assigned job back to pending and queues it. It
+// returns false if the job could not be rebuilt from its payload.
+func (c *Coordinator) requeueStoredJob(stored models.Job) bool {
+	job, err := parseJob([]byte(stored.Payload))
+	if err != nil {
+		c.logger.Error("Failed to rebuild stored job", logging.JobID(stored.JobID), zap.Error(err))
+		return false
+	}
+	if stored.NotBefore != nil {
+		job.NotBefore = *stored.NotBefore
+	}
+	c.setJobStatus(jobContext(job), stored.JobID, models.JobStatusPending, "", "")
+	c.Submit(job)
+	metrics.JobRetries.WithLabelValues("recovered").Inc()
+	return true
+}
+
+// listStoredJobs returns every stored job matching filter.
+func (c *Coordinator) listStoredJobs(ctx context.Context, filter storage.JobFilter) ([]models.Job, error) {
+	var jobs []models.Job
+	page := storage.Page{Limit: storage.MaxPageSize}
+	for {
+		result, err := c.jobs.List(ctx, filter, page)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, result.Jobs...)
+		if result.NextCursor == "" {
+			return jobs, nil
+		}
+		page.Cursor = result.NextCursor
+	}
+}
@@ -0,0 +1,216 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"execution-service/internal/models"
+	"execution-service/internal/storage"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// fakeContainers serves a worker's container API with the given containers
+// and records the IDs of the ones removed.
+type fakeContainers struct {
+	containers []workerContainer
+
+	mu      sync.Mutex
+	removed []string
+}
+
+func (f *fakeContainers) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/containers":
+		json.NewEncoder(wr).Encode(f.containers)
+	case req.Method == http.MethodDelete && strings.HasPrefix(req.URL.Path, "/containers/"):
+		f.mu.Lock()
+		f.removed = append(f.removed, strings.TrimPrefix(req.URL.Path, "/containers/"))
+		f.mu.Unlock()
+		wr.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(wr, req)
+	}
+}
+
+// newRecoveryCoordinator returns a coordinator, not started, with memory
+// storage and the single worker w1 served by worker.
+func newRecoveryCoordinator(t *testing.T, worker http.Handler) (*Coordinator, *storage.MemoryJobRepository) {
+	t.Helper()
+	server := httptest.NewServer(worker)
+	t.Cleanup(server.Close)
+	config := viper.New()
+	config.Set("node.address", "127.0.0.1:0")
+	config.Set("workers.heartbeat_interval", "1s")
+	config.Set("workers.list", []interface{}{
+		map[string]interface{}{"id": "w1", "address": server.URL, "slots": 4},
+	})
+	repo := storage.NewMemoryJobRepository()
+	c, err := NewCoordinator(config, nil, repo, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewCoordinator: %v", err)
+	}
+	t.Cleanup(func() { close(c.done) })
+	return c, repo
+}
+
+// storeAssigned stores a job assigned to w1 and returns it as stored.
+func storeAssigned(t *testing.T, repo storage.JobRepository, jobID string) models.Job {
+	t.Helper()
+	ctx := context.Background()
+	err := repo.Create(ctx, models.Job{
+		JobID:    jobID,
+		Status:   models.JobStatusAssigned,
+		WorkerID: "w1",
+		Payload:  fmt.Sprintf(`{"job_id":%q,"dockerfile_reference":"https://example.com/Dockerfile"}`, jobID),
+	})
+	if err != nil {
+		t.Fatalf("Create %s: %v", jobID, err)
+	}
+	stored, err := repo.Get(ctx, jobID)
+	if err != nil {
+		t.Fatalf("Get %s: %v", jobID, err)
+	}
+	return stored
+}
+
+func TestFinishFromAttempt(t *testing.T) {
+	tests := []struct {
+		name string
+		// attempt is appended unless nil; completedAfter is added to the
+		// time the job was assigned.
+		attempt        *models.ExecutedJob
+		completedAfter time.Duration
+		wantFinished   bool
+		wantStatus     string
+		wantError      string
+	}{
+		{
+			name:       "no attempt",
+			wantStatus: models.JobStatusAssigned,
+		},
+		{
+			name:           "attempt on another worker",
+			attempt:        &models.ExecutedJob{WorkerID: "w2", Status: "success"},
+			completedAfter: time.Minute,
+			wantStatus:     models.JobStatusAssigned,
+		},
+		{
+			name:           "attempt of an earlier assignment",
+			attempt:        &models.ExecutedJob{WorkerID: "w1", Status: "success"},
+			completedAfter: -time.Minute,
+			wantStatus:     models.JobStatusAssigned,
+		},
+		{
+			name:           "succeeded",
+			attempt:        &models.ExecutedJob{WorkerID: "w1", Status: "success"},
+			completedAfter: time.Minute,
+			wantFinished:   true,
+			wantStatus:     models.JobStatusSucceeded,
+		},
+		{
+			name:           "failed",
+			attempt:        &models.ExecutedJob{WorkerID: "w1", Status: "error", ErrorMessage: "exit status 1"},
+			completedAfter: time.Minute,
+			wantFinished:   true,
+			wantStatus:     models.JobStatusFailed,
+			wantError:      "exit status 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, repo := newRecoveryCoordinator(t, &fakeContainers{})
+			stored := storeAssigned(t, repo, "job-1")
+			if tt.attempt != nil {
+				attempt := *tt.attempt
+				attempt.JobID = stored.JobID
+				attempt.ExecutionCompletionTime = stored.UpdatedAt.Add(tt.completedAfter)
+				if err := repo.AppendAttempt(ctx, attempt); err != nil {
+					t.Fatalf("AppendAttempt: %v", err)
+				}
+			}
+
+			finished, err := c.finishFromAttempt(ctx, stored)
+			if err != nil || finished != tt.wantFinished {
+				t.Fatalf("finishFromAttempt = %v, %v, want %v", finished, err, tt.wantFinished)
+			}
+			job, err := repo.Get(ctx, stored.JobID)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if job.Status != tt.wantStatus || job.ErrorMessage != tt.wantError {
+				t.Fatalf("job is %s with error %q, want %s with error %q", job.Status, job.ErrorMessage, tt.wantStatus, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRecoverWorkerJobs(t *testing.T) {
+	ctx := context.Background()
+	worker := &fakeContainers{containers: []workerContainer{
+		{ID: "c-running", JobID: "running"},
+		{ID: "c-tracked", JobID: "tracked"},
+		{ID: "c-orphan", JobID: "orphan"},
+	}}
+	c, repo := newRecoveryCoordinator(t, worker)
+	w, _ := c.workers.GetWorker("w1")
+
+	tests := []struct {
+		jobID string
+		// finished jobs have an attempt recorded after their assignment.
+		finished   bool
+		wantStatus string
+	}{
+		{jobID: "running", wantStatus: models.JobStatusAssigned},
+		{jobID: "tracked", wantStatus: models.JobStatusAssigned},
+		{jobID: "finished", finished: true, wantStatus: models.JobStatusSucceeded},
+		{jobID: "lost", wantStatus: models.JobStatusPending},
+	}
+	var assigned []models.Job
+	for _, tt := range tests {
+		stored := storeAssigned(t, repo, tt.jobID)
+		if tt.finished {
+			attempt := models.ExecutedJob{JobID: tt.jobID, WorkerID: "w1", Status: "success", ExecutionCompletionTime: stored.UpdatedAt.Add(time.Minute)}
+			if err := repo.AppendAttempt(ctx, attempt); err != nil {
+				t.Fatalf("AppendAttempt: %v", err)
+			}
+		}
+		assigned = append(assigned, stored)
+	}
+	// tracked was assigned again since the worker was probed.
+	w.reserve(Job{JobID: "tracked", TenantID: defaultTenant})
+
+	counts, err := c.recoverWorkerJobs(ctx, w, map[string]bool{"running": true}, assigned)
+	if err != nil {
+		t.Fatalf("recoverWorkerJobs: %v", err)
+	}
+	if want := (recoveryCounts{adopted: 1, finished: 1, requeued: 1, orphans: 1}); counts != want {
+		t.Fatalf("counts = %+v, want %+v", counts, want)
+	}
+	for _, tt := range tests {
+		job, err := repo.Get(ctx, tt.jobID)
+		if err != nil {
+			t.Fatalf("Get %s: %v", tt.jobID, err)
+		}
+		if job.Status != tt.wantStatus {
+			t.Errorf("job %s is %s, want %s", tt.jobID, job.Status, tt.wantStatus)
+		}
+	}
+	if fmt.Sprint(worker.removed) != "[c-orphan]" {
+		t.Errorf("removed containers %v, want [c-orphan]", worker.removed)
+	}
+	if _, ok := w.AssignedJobs["running"]; !ok {
+		t.Error("running job was not reserved on its worker again")
+	}
+	if usage := c.tenants.TenantUsage(defaultTenant); usage.Pending != 1 || usage.Running != 1 {
+		t.Errorf("tenant usage = %+v, want the lost job queued and the running one counted", usage)
+	}
+}
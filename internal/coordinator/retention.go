@@ -0,0 +1,337 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/archive"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
+	"execution-service/internal/storage"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// RetentionPolicy is how long finished jobs are kept, by final status. A
+// policy without TenantID is the default; tenant policies fall back to it
+// for statuses they leave at zero. Zero everywhere keeps jobs forever.
+type RetentionPolicy struct {
+	TenantID  string        `mapstructure:"tenant_id"`
+	Succeeded time.Duration `mapstructure:"succeeded"`
+	Failed    time.Duration `mapstructure:"failed"`
+}
+
+// maxAge returns how long jobs that ended in status are kept under p.
+func (p RetentionPolicy) maxAge(status string) time.Duration {
+	if status == models.JobStatusSucceeded {
+		return p.Succeeded
+	}
+	return p.Failed
+}
+
+// RetentionStats reports what the retention sweeper has done since the
+// coordinator started.
+type RetentionStats struct {
+	Mode            string     `json:"mode"`
+	LastSweep       *time.Time `json:"last_sweep,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	JobsDeleted     int64      `json:"jobs_deleted"`
+	JobsArchived    int64      `json:"jobs_archived"`
+	ArchivesWritten int64      `json:"archives_written"`
+}
+
+// archivedJob is one line of an archive file: a job with everything stored
+// about it.
+type archivedJob struct {
+	Job               models.Job               `json:"job"`
+	Attempts          []models.ExecutedJob     `json:"attempts"`
+	Logs              []models.LogChunk        `json:"logs"`
+	WebhookDeliveries []models.WebhookDelivery `json:"webhook_deliveries,omitempty"`
+	ArchivedAt        time.Time                `json:"archived_at"`
+}
+
+// retentionSweeper periodically removes finished jobs that are older than
+// their retention policy, together with their attempts, output and webhook
+// deliveries. In archive mode, they are written to the archive store first.
+//
+// A MongoDB TTL index would remove each collection on its own schedule and
+// leave attempts, output or deliveries of deleted jobs behind, so expiry is
+// done here, one job at a time. The TTL indexes of
+// storage.mongo.completed_retention may still remove attempts and output
+// earlier; in archive mode they must not expire before their job is archived.
+type retentionSweeper struct {
+	jobs       storage.JobRepository
+	deliveries *mongo.Collection // nil without MongoDB
+	store      archive.Store     // nil in delete mode
+	defaults   RetentionPolicy
+	tenants    []RetentionPolicy
+	interval   time.Duration
+	batchSize  int
+	logger     *zap.Logger
+
+	mu    sync.Mutex
+	stats RetentionStats
+}
+
+// newRetentionSweeperFromConfig reads the retention section. It returns nil
+// when retention is disabled.
+func newRetentionSweeperFromConfig(config *viper.Viper, jobs storage.JobRepository, deliveries *mongo.Collection, logger *zap.Logger) (*retentionSweeper, error) {
+	if !config.GetBool("retention.enabled") {
+		return nil, nil
+	}
+	if jobs == nil {
+		return nil, fmt.Errorf("retention needs job storage")
+	}
+	var policies []RetentionPolicy
+	if err := config.UnmarshalKey("retention.policies", &policies); err != nil {
+		return nil, fmt.Errorf("invalid retention.policies configuration: %w", err)
+	}
+	interval, err := configDuration(config, "retention.interval", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	s := &retentionSweeper{
+		jobs:       jobs,
+		deliveries: deliveries,
+		interval:   interval,
+		batchSize:  config.GetInt("retention.batch_size"),
+		logger:     logger,
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 100
+	}
+	seen := make(map[string]bool)
+	for _, policy := range policies {
+		if policy.Succeeded < 0 || policy.Failed < 0 {
+			return nil, fmt.Errorf("retention policy for tenant %q has a negative duration", policy.TenantID)
+		}
+		if seen[policy.TenantID] {
+			return nil, fmt.Errorf("more than one retention policy for tenant %q", policy.TenantID)
+		}
+		seen[policy.TenantID] = true
+		if policy.TenantID == "" {
+			s.defaults = policy
+		} else {
+			s.tenants = append(s.tenants, policy)
+		}
+	}
+
+	mode := configString(config, "retention.mode", "delete")
+	switch mode {
+	case "delete":
+	case "archive":
+		store, err := archive.NewStoreFromConfig(config, "retention.archive")
+		if err != nil {
+			return nil, err
+		}
+		s.store = store
+		if err := s.checkCompletedRetention(config); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown retention.mode %q", mode)
+	}
+	s.stats.Mode = mode
+	return s, nil
+}
+
+// checkCompletedRetention returns an error if the TTL indexes of
+// storage.mongo.completed_retention could remove attempts and output of a job
+// before the sweeper archives it.
+func (s *retentionSweeper) checkCompletedRetention(config *viper.Viper) error {
+	if _, ok := s.jobs.(*storage.MongoJobRepository); !ok {
+		return nil
+	}
+	mongoConfig, err := storage.MongoConfigFromViper(config)
+	if err != nil {
+		return err
+	}
+	ttl := mongoConfig.CompletedRetention
+	if ttl <= 0 {
+		return nil
+	}
+	for _, policy := range append([]RetentionPolicy{s.defaults}, s.tenants...) {
+		for _, status := range []string{models.JobStatusSucceeded, models.JobStatusFailed} {
+			maxAge := policy.maxAge(status)
+			if maxAge == 0 {
+				maxAge = s.defaults.maxAge(status)
+			}
+			// Jobs are archived up to one interval after they expire.
+			if maxAge > 0 && maxAge+s.interval >= ttl {
+				return fmt.Errorf("storage.mongo.completed_retention (%s) must be longer than every retention policy plus retention.interval in archive mode, or attempts and output expire before their job is archived", ttl)
+			}
+		}
+	}
+	return nil
+}
+
+// run sweeps every interval until done is closed.
+func (s *retentionSweeper) run(done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		removed, err := s.sweep(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.logger.Error("Sweep failed", zap.Int("removed", removed), zap.Error(err))
+		} else if removed > 0 {
+			s.logger.Info("Removed expired jobs", zap.Int("removed", removed))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweep removes every job that has expired by now and returns how many it
+// removed.
+func (s *retentionSweeper) sweep(ctx context.Context) (int, error) {
+	now := time.Now()
+	removed, err := s.sweepPolicies(ctx, now)
+	s.mu.Lock()
+	s.stats.LastSweep = &now
+	s.stats.LastError = ""
+	if err != nil {
+		s.stats.LastError = err.Error()
+	}
+	s.mu.Unlock()
+	return removed, err
+}
+
+func (s *retentionSweeper) sweepPolicies(ctx context.Context, now time.Time) (int, error) {
+	removed := 0
+	for _, status := range []string{models.JobStatusSucceeded, models.JobStatusFailed} {
+		// Tenants with their own policy first, then everyone else.
+		excluded := make([]string, 0, len(s.tenants))
+		for _, policy := range s.tenants {
+			excluded = append(excluded, policy.TenantID)
+			maxAge := policy.maxAge(status)
+			if maxAge == 0 {
+				maxAge = s.defaults.maxAge(status)
+			}
+			n, err := s.sweepExpired(ctx, storage.JobFilter{TenantID: policy.TenantID, Status: status}, now, maxAge)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+		n, err := s.sweepExpired(ctx, storage.JobFilter{Status: status, ExcludeTenants: excluded}, now, s.defaults.maxAge(status))
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// sweepExpired removes the jobs matching filter that finished more than
+// maxAge before now, a batch at a time. A zero maxAge keeps them.
+func (s *retentionSweeper) sweepExpired(ctx context.Context, filter storage.JobFilter, now time.Time, maxAge time.Duration) (int, error) {
+	if maxAge == 0 {
+		return 0, nil
+	}
+	filter.UpdatedBefore = now.Add(-maxAge)
+	removed := 0
+	for {
+		page, err := s.jobs.List(ctx, filter, storage.Page{Limit: s.batchSize})
+		if err != nil {
+			return removed, err
+		}
+		if len(page.Jobs) == 0 {
+			return removed, nil
+		}
+		if s.store != nil {
+			if err := s.archive(ctx, page.Jobs); err != nil {
+				return removed, err
+			}
+		}
+		for _, job := range page.Jobs {
+			if err := s.remove(ctx, job.JobID); err != nil {
+				return removed, fmt.Errorf("failed to remove job %s: %w", job.JobID, err)
+			}
+			removed++
+			s.mu.Lock()
+			s.stats.JobsDeleted++
+			s.mu.Unlock()
+		}
+		// Removed jobs drop out of the filter, so the next batch is again
+		// the first page.
+		if page.NextCursor == "" {
+			return removed, nil
+		}
+	}
+}
+
+// archive writes jobs with their attempts, output and webhook deliveries to
+// one archive file. If the coordinator stops before the jobs are removed,
+// they are archived again by the next sweep, so readers should deduplicate
+// by job_id.
+func (s *retentionSweeper) archive(ctx context.Context, jobs []models.Job) error {
+	now := time.Now().UTC()
+	records := make([]archivedJob, 0, len(jobs))
+	for _, job := range jobs {
+		record := archivedJob{Job: job, ArchivedAt: now}
+		var err error
+		if record.Attempts, err = s.jobs.Attempts(ctx, job.JobID); err != nil {
+			return err
+		}
+		if record.Logs, err = s.jobs.Logs(ctx, job.JobID); err != nil {
+			return err
+		}
+		if s.deliveries != nil {
+			record.WebhookDeliveries, err = queries.FindWebhookDeliveries(ctx, s.deliveries, bson.M{"job_id": job.JobID})
+			if err != nil {
+				return err
+			}
+		}
+		records = append(records, record)
+	}
+
+	data, err := archive.EncodeJSONL(records)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("jobs/%s/%s-%s.jsonl.gz", now.Format("2006/01/02"), now.Format("20060102T150405Z"), primitive.NewObjectID().Hex())
+	if err := s.store.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("failed to write archive %s: %w", key, err)
+	}
+	s.mu.Lock()
+	s.stats.JobsArchived += int64(len(jobs))
+	s.stats.ArchivesWritten++
+	s.mu.Unlock()
+	return nil
+}
+
+// remove deletes a job's webhook deliveries and then the job itself, with
+// its attempts and output.
+func (s *retentionSweeper) remove(ctx context.Context, jobID string) error {
+	if s.deliveries != nil {
+		if err := queries.DeleteByJobID(ctx, s.deliveries, jobID); err != nil {
+			return err
+		}
+	}
+	if err := s.jobs.Delete(ctx, jobID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *retentionSweeper) Stats() RetentionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
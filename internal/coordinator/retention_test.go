@@ -0,0 +1,160 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/archive"
+	"execution-service/internal/models"
+	"execution-service/internal/storage"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// newTestSweeper returns a sweeper over a memory repository holding one job
+// per entry of jobs, keyed by job ID, with the given tenant and status.
+func newTestSweeper(t *testing.T, jobs map[string][2]string, defaults RetentionPolicy, tenants ...RetentionPolicy) (*retentionSweeper, *storage.MemoryJobRepository) {
+	t.Helper()
+	repo := storage.NewMemoryJobRepository()
+	for jobID, job := range jobs {
+		if err := repo.Create(context.Background(), models.Job{JobID: jobID, TenantID: job[0], Status: job[1]}); err != nil {
+			t.Fatalf("Create %s: %v", jobID, err)
+		}
+	}
+	return &retentionSweeper{
+		jobs:      repo,
+		defaults:  defaults,
+		tenants:   tenants,
+		interval:  time.Hour,
+		batchSize: 2,
+		logger:    zap.NewNop(),
+	}, repo
+}
+
+func TestRetentionSweepPolicies(t *testing.T) {
+	jobs := map[string][2]string{
+		"default-succeeded": {"", models.JobStatusSucceeded},
+		"default-failed":    {"", models.JobStatusFailed},
+		"a-succeeded":       {"a", models.JobStatusSucceeded},
+		"a-failed":          {"a", models.JobStatusFailed},
+		"b-succeeded":       {"b", models.JobStatusSucceeded},
+		"pending":           {"", models.JobStatusPending},
+	}
+	defaults := RetentionPolicy{Succeeded: 2 * time.Hour, Failed: 48 * time.Hour}
+	// a keeps succeeded jobs longer than the default and falls back to it
+	// for failed ones; b keeps them shorter.
+	tenants := []RetentionPolicy{
+		{TenantID: "a", Succeeded: 4 * time.Hour},
+		{TenantID: "b", Succeeded: time.Hour},
+	}
+	tests := []struct {
+		name        string
+		after       time.Duration
+		wantRemoved []string
+	}{
+		{"nothing expired", 30 * time.Minute, nil},
+		{"shorter tenant policy", 90 * time.Minute, []string{"b-succeeded"}},
+		{"default policy", 3 * time.Hour, []string{"b-succeeded", "default-succeeded"}},
+		{"longer tenant policy", 5 * time.Hour, []string{"a-succeeded", "b-succeeded", "default-succeeded"}},
+		{
+			name:        "tenant falls back to the default",
+			after:       49 * time.Hour,
+			wantRemoved: []string{"a-failed", "a-succeeded", "b-succeeded", "default-failed", "default-succeeded"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newTestSweeper(t, jobs, defaults, tenants...)
+			removed, err := s.sweepPolicies(context.Background(), time.Now().Add(tt.after))
+			if err != nil {
+				t.Fatalf("sweepPolicies: %v", err)
+			}
+			var gone []string
+			for jobID := range jobs {
+				if _, err := repo.Get(context.Background(), jobID); errors.Is(err, storage.ErrNotFound) {
+					gone = append(gone, jobID)
+				}
+			}
+			sort.Strings(gone)
+			if strings.Join(gone, ",") != strings.Join(tt.wantRemoved, ",") {
+				t.Fatalf("removed %v, want %v", gone, tt.wantRemoved)
+			}
+			if removed != len(tt.wantRemoved) || s.Stats().JobsDeleted != int64(removed) {
+				t.Fatalf("sweepPolicies returned %d and counted %d, want %d", removed, s.Stats().JobsDeleted, len(tt.wantRemoved))
+			}
+		})
+	}
+}
+
+func TestRetentionSweepArchives(t *testing.T) {
+	dir := t.TempDir()
+	s, repo := newTestSweeper(t, map[string][2]string{
+		"job-1": {"", models.JobStatusSucceeded},
+		"job-2": {"", models.JobStatusFailed},
+		"job-3": {"", models.JobStatusFailed},
+	}, RetentionPolicy{Succeeded: time.Hour, Failed: time.Hour})
+	s.store = archive.NewFileStore(dir)
+	if err := repo.AppendAttempt(context.Background(), models.ExecutedJob{JobID: "job-1"}); err != nil {
+		t.Fatalf("AppendAttempt: %v", err)
+	}
+
+	removed, err := s.sweepPolicies(context.Background(), time.Now().Add(2*time.Hour))
+	if err != nil || removed != 3 {
+		t.Fatalf("sweepPolicies = %d, %v, want 3 jobs removed", removed, err)
+	}
+	if attempts, _ := repo.Attempts(context.Background(), "job-1"); len(attempts) != 0 {
+		t.Fatalf("attempts of a removed job are left: %+v", attempts)
+	}
+	// One archive per batch: the succeeded job, then both failed ones.
+	var files []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	if len(files) != 2 || stats.ArchivesWritten != 2 || stats.JobsArchived != 3 {
+		t.Fatalf("wrote %v with stats %+v, want 2 archives of 3 jobs", files, stats)
+	}
+}
+
+func TestRetentionCheckCompletedRetention(t *testing.T) {
+	defaults := RetentionPolicy{Succeeded: 24 * time.Hour, Failed: 48 * time.Hour}
+	tests := []struct {
+		name     string
+		jobs     storage.JobRepository
+		ttl      string
+		defaults RetentionPolicy
+		tenants  []RetentionPolicy
+		wantErr  bool
+	}{
+		{"no ttl", &storage.MongoJobRepository{}, "0s", defaults, nil, false},
+		{"ttl longer than policy and interval", &storage.MongoJobRepository{}, "72h", defaults, nil, false},
+		{"ttl within the interval", &storage.MongoJobRepository{}, "49h", defaults, nil, true},
+		{"ttl shorter than policy", &storage.MongoJobRepository{}, "36h", defaults, nil, true},
+		{"tenant policy too long", &storage.MongoJobRepository{}, "72h", defaults, []RetentionPolicy{{TenantID: "a", Succeeded: 100 * time.Hour}}, true},
+		{"tenant falls back to the default", &storage.MongoJobRepository{}, "72h", defaults, []RetentionPolicy{{TenantID: "a", Succeeded: time.Hour}}, false},
+		{"policies that keep jobs forever", &storage.MongoJobRepository{}, "1h", RetentionPolicy{}, nil, false},
+		{"not mongo", storage.NewMemoryJobRepository(), "1h", defaults, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := viper.New()
+			config.Set("storage.mongo.completed_retention", tt.ttl)
+			s := &retentionSweeper{jobs: tt.jobs, defaults: tt.defaults, tenants: tt.tenants, interval: time.Hour}
+			if err := s.checkCompletedRetention(config); (err != nil) != tt.wantErr {
+				t.Fatalf("checkCompletedRetention = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
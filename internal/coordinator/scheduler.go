@@ -0,0 +1,235 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Resources describes the CPU and memory a job requests or a worker offers.
+type Resources struct {
+	CPU      float64 `json:"cpu,omitempty" mapstructure:"cpu"`
+	MemoryMB int     `json:"memory_mb,omitempty" mapstructure:"memory_mb"`
+}
+
+// Add returns the sum of r and other.
+func (r Resources) Add(other Resources) Resources {
+	return Resources{CPU: r.CPU + other.CPU, MemoryMB: r.MemoryMB + other.MemoryMB}
+}
+
+// CandidateScore explains how a scheduler rated one worker for a job.
+type CandidateScore struct {
+	WorkerID string  `json:"worker_id"`
+	Score    float64 `json:"score"`
+	Affinity int     `json:"affinity"`
+	Reason   string  `json:"reason"`
+}
+
+// Decision records why a job was assigned to a worker.
+type Decision struct {
+	JobID      string           `json:"job_id"`
+	TenantID   string           `json:"tenant_id"`
+	Strategy   string           `json:"strategy"`
+	WorkerID   string           `json:"worker_id"`
+	Time       time.Time        `json:"time"`
+	Candidates []CandidateScore `json:"candidates"`
+	Rejected   []CandidateScore `json:"rejected,omitempty"`
+}
+
+// Scheduler chooses a worker for a job among candidates that are able to run it.
+type Scheduler interface {
+	// Name returns the strategy name used in config and decision traces.
+	Name() string
+	// Select returns the chosen worker along with the scores of all candidates.
+	// candidates is never empty.
+	Select(job Job, candidates []*Worker) (*Worker, []CandidateScore)
+}
+
+// NewScheduler returns the scheduler for a strategy name.
+func NewScheduler(strategy string) (Scheduler, error) {
+	switch strategy {
+	case "", "round-robin":
+		return &roundRobinScheduler{}, nil
+	case "least-loaded":
+		return scoringScheduler{name: "least-loaded", score: leastLoadedScore}, nil
+	case "bin-packing":
+		return scoringScheduler{name: "bin-packing", score: binPackingScore}, nil
+	case "locality":
+		return scoringScheduler{name: "locality", score: localityScore}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling strategy: %s", strategy)
+	}
+}
+
+// canRun reports whether w has a free slot and enough unallocated resources
+// for job, and why not if it does not.
+func canRun(job Job, w *Worker) (bool, string) {
+	if !matchesNodeSelector(job.NodeSelector, w.Labels) {
+		return false, "node selector mismatch"
+	}
+	if w.FreeSlots() <= 0 {
+		return false, "no free slots"
+	}
+	allocated := w.Allocated().Add(job.Resources)
+	if w.Capacity.CPU > 0 && allocated.CPU > w.Capacity.CPU {
+		return false, "insufficient cpu"
+	}
+	if w.Capacity.MemoryMB > 0 && allocated.MemoryMB > w.Capacity.MemoryMB {
+		return false, "insufficient memory"
+	}
+	return true, ""
+}
+
+// utilization returns the fraction of the worker's busiest dimension (slots,
+// CPU or memory) that would be in use with extra added to its allocation.
+func utilization(w *Worker, extra Resources, extraSlots int) float64 {
+	used := 0.0
+	if w.Slots > 0 {
+		used = float64(len(w.AssignedJobs)+extraSlots) / float64(w.Slots)
+	}
+	allocated := w.Allocated().Add(extra)
+	if w.Capacity.CPU > 0 {
+		used = max(used, allocated.CPU/w.Capacity.CPU)
+	}
+	if w.Capacity.MemoryMB > 0 {
+		used = max(used, float64(allocated.MemoryMB)/float64(w.Capacity.MemoryMB))
+	}
+	return min(used, 1)
+}
+
+// rank combines strategy scores in [0, 1] with affinity scores. Affinity
+// dominates, so the strategy only decides between equally preferred workers.
+// Ties are broken by worker ID.
+func rank(job Job, candidates []*Worker, scores []CandidateScore) (*Worker, []CandidateScore) {
+	for i := range scores {
+		scores[i].Affinity = affinityScore(job, candidates[i].Labels)
+	}
+	best := 0
+	for i := 1; i < len(candidates); i++ {
+		total, bestTotal := float64(scores[i].Affinity)+scores[i].Score, float64(scores[best].Affinity)+scores[best].Score
+		if total > bestTotal || (total == bestTotal && candidates[i].ID < candidates[best].ID) {
+			best = i
+		}
+	}
+	return candidates[best], scores
+}
+
+// scoringScheduler picks the candidate with the highest score.
+type scoringScheduler struct {
+	name  string
+	score func(job Job, w *Worker) (float64, string)
+}
+
+func (s scoringScheduler) Name() string {
+	return s.name
+}
+
+func (s scoringScheduler) Select(job Job, candidates []*Worker) (*Worker, []CandidateScore) {
+	scores := make([]CandidateScore, len(candidates))
+	for i, w := range candidates {
+		score, reason := s.score(job, w)
+		scores[i] = CandidateScore{WorkerID: w.ID, Score: score, Reason: reason}
+	}
+	return rank(job, candidates, scores)
+}
+
+// leastLoadedScore prefers the worker with the most headroom.
+func leastLoadedScore(job Job, w *Worker) (float64, string) {
+	load := utilization(w, Resources{}, 0)
+	return 1 - load, fmt.Sprintf("current load %.2f", load)
+}
+
+// binPackingScore prefers the worker that would be fullest after placing the
+// job, keeping other workers free for large jobs.
+func binPackingScore(job Job, w *Worker) (float64, string) {
+	load := utilization(w, job.Resources, 1)
+	return load, fmt.Sprintf("load after placement %.2f", load)
+}
+
+// localityScore prefers workers that already have the job's image cached,
+// falling back to the least loaded worker.
+func localityScore(job Job, w *Worker) (float64, string) {
+	headroom := 1 - utilization(w, Resources{}, 0)
+	if w.CachedImages[job.DockerfileReference] {
+		return 0.5 + headroom/2, "image cached"
+	}
+	return headroom / 2, "image not cached"
+}
+
+// roundRobinScheduler rotates through workers in ID order, starting after the
+// worker that received the previous job.
+type roundRobinScheduler struct {
+	mu   sync.Mutex
+	last string
+}
+
+func (s *roundRobinScheduler) Name() string {
+	return "round-robin"
+}
+
+func (s *roundRobinScheduler) Select(job Job, candidates []*Worker) (*Worker, []CandidateScore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := make([]*Worker, len(candidates))
+	copy(ordered, candidates)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].ID < ordered[j].ID })
+	start := sort.Search(len(ordered), func(i int) bool { return ordered[i].ID > s.last })
+
+	scores := make([]CandidateScore, len(ordered))
+	for i, w := range ordered {
+		position := (i - start + len(ordered)) % len(ordered)
+		scores[i] = CandidateScore{
+			WorkerID: w.ID,
+			Score:    1 - float64(position)/float64(len(ordered)),
+			Reason:   fmt.Sprintf("position %d in rotation", position),
+		}
+	}
+	chosen, scores := rank(job, ordered, scores)
+	s.last = chosen.ID
+	return chosen, scores
+}
+
+// decisionLog keeps the most recent scheduling decisions.
+type decisionLog struct {
+	mu        sync.Mutex
+	decisions []Decision
+	next      int
+	full      bool
+}
+
+func newDecisionLog(size int) *decisionLog {
+	if size <= 0 {
+		size = 1000
+	}
+	return &decisionLog{decisions: make([]Decision, size)}
+}
+
+func (l *decisionLog) Record(d Decision) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions[l.next] = d
+	l.next = (l.next + 1) % len(l.decisions)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// List returns recorded decisions, newest first, optionally only those for jobID.
+func (l *decisionLog) List(jobID string) []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.decisions)
+	}
+	result := make([]Decision, 0, n)
+	for i := 1; i <= n; i++ {
+		d := l.decisions[(l.next-i+len(l.decisions))%len(l.decisions)]
+		if jobID == "" || d.JobID == jobID {
+			result = append(result, d)
+		}
+	}
+	return result
+}
@@ -0,0 +1,178 @@
+package coordinator
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testWorker returns a worker with slots slots, capacity and running jobs
+// that each request perJob.
+func testWorker(id string, slots, running int, capacity, perJob Resources) *Worker {
+	w := &Worker{
+		ID:           id,
+		Slots:        slots,
+		Capacity:     capacity,
+		AssignedJobs: make(map[string]Job),
+		CachedImages: make(map[string]bool),
+		Labels:       make(map[string]string),
+	}
+	for i := 0; i < running; i++ {
+		jobID := fmt.Sprintf("%s-job-%d", id, i)
+		w.AssignedJobs[jobID] = Job{JobID: jobID, Resources: perJob}
+	}
+	return w
+}
+
+func TestCanRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		job        Job
+		worker     *Worker
+		want       bool
+		wantReason string
+	}{
+		{
+			name:   "free slot",
+			worker: testWorker("w", 2, 1, Resources{}, Resources{}),
+			want:   true,
+		},
+		{
+			name:       "no free slots",
+			worker:     testWorker("w", 1, 1, Resources{}, Resources{}),
+			wantReason: "no free slots",
+		},
+		{
+			name:       "node selector mismatch",
+			job:        Job{NodeSelector: map[string]string{"arch": "arm64"}},
+			worker:     testWorker("w", 1, 0, Resources{}, Resources{}),
+			wantReason: "node selector mismatch",
+		},
+		{
+			name:       "insufficient cpu",
+			job:        Job{Resources: Resources{CPU: 2}},
+			worker:     testWorker("w", 4, 1, Resources{CPU: 4}, Resources{CPU: 3}),
+			wantReason: "insufficient cpu",
+		},
+		{
+			name:       "insufficient memory",
+			job:        Job{Resources: Resources{MemoryMB: 1024}},
+			worker:     testWorker("w", 4, 1, Resources{MemoryMB: 2048}, Resources{MemoryMB: 1536}),
+			wantReason: "insufficient memory",
+		},
+		{
+			name:   "exactly fills capacity",
+			job:    Job{Resources: Resources{CPU: 1, MemoryMB: 512}},
+			worker: testWorker("w", 4, 1, Resources{CPU: 2, MemoryMB: 1024}, Resources{CPU: 1, MemoryMB: 512}),
+			want:   true,
+		},
+		{
+			name:   "unlimited capacity",
+			job:    Job{Resources: Resources{CPU: 64, MemoryMB: 1 << 20}},
+			worker: testWorker("w", 1, 0, Resources{}, Resources{}),
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := canRun(tt.job, tt.worker)
+			if got != tt.want || reason != tt.wantReason {
+				t.Fatalf("canRun = %v, %q, want %v, %q", got, reason, tt.want, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestSchedulerStrategies(t *testing.T) {
+	const image = "https://example.com/Dockerfile"
+	// busy has 3 of 4 slots in use, idle none; cached is half busy and
+	// has the image.
+	workers := func() []*Worker {
+		busy := testWorker("busy", 4, 3, Resources{}, Resources{})
+		idle := testWorker("idle", 4, 0, Resources{}, Resources{})
+		cached := testWorker("cached", 4, 2, Resources{}, Resources{})
+		cached.CachedImages[image] = true
+		return []*Worker{busy, idle, cached}
+	}
+	tests := []struct {
+		name     string
+		strategy string
+		job      Job
+		want     string
+	}{
+		{"least-loaded", "least-loaded", Job{}, "idle"},
+		{"bin-packing", "bin-packing", Job{}, "busy"},
+		{"locality cached", "locality", Job{DockerfileReference: image}, "cached"},
+		{"locality not cached", "locality", Job{DockerfileReference: "https://example.com/other"}, "idle"},
+		// Affinity outweighs the strategy's own preference.
+		{"least-loaded affinity", "least-loaded", Job{Affinity: []AffinityTerm{{Key: "disk", Operator: OperatorExists}}}, "busy"},
+		{"bin-packing anti-affinity", "bin-packing", Job{AntiAffinity: []AffinityTerm{{Key: "disk", Operator: OperatorExists}}}, "cached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheduler, err := NewScheduler(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			candidates := workers()
+			candidates[0].Labels["disk"] = "ssd"
+			chosen, scores := scheduler.Select(tt.job, candidates)
+			if chosen.ID != tt.want {
+				t.Fatalf("Select chose %s, want %s (scores %+v)", chosen.ID, tt.want, scores)
+			}
+			if len(scores) != len(candidates) {
+				t.Fatalf("Select returned %d scores for %d candidates", len(scores), len(candidates))
+			}
+		})
+	}
+}
+
+func TestRoundRobinScheduler(t *testing.T) {
+	scheduler, err := NewScheduler("round-robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := []*Worker{
+		testWorker("c", 1, 0, Resources{}, Resources{}),
+		testWorker("a", 1, 0, Resources{}, Resources{}),
+		testWorker("b", 1, 0, Resources{}, Resources{}),
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		chosen, _ := scheduler.Select(Job{}, candidates)
+		got = append(got, chosen.ID)
+	}
+	if fmt.Sprint(got) != "[a b c a]" {
+		t.Fatalf("round-robin chose %v, want [a b c a]", got)
+	}
+
+	// A worker that left the candidates is skipped without restarting the
+	// rotation.
+	chosen, _ := scheduler.Select(Job{}, candidates[:1])
+	if chosen.ID != "c" {
+		t.Fatalf("round-robin chose %s from [c], want c", chosen.ID)
+	}
+}
+
+func TestNewSchedulerUnknownStrategy(t *testing.T) {
+	if _, err := NewScheduler("random"); err == nil {
+		t.Fatal("NewScheduler accepted an unknown strategy")
+	}
+	scheduler, err := NewScheduler("")
+	if err != nil || scheduler.Name() != "round-robin" {
+		t.Fatalf("NewScheduler(\"\") = %v, %v, want round-robin", scheduler, err)
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	log := newDecisionLog(3)
+	for i := 1; i <= 4; i++ {
+		log.Record(Decision{JobID: fmt.Sprintf("job-%d", i%2)})
+	}
+	all := log.List("")
+	if len(all) != 3 || all[0].JobID != "job-0" || all[1].JobID != "job-1" {
+		t.Fatalf("List = %+v, want the 3 newest decisions, newest first", all)
+	}
+	if ones := log.List("job-1"); len(ones) != 1 {
+		t.Fatalf("List(job-1) = %+v, want the one kept decision for job-1", ones)
+	}
+}
@@ -0,0 +1,289 @@
+package coordinator
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// defaultTenant owns jobs that are submitted without a tenant or user ID.
+const defaultTenant = "default"
+
+// TenantQuota limits how much of the cluster a single tenant may use.
+// Zero values mean "unlimited" for MaxConcurrentJobs and RatePerMinute.
+type TenantQuota struct {
+	Weight            int `mapstructure:"weight" json:"weight"`
+	MaxConcurrentJobs int `mapstructure:"max_concurrent_jobs" json:"max_concurrent_jobs"`
+	RatePerMinute     int `mapstructure:"rate_per_minute" json:"rate_per_minute"`
+	Burst             int `mapstructure:"burst" json:"burst"`
+}
+
+// TenantUsage is a point-in-time view of a tenant's quota consumption.
+type TenantUsage struct {
+	TenantID        string      `json:"tenant_id"`
+	Quota           TenantQuota `json:"quota"`
+	Pending         int         `json:"pending"`
+	Running         int         `json:"running"`
+	Dispatched      int64       `json:"dispatched"`
+	Throttled       int64       `json:"throttled"`
+	AvailableTokens float64     `json:"available_tokens"`
+}
+
+type tenantState struct {
+	id         string
+	quota      TenantQuota
+	queue      []Job
+	running    int
+	bucket     *tokenBucket
+	current    int // smooth weighted round-robin counter
+	dispatched int64
+	throttled  int64
+	// blocked is set while the tenant's rate quota holds its jobs back, so
+	// each time it runs out of tokens is counted once.
+	blocked bool
+}
+
+// FairShareQueue holds pending jobs per tenant and hands them out using smooth
+// weighted round-robin, skipping tenants that are over their concurrency or
+// rate quota. This keeps a burst from one tenant from starving the others.
+type FairShareQueue struct {
+	mu        sync.Mutex
+	defaults  TenantQuota
+	overrides map[string]TenantQuota
+	tenants   map[string]*tenantState
+}
+
+// NewFairShareQueue creates a queue where tenants without an override use defaults.
+func NewFairShareQueue(defaults TenantQuota, overrides map[string]TenantQuota) *FairShareQueue {
+	if defaults.Weight <= 0 {
+		defaults.Weight = 1
+	}
+	if overrides == nil {
+		overrides = make(map[string]TenantQuota)
+	}
+	return &FairShareQueue{
+		defaults:  defaults,
+		overrides: overrides,
+		tenants:   make(map[string]*tenantState),
+	}
+}
+
+// NewFairShareQueueFromConfig builds a FairShareQueue from the "tenants" config section.
+func NewFairShareQueueFromConfig(config *viper.Viper) (*FairShareQueue, error) {
+	var defaults TenantQuota
+	if err := config.UnmarshalKey("tenants.default", &defaults); err != nil {
+		return nil, fmt.Errorf("invalid tenants.default configuration: %w", err)
+	}
+
+	var list []struct {
+		ID          string `mapstructure:"id"`
+		TenantQuota `mapstructure:",squash"`
+	}
+	if err := config.UnmarshalKey("tenants.list", &list); err != nil {
+		return nil, fmt.Errorf("invalid tenants.list configuration: %w", err)
+	}
+
+	overrides := make(map[string]TenantQuota, len(list))
+	for _, t := range list {
+		if t.Weight <= 0 {
+			t.Weight = defaults.Weight
+		}
+		overrides[t.ID] = t.TenantQuota
+	}
+	return NewFairShareQueue(defaults, overrides), nil
+}
+
+// tenant returns the state for id, creating it on first use. Callers must hold q.mu.
+func (q *FairShareQueue) tenant(id string) *tenantState {
+	if t, ok := q.tenants[id]; ok {
+		return t
+	}
+	quota, ok := q.overrides[id]
+	if !ok {
+		quota = q.defaults
+	}
+	if quota.Weight <= 0 {
+		quota.Weight = 1
+	}
+	t := &tenantState{
+		id:     id,
+		quota:  quota,
+		bucket: newTokenBucket(quota.RatePerMinute, quota.Burst),
+	}
+	q.tenants[id] = t
+	return t
+}
+
+// Push appends a job to its tenant's queue.
+func (q *FairShareQueue) Push(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.TenantID == "" {
+		job.TenantID = defaultTenant
+	}
+	t := q.tenant(job.TenantID)
+	t.queue = append(t.queue, job)
+}
+
+// Requeue puts a job that could not be dispatched back at the head of its
+// tenant's queue and releases the concurrency slot and rate token it was
+// holding.
+func (q *FairShareQueue) Requeue(job Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenant(job.TenantID)
+	t.queue = append([]Job{job}, t.queue...)
+	if t.running > 0 {
+		t.running--
+	}
+	t.bucket.Refund()
+	t.dispatched--
+}
+
+// Acquire counts a job that is already running against tenantID's
+// concurrency without queueing it, e.g. a job found running on a worker
+// after the coordinator restarted. It is freed with Release.
+func (q *FairShareQueue) Acquire(tenantID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tenant(tenantID).running++
+}
+
+// Release frees a concurrency slot held by tenantID once one of its jobs finishes.
+func (q *FairShareQueue) Release(tenantID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t, ok := q.tenants[tenantID]; ok && t.running > 0 {
+		t.running--
+	}
+}
+
+// Next returns the next job to dispatch according to the tenants' weights, or
+// false when no tenant has a job it is allowed to run right now. Only jobs for
+// which fits returns true are considered, so a job that cannot be placed does
+// not block the ones queued behind it; a nil fits accepts every job. The
+// returned job counts against its tenant's concurrency until Release or
+// Requeue is called.
+func (q *FairShareQueue) Next(fits func(Job) bool) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	totalWeight := 0
+	var best *tenantState
+	bestIndex := -1
+	for _, t := range q.tenants {
+		if len(t.queue) == 0 {
+			continue
+		}
+		if t.quota.MaxConcurrentJobs > 0 && t.running >= t.quota.MaxConcurrentJobs {
+			continue
+		}
+		if !t.bucket.Allow(now) {
+			if !t.blocked {
+				t.blocked = true
+				t.throttled++
+			}
+			continue
+		}
+		index := firstFitting(t.queue, fits)
+		if index < 0 {
+			continue
+		}
+		t.current += t.quota.Weight
+		totalWeight += t.quota.Weight
+		if best == nil || t.current > best.current || (t.current == best.current && t.id < best.id) {
+			best = t
+			bestIndex = index
+		}
+	}
+	if best == nil {
+		return Job{}, false
+	}
+
+	best.current -= totalWeight
+	best.bucket.Take(now)
+	best.blocked = false
+	job := best.queue[bestIndex]
+	if bestIndex == 0 {
+		best.queue = best.queue[1:]
+	} else {
+		best.queue = slices.Delete(best.queue, bestIndex, bestIndex+1)
+	}
+	best.running++
+	best.dispatched++
+	return job, true
+}
+
+func firstFitting(jobs []Job, fits func(Job) bool) int {
+	if fits == nil {
+		return 0
+	}
+	for i, job := range jobs {
+		if fits(job) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Len returns the number of pending jobs across all tenants.
+func (q *FairShareQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, t := range q.tenants {
+		n += len(t.queue)
+	}
+	return n
+}
+
+// Usage returns quota usage for every tenant that has submitted jobs or has
+// an explicit quota configured, sorted by tenant ID.
+func (q *FairShareQueue) Usage() []TenantUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id := range q.overrides {
+		q.tenant(id)
+	}
+
+	now := time.Now()
+	usage := make([]TenantUsage, 0, len(q.tenants))
+	for _, t := range q.tenants {
+		usage = append(usage, TenantUsage{
+			TenantID:        t.id,
+			Quota:           t.quota,
+			Pending:         len(t.queue),
+			Running:         t.running,
+			Dispatched:      t.dispatched,
+			Throttled:       t.throttled,
+			AvailableTokens: t.bucket.Available(now),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].TenantID < usage[j].TenantID })
+	return usage
+}
+
+// TenantUsage returns quota usage for a single tenant.
+func (q *FairShareQueue) TenantUsage(tenantID string) TenantUsage {
+	for _, u := range q.Usage() {
+		if u.TenantID == tenantID {
+			return u
+		}
+	}
+	q.mu.Lock()
+	quota, ok := q.overrides[tenantID]
+	if !ok {
+		quota = q.defaults
+	}
+	q.mu.Unlock()
+	return TenantUsage{
+		TenantID:        tenantID,
+		Quota:           quota,
+		AvailableTokens: newTokenBucket(quota.RatePerMinute, quota.Burst).Available(time.Now()),
+	}
+}
@@ -0,0 +1,165 @@
+package coordinator
+
+import (
+	"fmt"
+	"testing"
+)
+
+// pushJobs queues n jobs for each tenant, named <tenant>-<i>.
+func pushJobs(q *FairShareQueue, n int, tenants ...string) {
+	for _, tenant := range tenants {
+		for i := 0; i < n; i++ {
+			q.Push(Job{JobID: fmt.Sprintf("%s-%d", tenant, i), TenantID: tenant})
+		}
+	}
+}
+
+// drain takes up to n jobs from q, releasing each one straight away, and
+// counts them per tenant.
+func drain(q *FairShareQueue, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		job, ok := q.Next(nil)
+		if !ok {
+			break
+		}
+		counts[job.TenantID]++
+		q.Release(job.TenantID)
+	}
+	return counts
+}
+
+func TestFairShareQueueWeights(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides map[string]TenantQuota
+		take      int
+		want      map[string]int
+	}{
+		{
+			name: "equal weights",
+			take: 8,
+			want: map[string]int{"a": 4, "b": 4},
+		},
+		{
+			name:      "three to one",
+			overrides: map[string]TenantQuota{"a": {Weight: 3}, "b": {Weight: 1}},
+			take:      8,
+			want:      map[string]int{"a": 6, "b": 2},
+		},
+		{
+			name:      "idle share goes to the other tenant",
+			overrides: map[string]TenantQuota{"a": {Weight: 1}, "b": {Weight: 9}},
+			take:      20,
+			want:      map[string]int{"a": 10, "b": 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewFairShareQueue(TenantQuota{}, tt.overrides)
+			pushJobs(q, 10, "a", "b")
+			got := drain(q, tt.take)
+			if got["a"] != tt.want["a"] || got["b"] != tt.want["b"] {
+				t.Fatalf("dispatched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairShareQueueQuotas(t *testing.T) {
+	tests := []struct {
+		name  string
+		quota TenantQuota
+		// want is how many jobs Next hands out while none is released.
+		want          int
+		wantThrottled int64
+	}{
+		{"unlimited", TenantQuota{}, 5, 0},
+		{"concurrency", TenantQuota{MaxConcurrentJobs: 2}, 2, 0},
+		{"rate with burst", TenantQuota{RatePerMinute: 1, Burst: 3}, 3, 1},
+		{"rate without burst", TenantQuota{RatePerMinute: 4}, 4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewFairShareQueue(tt.quota, nil)
+			pushJobs(q, 5, "a")
+			got := 0
+			for {
+				if _, ok := q.Next(nil); !ok {
+					break
+				}
+				got++
+			}
+			if got != tt.want {
+				t.Fatalf("Next handed out %d jobs, want %d", got, tt.want)
+			}
+			usage := q.TenantUsage("a")
+			if usage.Pending != 5-tt.want || usage.Running != tt.want {
+				t.Errorf("usage = %+v, want %d pending and %d running", usage, 5-tt.want, tt.want)
+			}
+			if usage.Throttled != tt.wantThrottled {
+				t.Errorf("throttled = %d, want %d", usage.Throttled, tt.wantThrottled)
+			}
+		})
+	}
+}
+
+func TestFairShareQueueDefaultTenant(t *testing.T) {
+	q := NewFairShareQueue(TenantQuota{}, nil)
+	q.Push(Job{JobID: "job-1"})
+	job, ok := q.Next(nil)
+	if !ok || job.TenantID != defaultTenant {
+		t.Fatalf("Next = %+v, %v, want job-1 of the default tenant", job, ok)
+	}
+}
+
+func TestFairShareQueueSkipsJobsThatDoNotFit(t *testing.T) {
+	q := NewFairShareQueue(TenantQuota{}, nil)
+	pushJobs(q, 3, "a")
+	job, ok := q.Next(func(job Job) bool { return job.JobID != "a-0" })
+	if !ok || job.JobID != "a-1" {
+		t.Fatalf("Next = %+v, %v, want a-1", job, ok)
+	}
+	if _, ok := q.Next(func(Job) bool { return false }); ok {
+		t.Fatal("Next returned a job that does not fit")
+	}
+	job, _ = q.Next(nil)
+	if job.JobID != "a-0" {
+		t.Fatalf("Next = %s, want a-0, which kept its place", job.JobID)
+	}
+}
+
+func TestFairShareQueueRequeue(t *testing.T) {
+	q := NewFairShareQueue(TenantQuota{MaxConcurrentJobs: 1, RatePerMinute: 1, Burst: 1}, nil)
+	pushJobs(q, 2, "a")
+	job, ok := q.Next(nil)
+	if !ok {
+		t.Fatal("Next returned no job")
+	}
+	if _, ok := q.Next(nil); ok {
+		t.Fatal("Next ignored the tenant's quota")
+	}
+
+	q.Requeue(job)
+	usage := q.TenantUsage("a")
+	if usage.Running != 0 || usage.Dispatched != 0 || usage.AvailableTokens < 1 {
+		t.Fatalf("usage after Requeue = %+v, want the slot and token released", usage)
+	}
+	again, ok := q.Next(nil)
+	if !ok || again.JobID != job.JobID {
+		t.Fatalf("Next after Requeue = %+v, %v, want %s again", again, ok, job.JobID)
+	}
+}
+
+func TestFairShareQueueAcquireRelease(t *testing.T) {
+	q := NewFairShareQueue(TenantQuota{MaxConcurrentJobs: 1}, nil)
+	q.Acquire("a")
+	pushJobs(q, 1, "a")
+	if _, ok := q.Next(nil); ok {
+		t.Fatal("Next ignored a job counted with Acquire")
+	}
+	q.Release("a")
+	if _, ok := q.Next(nil); !ok {
+		t.Fatal("Next returned no job after Release")
+	}
+}
@@ -0,0 +1,87 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"execution-service/internal/jobstream"
+	"execution-service/internal/logging"
+	"execution-service/internal/storage"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// handleJobUpdates streams job changes as server-sent events: for one job
+// on /jobs/{job_id}/updates, and for all jobs or those of tenant_id on
+// /jobs/updates. Each event's ID is a resume token. Clients that reconnect
+// with it in the Last-Event-ID header, or the after parameter, receive the
+// changes they missed; 410 Gone means the token is too old and the client
+// has to reload the jobs before subscribing again.
+func (c *Coordinator) handleJobUpdates(wr http.ResponseWriter, req *http.Request) {
+	if c.updates == nil {
+		http.Error(wr, "Job updates are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := wr.(http.Flusher)
+	if !ok {
+		http.Error(wr, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	filter := jobstream.Filter{JobID: req.PathValue("job_id"), TenantID: req.URL.Query().Get("tenant_id")}
+	after := req.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = req.URL.Query().Get("after")
+	}
+
+	sub, err := c.updates.Subscribe(req.Context(), filter, after)
+	if errors.Is(err, storage.ErrChangeHistoryLost) {
+		http.Error(wr, "Resume token is no longer available", http.StatusGone)
+		return
+	}
+	if err != nil {
+		c.logger.Error("Failed to subscribe to job updates", zap.Error(err))
+		http.Error(wr, "Failed to subscribe to job updates", http.StatusInternalServerError)
+		return
+	}
+	defer c.updates.Unsubscribe(sub)
+
+	wr.Header().Set("Content-Type", "text/event-stream")
+	wr.Header().Set("Cache-Control", "no-cache")
+	wr.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(c.updatesKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case change, ok := <-sub.Changes():
+			if !ok {
+				// The client reconnects with the last event ID it received.
+				if err := sub.Err(); err != nil {
+					data, _ := json.Marshal(map[string]string{"error": err.Error()})
+					fmt.Fprintf(wr, "event: error\ndata: %s\n\n", data)
+					flusher.Flush()
+				}
+				return
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				c.logger.Error("Failed to encode job update", logging.JobID(change.Job.JobID), zap.Error(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(wr, "id: %s\nevent: job\ndata: %s\n\n", change.Token, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(wr, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
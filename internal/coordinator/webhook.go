@@ -0,0 +1,536 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"execution-service/internal/logging"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// Headers sent with every webhook.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookEventHeader     = "X-Webhook-Event"
+)
+
+// webhookSecretEnv overrides webhooks.secret so the secret can be kept out of
+// the config file.
+const webhookSecretEnv = "WEBHOOK_SECRET"
+
+// ErrDeliveryNotFound is returned for unknown webhook delivery IDs.
+var ErrDeliveryNotFound = errors.New("webhook delivery not found")
+
+// errWebhooksDisabled is returned for callbacks while no secret is configured.
+var errWebhooksDisabled = errors.New("webhooks are disabled because webhooks.secret is not set")
+
+// Callback asks for a webhook when the job changes to one of Events. Without
+// Events, webhooks are sent when the job succeeds or fails.
+type Callback struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+}
+
+// Wants reports whether the callback subscribes to status.
+func (cb *Callback) Wants(status string) bool {
+	if len(cb.Events) == 0 {
+		return status == models.JobStatusSucceeded || status == models.JobStatusFailed
+	}
+	return slices.Contains(cb.Events, status)
+}
+
+type registeredCallback struct {
+	callback *Callback
+	tenantID string
+}
+
+// WebhookDispatcher sends job events to job callback URLs. Payloads are
+// signed with HMAC-SHA256 over "<timestamp>.<body>" and failed deliveries
+// are retried with exponential backoff. A job's deliveries are made one at a
+// time in the order of its events. Deliveries are kept in memory and,
+// when a collection is set, in MongoDB so pending retries survive restarts.
+// Without a secret no webhooks are sent, and webhooks are never sent to
+// loopback, private or link-local addresses.
+type WebhookDispatcher struct {
+	secret         []byte
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	historySize    int
+	client         *http.Client
+	collection     *mongo.Collection
+	done           <-chan struct{}
+	logger         *zap.Logger
+
+	mu         sync.Mutex
+	callbacks  map[string]registeredCallback
+	deliveries map[string]*models.WebhookDelivery
+	// finished lists delivered and failed deliveries, oldest first, so the
+	// oldest can be dropped from memory once there are historySize of them.
+	finished []string
+	// active holds deliveries that are queued or being delivered.
+	active map[string]bool
+	// queues holds the active deliveries of each job in event order. The
+	// first one is being delivered; the rest wait for it to finish.
+	queues map[string][]queuedDelivery
+}
+
+// queuedDelivery is a delivery waiting for the earlier deliveries of its job.
+type queuedDelivery struct {
+	delivery *models.WebhookDelivery
+	attempts int
+}
+
+// NewWebhookDispatcherFromConfig creates a WebhookDispatcher from the
+// "webhooks" config section. collection may be nil.
+func NewWebhookDispatcherFromConfig(config *viper.Viper, collection *mongo.Collection, done <-chan struct{}, logger *zap.Logger) (*WebhookDispatcher, error) {
+	secret := config.GetString("webhooks.secret")
+	if env := os.Getenv(webhookSecretEnv); env != "" {
+		secret = env
+	}
+	if secret == "" {
+		logger.Warn("No webhooks.secret configured, jobs with a callback are rejected")
+	}
+	maxAttempts := config.GetInt("webhooks.max_attempts")
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+	historySize := config.GetInt("webhooks.history_size")
+	if historySize <= 0 {
+		historySize = 1000
+	}
+	initialBackoff, err := configDuration(config, "webhooks.initial_backoff", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := configDuration(config, "webhooks.max_backoff", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := configDuration(config, "webhooks.timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookDispatcher{
+		secret:         []byte(secret),
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		historySize:    historySize,
+		client:         newWebhookClient(timeout),
+		collection:     collection,
+		done:           done,
+		logger:         logger,
+		callbacks:      make(map[string]registeredCallback),
+		deliveries:     make(map[string]*models.WebhookDelivery),
+		active:         make(map[string]bool),
+		queues:         make(map[string][]queuedDelivery),
+	}, nil
+}
+
+// configDuration reads a duration from config, falling back to def when unset.
+func configDuration(config *viper.Viper, key string, def time.Duration) (time.Duration, error) {
+	value := config.GetString(key)
+	if value == "" {
+		return def, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for %s: %w", key, err)
+	}
+	return duration, nil
+}
+
+// configString returns the string at key, or def if it is not set.
+func configString(config *viper.Viper, key, def string) string {
+	if value := config.GetString(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// newWebhookClient returns an HTTP client that only connects to public
+// addresses. The check runs on the resolved address of every connection, so
+// it also covers redirects and host names that resolve to internal addresses.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// publicIP reports whether ip may receive webhooks.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsMulticast()
+}
+
+// CheckCallback returns an error if webhooks cannot be sent to cb: while no
+// secret is configured, or if its URL is not an http or https URL of a
+// public host. Host names are checked again when they are resolved.
+func (d *WebhookDispatcher) CheckCallback(cb *Callback) error {
+	if len(d.secret) == 0 {
+		return errWebhooksDisabled
+	}
+	u, err := url.Parse(cb.URL)
+	if err != nil {
+		return fmt.Errorf("invalid callback URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("callback URL must use http or https")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("callback URL has no host")
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicIP(ip) {
+		return fmt.Errorf("callback URL must not point to a loopback, private or link-local address")
+	}
+	if host = strings.ToLower(strings.TrimSuffix(host, ".")); host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("callback URL must not point to localhost")
+	}
+	return nil
+}
+
+// Register remembers the callback of job, if it has one. Callbacks that fail
+// CheckCallback, e.g. of jobs accepted before the configuration changed, are
+// dropped.
+func (d *WebhookDispatcher) Register(job Job) {
+	if job.Callback == nil {
+		return
+	}
+	if err := d.CheckCallback(job.Callback); err != nil {
+		d.logger.Warn("Dropping job callback", logging.JobID(job.JobID), zap.Error(err))
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.callbacks[job.JobID] = registeredCallback{callback: job.Callback, tenantID: job.TenantID}
+}
+
+// Notify sends event to the callback of its job if the callback subscribes
+// to the new status. Callbacks are forgotten once the job finished.
+func (d *WebhookDispatcher) Notify(event models.JobEvent) {
+	d.mu.Lock()
+	registered, ok := d.callbacks[event.JobID]
+	if ok && (event.Status == models.JobStatusSucceeded || event.Status == models.JobStatusFailed) {
+		delete(d.callbacks, event.JobID)
+	}
+	d.mu.Unlock()
+	if !ok || !registered.callback.Wants(event.Status) {
+		return
+	}
+
+	now := time.Now()
+	id := primitive.NewObjectID().Hex()
+	if event.EventID == "" {
+		event.EventID = id
+	}
+	if event.TenantID == "" {
+		event.TenantID = registered.tenantID
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = now
+	}
+	d.start(&models.WebhookDelivery{
+		DeliveryID: id,
+		JobID:      event.JobID,
+		URL:        registered.callback.URL,
+		Event:      event,
+		Status:     models.WebhookDeliveryPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, d.maxAttempts)
+}
+
+// Redeliver retries a delivery with a fresh set of attempts. Deliveries that
+// are still being retried are returned unchanged.
+func (d *WebhookDispatcher) Redeliver(ctx context.Context, deliveryID string) (models.WebhookDelivery, error) {
+	if len(d.secret) == 0 {
+		return models.WebhookDelivery{}, errWebhooksDisabled
+	}
+	delivery, err := d.lookup(ctx, deliveryID)
+	if err != nil {
+		return models.WebhookDelivery{}, err
+	}
+	delivery.Status = models.WebhookDeliveryPending
+	delivery.UpdatedAt = time.Now()
+	d.start(&delivery, d.maxAttempts)
+	return d.Get(ctx, deliveryID)
+}
+
+// Resume restarts the deliveries that were still pending when the
+// coordinator stopped. They stay pending while no secret is configured.
+func (d *WebhookDispatcher) Resume(ctx context.Context) error {
+	if d.collection == nil || len(d.secret) == 0 {
+		return nil
+	}
+	pending, err := queries.FindWebhookDeliveries(ctx, d.collection, bson.M{"status": models.WebhookDeliveryPending})
+	if err != nil {
+		return err
+	}
+	for i := range pending {
+		// Attempts made before the restart count against the retry budget.
+		d.start(&pending[i], max(1, d.maxAttempts-len(pending[i].Attempts)))
+	}
+	if len(pending) > 0 {
+		d.logger.Info("Resumed pending webhook deliveries", zap.Int("deliveries", len(pending)))
+	}
+	return nil
+}
+
+// Get returns a delivery by ID.
+func (d *WebhookDispatcher) Get(ctx context.Context, deliveryID string) (models.WebhookDelivery, error) {
+	return d.lookup(ctx, deliveryID)
+}
+
+// List returns the deliveries of jobID, or of all jobs if jobID is empty,
+// oldest first.
+func (d *WebhookDispatcher) List(ctx context.Context, jobID string) ([]models.WebhookDelivery, error) {
+	if d.collection != nil {
+		filter := bson.M{}
+		if jobID != "" {
+			filter["job_id"] = jobID
+		}
+		return queries.FindWebhookDeliveries(ctx, d.collection, filter)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := make([]models.WebhookDelivery, 0)
+	for _, delivery := range d.deliveries {
+		if jobID == "" || delivery.JobID == jobID {
+			deliveries = append(deliveries, snapshotDelivery(delivery))
+		}
+	}
+	slices.SortFunc(deliveries, func(a, b models.WebhookDelivery) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return deliveries, nil
+}
+
+func (d *WebhookDispatcher) lookup(ctx context.Context, deliveryID string) (models.WebhookDelivery, error) {
+	d.mu.Lock()
+	delivery, ok := d.deliveries[deliveryID]
+	if ok {
+		snapshot := snapshotDelivery(delivery)
+		d.mu.Unlock()
+		return snapshot, nil
+	}
+	d.mu.Unlock()
+	if d.collection == nil {
+		return models.WebhookDelivery{}, ErrDeliveryNotFound
+	}
+	stored, err := queries.GetWebhookDelivery(ctx, d.collection, deliveryID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.WebhookDelivery{}, ErrDeliveryNotFound
+	}
+	return stored, err
+}
+
+func snapshotDelivery(delivery *models.WebhookDelivery) models.WebhookDelivery {
+	snapshot := *delivery
+	snapshot.Attempts = slices.Clone(delivery.Attempts)
+	return snapshot
+}
+
+// start tracks delivery and delivers it in the background, making at most
+// attempts attempts. Deliveries of the same job are made one at a time, in
+// the order they were started, so receivers see a job's events in order. It
+// does nothing if the delivery is already in progress.
+func (d *WebhookDispatcher) start(delivery *models.WebhookDelivery, attempts int) {
+	d.mu.Lock()
+	if d.active[delivery.DeliveryID] {
+		d.mu.Unlock()
+		return
+	}
+	d.deliveries[delivery.DeliveryID] = delivery
+	d.finished = slices.DeleteFunc(d.finished, func(id string) bool { return id == delivery.DeliveryID })
+	d.active[delivery.DeliveryID] = true
+	queue := append(d.queues[delivery.JobID], queuedDelivery{delivery: delivery, attempts: attempts})
+	d.queues[delivery.JobID] = queue
+	d.mu.Unlock()
+	d.save(delivery)
+	if len(queue) == 1 {
+		go d.deliverQueue(delivery.JobID)
+	}
+}
+
+// deliverQueue makes the queued deliveries of jobID in order until the queue
+// is empty or the dispatcher stops.
+func (d *WebhookDispatcher) deliverQueue(jobID string) {
+	for {
+		d.mu.Lock()
+		next := d.queues[jobID][0]
+		d.mu.Unlock()
+		if !d.deliver(next.delivery, next.attempts) {
+			// Left pending with the rest of the queue; Resume picks them
+			// up after a restart.
+			return
+		}
+		d.mu.Lock()
+		queue := d.queues[jobID][1:]
+		if len(queue) == 0 {
+			delete(d.queues, jobID)
+		} else {
+			d.queues[jobID] = queue
+		}
+		d.mu.Unlock()
+		if len(queue) == 0 {
+			return
+		}
+	}
+}
+
+// deliver POSTs the delivery until it is accepted with a 2xx response or the
+// attempts run out, backing off exponentially between attempts. It returns
+// false if the dispatcher stopped before the delivery finished.
+func (d *WebhookDispatcher) deliver(delivery *models.WebhookDelivery, attempts int) bool {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		d.logger.Error("Failed to encode webhook", zap.String("delivery_id", delivery.DeliveryID), logging.JobID(delivery.JobID), zap.Error(err))
+		d.finish(delivery, models.WebhookDeliveryFailed)
+		return true
+	}
+
+	backoff := d.initialBackoff
+	for attempt := 1; ; attempt++ {
+		result := d.send(delivery, body)
+
+		d.mu.Lock()
+		delivery.Attempts = append(delivery.Attempts, result)
+		delivery.UpdatedAt = time.Now()
+		d.mu.Unlock()
+		if result.Error == "" {
+			d.finish(delivery, models.WebhookDeliveryDelivered)
+			return true
+		}
+		if attempt >= attempts {
+			d.logger.Warn("Giving up on webhook", zap.String("delivery_id", delivery.DeliveryID), logging.JobID(delivery.JobID),
+				zap.Int("attempts", attempt), zap.String("error", result.Error))
+			d.finish(delivery, models.WebhookDeliveryFailed)
+			return true
+		}
+
+		next := time.Now().Add(backoff)
+		d.mu.Lock()
+		delivery.NextAttemptAt = &next
+		d.mu.Unlock()
+		d.save(delivery)
+		select {
+		case <-time.After(backoff):
+		case <-d.done:
+			return false
+		}
+		backoff = min(backoff*2, d.maxBackoff)
+	}
+}
+
+// send makes one delivery attempt.
+func (d *WebhookDispatcher) send(delivery *models.WebhookDelivery, body []byte) models.WebhookAttempt {
+	start := time.Now()
+	attempt := models.WebhookAttempt{Time: start}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, delivery.DeliveryID)
+	req.Header.Set(webhookEventHeader, "job."+delivery.Event.Status)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, "sha256="+d.sign(timestamp, body))
+
+	resp, err := d.client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = "unexpected response status " + resp.Status
+	}
+	return attempt
+}
+
+// sign returns the hex HMAC-SHA256 of "<timestamp>.<body>". Including the
+// timestamp lets receivers reject replayed requests.
+func (d *WebhookDispatcher) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// finish records the final status of a delivery round and trims the
+// in-memory history.
+func (d *WebhookDispatcher) finish(delivery *models.WebhookDelivery, status string) {
+	d.mu.Lock()
+	delivery.Status = status
+	delivery.NextAttemptAt = nil
+	delivery.UpdatedAt = time.Now()
+	delete(d.active, delivery.DeliveryID)
+	d.finished = append(d.finished, delivery.DeliveryID)
+	for len(d.finished) > d.historySize {
+		delete(d.deliveries, d.finished[0])
+		d.finished = d.finished[1:]
+	}
+	d.mu.Unlock()
+	d.save(delivery)
+}
+
+// save persists a snapshot of delivery when a collection is configured.
+// Deliveries outlive the requests that start them, so the write is not tied
+// to one.
+func (d *WebhookDispatcher) save(delivery *models.WebhookDelivery) {
+	if d.collection == nil {
+		return
+	}
+	d.mu.Lock()
+	snapshot := snapshotDelivery(delivery)
+	d.mu.Unlock()
+	if err := queries.SaveWebhookDelivery(context.Background(), d.collection, snapshot); err != nil {
+		d.logger.Error("Failed to store webhook delivery", zap.String("delivery_id", delivery.DeliveryID), logging.JobID(delivery.JobID), zap.Error(err))
+	}
+}
@@ -0,0 +1,72 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"execution-service/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestWebhookDeliveriesOfAJobStayInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		var event models.JobEvent
+		json.NewDecoder(req.Body).Decode(&event)
+		mu.Lock()
+		defer mu.Unlock()
+		// Fail the first event once, so later events would overtake its retry.
+		if event.Status == models.JobStatusAssigned && !failed {
+			failed = true
+			wr.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received = append(received, event.Status)
+	}))
+	defer server.Close()
+
+	d := &WebhookDispatcher{
+		secret:         []byte("secret"),
+		maxAttempts:    3,
+		initialBackoff: 20 * time.Millisecond,
+		maxBackoff:     20 * time.Millisecond,
+		historySize:    10,
+		client:         server.Client(),
+		done:           make(chan struct{}),
+		logger:         zap.NewNop(),
+		callbacks:      make(map[string]registeredCallback),
+		deliveries:     make(map[string]*models.WebhookDelivery),
+		active:         make(map[string]bool),
+		queues:         make(map[string][]queuedDelivery),
+	}
+	// Registered directly: CheckCallback rejects the loopback test server.
+	d.callbacks["job-1"] = registeredCallback{callback: &Callback{
+		URL:    server.URL,
+		Events: []string{models.JobStatusAssigned, models.JobStatusSucceeded},
+	}}
+	d.Notify(models.JobEvent{JobID: "job-1", Status: models.JobStatusAssigned})
+	d.Notify(models.JobEvent{JobID: "job-1", Status: models.JobStatusSucceeded})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d webhooks, want 2", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received[0] != models.JobStatusAssigned || received[1] != models.JobStatusSucceeded {
+		t.Fatalf("received %v, want assigned then succeeded", received)
+	}
+}
@@ -2,21 +2,77 @@ package coordinator
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"execution-service/internal/tracing"
+	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
-	"log"	
 )
 
 // Worker represents a worker node in the system.
 type Worker struct {
-	ID         string
-	Name       string
-	Address    string
-	Status     string
-	AssignedJob *Job
+	ID            string
+	Name          string
+	Address       string
+	Status        string
 	LastHeartbeat time.Time
+	// AssignedJobs are the jobs the coordinator has assigned to the worker
+	// that have not finished yet, keyed by job ID.
+	AssignedJobs map[string]Job
+	// Slots is the number of jobs the worker runs concurrently.
+	Slots int
+	// Capacity is the total resources the worker offers to jobs. Zero fields
+	// are not limited.
+	Capacity Resources
+	// CachedImages holds the Dockerfile references the worker has built images for.
+	CachedImages map[string]bool
+	// StaticLabels are the labels set for the worker in the coordinator config.
+	StaticLabels map[string]string
+	// Labels are StaticLabels merged with the labels the worker advertises.
+	Labels map[string]string
+
+	// assignedAt records when each assigned job was handed to the worker,
+	// once its /execute request returned, so a probe that started earlier
+	// does not mistake it for a finished job.
+	assignedAt map[string]time.Time
+	// missing holds the assigned jobs the last probe did not find running.
+	// They are only treated as finished if the next probe does not find them
+	// either, which gives the worker's own report time to arrive.
+	missing map[string]bool
+	// inactiveSince is when the worker was last found unhealthy, and lost
+	// whether its jobs were given up on since.
+	inactiveSince time.Time
+	lost          bool
+	// rejections counts the jobs the worker refused in a row. No jobs are
+	// sent to it until backoffUntil.
+	rejections   int
+	backoffUntil time.Time
+}
+
+// initialRejectBackoff is how long no jobs are sent to a worker after it
+// refused one. It doubles with every further refusal in a row.
+const initialRejectBackoff = 500 * time.Millisecond
+
+// rejected records that w refused a job and returns how long no jobs are
+// sent to it, at most maxBackoff.
+func (w *Worker) rejected(now time.Time, maxBackoff time.Duration) time.Duration {
+	backoff := min(initialRejectBackoff<<min(w.rejections, 16), maxBackoff)
+	w.rejections++
+	w.backoffUntil = now.Add(backoff)
+	return backoff
+}
+
+// httpClient is used for all calls from the coordinator to workers.
+var httpClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		MaxIdleConns:        1000,
+		MaxIdleConnsPerHost: 100,
+		IdleConnTimeout:     90 * time.Second,
+	},
 }
 
 // WorkerManager manages the lifecycle of worker nodes.
@@ -69,6 +125,25 @@ func (wm *WorkerManager) GetActiveWorkers() []*Worker {
 	return activeWorkers
 }
 
+// GetWorker returns the worker with the given ID.
+func (wm *WorkerManager) GetWorker(id string) (*Worker, bool) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	worker, ok := wm.workers[id]
+	return worker, ok
+}
+
+// ListWorkers returns all workers regardless of status.
+func (wm *WorkerManager) ListWorkers() []*Worker {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	workers := make([]*Worker, 0, len(wm.workers))
+	for _, worker := range wm.workers {
+		workers = append(workers, worker)
+	}
+	return workers
+}
+
 // CheckWorkerHealth checks the health of workers and removes inactive ones.
 func (wm *WorkerManager) CheckWorkerHealth(timeout time.Duration) {
 	wm.mu.Lock()
@@ -81,7 +156,7 @@ func (wm *WorkerManager) CheckWorkerHealth(timeout time.Duration) {
 }
 
 func (w *Worker) IsHealthy() bool {
-	resp, err := http.Get(w.Address + "/health")
+	resp, err := httpClient.Get(w.Address + "/health")
 	if err != nil {
 		return false
 	}
@@ -90,65 +165,249 @@ func (w *Worker) IsHealthy() bool {
 	return resp.StatusCode == http.StatusOK
 }
 
-func (w *Worker) AssignJob(job Job) {
-	// Logic to assign a job to the worker
-	w.Status = "busy"
-	log.Print("Assigning job to worker", w.ID, job.ID)
-	reqBody, err := json.Marshal(job)
+// workerInfo is the worker's response to GET /info.
+type workerInfo struct {
+	Labels       map[string]string
+	Slots        int
+	CachedImages []string
+}
+
+// workerProbe is the result of polling a worker. Probes only read the
+// worker's immutable ID and Address, so they run without the coordinator lock;
+// the result is applied afterwards with applyProbe.
+type workerProbe struct {
+	startedAt time.Time
+	healthy   bool
+	info      *workerInfo
+	running   map[string]bool
+	err       error
+}
+
+// Probe checks the worker's health, advertised info and running jobs.
+func (w *Worker) Probe() workerProbe {
+	probe := workerProbe{startedAt: time.Now()}
+	if probe.healthy = w.IsHealthy(); !probe.healthy {
+		return probe
+	}
+	info, err := w.fetchInfo()
+	if err != nil {
+		probe.err = fmt.Errorf("failed to fetch info: %w", err)
+	} else {
+		probe.info = info
+	}
+	running, err := w.fetchRunningJobs()
 	if err != nil {
-		panic(err) // Handle error appropriately in production code
+		probe.err = fmt.Errorf("failed to fetch running jobs: %w", err)
+	} else {
+		probe.running = running
 	}
+	return probe
+}
 
-	resp, err := http.Post(w.Address+"/execute", "application/json", bytes.NewBuffer(reqBody))
+func (w *Worker) fetchInfo() (*workerInfo, error) {
+	resp, err := httpClient.Get(w.Address + "/info")
 	if err != nil {
-		panic(err) // Handle error appropriately in production code
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var info workerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
 
+func (w *Worker) fetchRunningJobs() (map[string]bool, error) {
+	resp, err := httpClient.Get(w.Address + "/job")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		// panic("Failed to assign job") // Handle error appropriately in production code
-		log.Printf("Failed to assign job to worker %s: %s", w.ID, resp.Status, resp.Body)
-		return
-	} else {
-		log.Printf("Job assigned to worker %s successfully", w.ID)
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var status struct {
+		JobID  string
+		JobIDs []string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
 	}
+	running := make(map[string]bool, len(status.JobIDs)+1)
+	for _, jobID := range status.JobIDs {
+		running[jobID] = true
+	}
+	if status.JobID != "" {
+		running[status.JobID] = true
+	}
+	return running, nil
+}
 
-	w.Status = "active"
+// workerContainer is a job container as listed by the worker's GET /containers.
+type workerContainer struct {
+	ID    string
+	JobID string
 }
 
-func (w *Worker) IsFree() bool {
-	resp, err := http.Get(w.Address + "/job")
+// fetchContainers lists the containers the worker started for jobs,
+// including ones it no longer tracks after a restart.
+func (w *Worker) fetchContainers() ([]workerContainer, error) {
+	resp, err := httpClient.Get(w.Address + "/containers")
 	if err != nil {
-		log.Printf("Error checking job status for worker %s: %v", w.ID, err)
-		return false
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var containers []workerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
 
-	if resp.StatusCode == http.StatusOK {
-		var job any
-		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
-			log.Printf("Error decoding job response for worker %s: %v", w.ID, err)
-			return false
+// removeContainer asks the worker to kill and remove one of its job containers.
+func (w *Worker) removeContainer(id string) error {
+	req, err := http.NewRequest(http.MethodDelete, w.Address+"/containers/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// applyProbe updates the worker from a probe and returns the assigned jobs
+// the worker has not reported as running in two probes in a row. The jobs
+// stay reserved until they are finished. Callers must hold the coordinator
+// lock.
+func (w *Worker) applyProbe(probe workerProbe) []Job {
+	w.LastHeartbeat = probe.startedAt
+	if probe.info != nil {
+		labels := make(map[string]string, len(w.StaticLabels)+len(probe.info.Labels))
+		for key, value := range w.StaticLabels {
+			labels[key] = value
 		}
-		jobMap, ok := job.(map[string]interface{})
-		if !ok {
-			log.Printf("Invalid job response format for worker %s", w.ID)
-			return false
+		// Advertised labels are merged over the configured ones and win on conflict.
+		for key, value := range probe.info.Labels {
+			labels[key] = value
 		}
-		jobID, ok := jobMap["JobID"].(string)
-		if !ok {
-			log.Printf("Invalid job ID format for worker %s", w.ID)
-			return false
+		w.Labels = labels
+		if probe.info.Slots > 0 {
+			w.Slots = probe.info.Slots
 		}
-		if jobID == "" {
-			return true // No job assigned
+		for _, ref := range probe.info.CachedImages {
+			w.CachedImages[ref] = true
+		}
+	}
+
+	var finished []Job
+	if probe.running != nil {
+		missing := make(map[string]bool)
+		for jobID, job := range w.AssignedJobs {
+			sentAt, sent := w.assignedAt[jobID]
+			if !sent || probe.running[jobID] || !sentAt.Before(probe.startedAt) {
+				continue
+			}
+			if w.missing[jobID] {
+				finished = append(finished, job)
+			} else {
+				missing[jobID] = true
+			}
 		}
-		return false // Job is assigned
+		w.missing = missing
+	}
+	w.updateStatus()
+	return finished
+}
+
+// reserve records job as assigned to the worker before it is sent, so the
+// slot and resources are not handed out twice. Callers must hold the
+// coordinator lock.
+func (w *Worker) reserve(job Job) {
+	w.AssignedJobs[job.JobID] = job
+	w.updateStatus()
+}
+
+// markSent records that the worker accepted a reserved job. It returns
+// false if the job finished in the meantime. Callers must hold the
+// coordinator lock.
+func (w *Worker) markSent(jobID string) bool {
+	if _, ok := w.AssignedJobs[jobID]; !ok {
+		return false
 	}
-	log.Printf("Error checking job status for worker %s: %v", w.ID, err)
-	return false
+	w.assignedAt[jobID] = time.Now()
+	return true
 }
 
+// unreserve forgets an assigned job. Callers must hold the coordinator lock.
+func (w *Worker) unreserve(jobID string) {
+	delete(w.AssignedJobs, jobID)
+	delete(w.assignedAt, jobID)
+	delete(w.missing, jobID)
+	w.updateStatus()
+}
+
+// AssignJob sends a job to the worker for execution.
+func (w *Worker) AssignJob(ctx context.Context, job Job) error {
+	reqBody, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Address+"/execute", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.InjectHTTP(ctx, req.Header)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("worker %s rejected job: %s", w.ID, resp.Status)
+	}
+	return nil
+}
+
+// FreeSlots returns the number of additional jobs the worker can take.
+func (w *Worker) FreeSlots() int {
+	return w.Slots - len(w.AssignedJobs)
+}
+
+// Allocated returns the resources requested by the jobs assigned to the worker.
+func (w *Worker) Allocated() Resources {
+	var allocated Resources
+	for _, job := range w.AssignedJobs {
+		allocated = allocated.Add(job.Resources)
+	}
+	return allocated
+}
+
+func (w *Worker) updateStatus() {
+	if w.Status == "inactive" {
+		return
+	}
+	if w.FreeSlots() > 0 {
+		w.Status = "active"
+	} else {
+		w.Status = "busy"
+	}
+}
 
 // func (w *Worker) updateHealth() error {
 // 	resp, err := http.Get(w.Address + "/health")
@@ -165,25 +424,3 @@ func (w *Worker) IsFree() bool {
 // 	}
 // 	return nil
 // }
-
-func (w* Worker) UpdateJobStatus() error {
-	resp, err := http.Get(w.Address + "/job")
-	if err != nil {
-
-	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		// Logic to update the assigned job
-		// For example, parse the response body to get job details
-		var job Job
-		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
-			return err
-		}
-		w.AssignedJob = &job
-	} else {
-		w.AssignedJob = nil
-	}
-	return nil
-}
\ No newline at end of file
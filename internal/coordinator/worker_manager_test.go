@@ -0,0 +1,26 @@
+package coordinator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerRejectedBackoff(t *testing.T) {
+	now := time.Now()
+	w := &Worker{}
+	for i, want := range []time.Duration{
+		500 * time.Millisecond,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	} {
+		if got := w.rejected(now, 5*time.Second); got != want {
+			t.Fatalf("rejection %d: backoff = %s, want %s", i+1, got, want)
+		}
+		if !w.backoffUntil.Equal(now.Add(want)) {
+			t.Fatalf("rejection %d: backoffUntil = %s, want %s", i+1, w.backoffUntil, now.Add(want))
+		}
+	}
+}
@@ -0,0 +1,639 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
+	"execution-service/internal/storage"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// Workflow step states.
+const (
+	StepWaiting   = "waiting"
+	StepPending   = "pending"
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+)
+
+// Workflow states.
+const (
+	WorkflowRunning   = "running"
+	WorkflowSucceeded = "succeeded"
+	WorkflowFailed    = "failed"
+)
+
+// JobResult is what a worker reports when a job finishes.
+type JobResult struct {
+	Status  string            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// Succeeded reports whether the job finished successfully.
+func (r JobResult) Succeeded() bool {
+	return r.Status == "success"
+}
+
+// WorkflowSpec is a workflow submission: a set of jobs and the steps each one depends on.
+type WorkflowSpec struct {
+	ID       string             `json:"id"`
+	TenantID string             `json:"tenant_id"`
+	Steps    []WorkflowStepSpec `json:"steps"`
+}
+
+// WorkflowStepSpec is one job in a workflow. Job has the same format as a
+// regular job submission; job_id and tenant_id are filled in when missing.
+type WorkflowStepSpec struct {
+	Name      string                 `json:"name"`
+	DependsOn []string               `json:"depends_on"`
+	Job       map[string]interface{} `json:"job"`
+}
+
+// WorkflowStep is the state of one step of a running workflow.
+type WorkflowStep struct {
+	Name      string            `json:"name"`
+	JobID     string            `json:"job_id"`
+	DependsOn []string          `json:"depends_on,omitempty"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	Outputs   map[string]string `json:"outputs,omitempty"`
+
+	job Job
+}
+
+// Workflow is a DAG of jobs. A step's job is only queued once every step it
+// depends on has succeeded; when a step fails, everything downstream of it
+// is skipped.
+type Workflow struct {
+	ID         string          `json:"id"`
+	TenantID   string          `json:"tenant_id"`
+	Status     string          `json:"status"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Steps      []*WorkflowStep `json:"steps"`
+
+	spec  WorkflowSpec
+	steps map[string]*WorkflowStep
+}
+
+// ErrWorkflowNotFound is returned for unknown workflow IDs.
+var ErrWorkflowNotFound = errors.New("workflow not found")
+
+// ErrWorkflowExists is returned when a new workflow reuses the ID of an
+// existing one.
+var ErrWorkflowExists = errors.New("workflow already exists")
+
+// errWorkflowStore wraps failures to store a new workflow.
+var errWorkflowStore = errors.New("failed to store workflow")
+
+var envNameInvalid = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// outputEnvName returns the environment variable under which a downstream
+// step receives output name of step.
+func outputEnvName(step, name string) string {
+	return envNameInvalid.ReplaceAllString(strings.ToUpper(step+"_"+name), "_")
+}
+
+// newWorkflow validates spec and builds a workflow with every step waiting.
+func newWorkflow(spec WorkflowSpec) (*Workflow, error) {
+	if spec.ID == "" {
+		return nil, fmt.Errorf("workflow is missing id")
+	}
+	if len(spec.Steps) == 0 {
+		return nil, fmt.Errorf("workflow %s has no steps", spec.ID)
+	}
+	if spec.TenantID == "" {
+		spec.TenantID = defaultTenant
+	}
+
+	wf := &Workflow{
+		ID:        spec.ID,
+		TenantID:  spec.TenantID,
+		Status:    WorkflowRunning,
+		CreatedAt: time.Now(),
+		spec:      spec,
+		steps:     make(map[string]*WorkflowStep, len(spec.Steps)),
+	}
+	for _, stepSpec := range spec.Steps {
+		if stepSpec.Name == "" {
+			return nil, fmt.Errorf("workflow %s has a step without a name", spec.ID)
+		}
+		if _, exists := wf.steps[stepSpec.Name]; exists {
+			return nil, fmt.Errorf("workflow %s has duplicate step %q", spec.ID, stepSpec.Name)
+		}
+
+		jobMap := make(map[string]interface{}, len(stepSpec.Job)+2)
+		for key, value := range stepSpec.Job {
+			jobMap[key] = value
+		}
+		if id, _ := jobMap["job_id"].(string); id == "" {
+			jobMap["job_id"] = spec.ID + "." + stepSpec.Name
+		}
+		if tenant, _ := jobMap["tenant_id"].(string); tenant == "" {
+			jobMap["tenant_id"] = spec.TenantID
+		}
+		data, err := json.Marshal(jobMap)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", stepSpec.Name, err)
+		}
+		job, err := parseJob(data)
+		if err != nil {
+			return nil, fmt.Errorf("step %q: %w", stepSpec.Name, err)
+		}
+
+		step := &WorkflowStep{
+			Name:      stepSpec.Name,
+			JobID:     job.JobID,
+			DependsOn: stepSpec.DependsOn,
+			Status:    StepWaiting,
+			job:       job,
+		}
+		wf.steps[step.Name] = step
+		wf.Steps = append(wf.Steps, step)
+	}
+
+	for _, step := range wf.Steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := wf.steps[dep]; !ok {
+				return nil, fmt.Errorf("step %q depends on unknown step %q", step.Name, dep)
+			}
+		}
+	}
+	if err := wf.checkAcyclic(); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// checkAcyclic verifies the dependency graph has no cycles using Kahn's algorithm.
+func (wf *Workflow) checkAcyclic() error {
+	indegree := make(map[string]int, len(wf.Steps))
+	for _, step := range wf.Steps {
+		indegree[step.Name] = len(step.DependsOn)
+	}
+	ready := make([]string, 0, len(wf.Steps))
+	for name, n := range indegree {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+	visited := 0
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		visited++
+		for _, downstream := range wf.downstream(name) {
+			indegree[downstream.Name]--
+			if indegree[downstream.Name] == 0 {
+				ready = append(ready, downstream.Name)
+			}
+		}
+	}
+	if visited != len(wf.Steps) {
+		var cyclic []string
+		for name, n := range indegree {
+			if n > 0 {
+				cyclic = append(cyclic, name)
+			}
+		}
+		sort.Strings(cyclic)
+		return fmt.Errorf("workflow %s has a dependency cycle involving steps %s", wf.ID, strings.Join(cyclic, ", "))
+	}
+	return nil
+}
+
+// downstream returns the steps that directly depend on name.
+func (wf *Workflow) downstream(name string) []*WorkflowStep {
+	var steps []*WorkflowStep
+	for _, step := range wf.Steps {
+		for _, dep := range step.DependsOn {
+			if dep == name {
+				steps = append(steps, step)
+				break
+			}
+		}
+	}
+	return steps
+}
+
+// releaseReady marks every waiting step whose dependencies have all succeeded
+// as pending and returns their jobs, with upstream outputs added to the
+// job's environment.
+func (wf *Workflow) releaseReady() []Job {
+	var jobs []Job
+	for _, step := range wf.Steps {
+		if step.Status != StepWaiting {
+			continue
+		}
+		ready := true
+		for _, dep := range step.DependsOn {
+			if wf.steps[dep].Status != StepSucceeded {
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			continue
+		}
+		step.Status = StepPending
+		jobs = append(jobs, wf.stepJob(step))
+	}
+	return jobs
+}
+
+// stepJob returns the job of a step that is ready to run, with upstream
+// outputs added to its environment.
+func (wf *Workflow) stepJob(step *WorkflowStep) Job {
+	job := step.job
+	env := make(map[string]string, len(job.Env))
+	for key, value := range job.Env {
+		env[key] = value
+	}
+	for _, dep := range step.DependsOn {
+		for name, value := range wf.steps[dep].Outputs {
+			env[outputEnvName(dep, name)] = value
+		}
+	}
+	job.Env = env
+	if job.Delay > 0 {
+		job.NotBefore = time.Now().Add(job.Delay)
+	}
+	return job
+}
+
+// record returns the workflow as it is stored.
+func (wf *Workflow) record() (models.Workflow, error) {
+	spec, err := json.Marshal(wf.spec)
+	if err != nil {
+		return models.Workflow{}, err
+	}
+	steps := make([]models.WorkflowStep, len(wf.Steps))
+	for i, step := range wf.Steps {
+		steps[i] = models.WorkflowStep{
+			Name:    step.Name,
+			JobID:   step.JobID,
+			Status:  step.Status,
+			Error:   step.Error,
+			Outputs: step.Outputs,
+		}
+	}
+	return models.Workflow{
+		WorkflowID: wf.ID,
+		TenantID:   wf.TenantID,
+		Status:     wf.Status,
+		Spec:       string(spec),
+		Steps:      steps,
+		CreatedAt:  wf.CreatedAt,
+		UpdatedAt:  time.Now(),
+		FinishedAt: wf.FinishedAt,
+	}, nil
+}
+
+// workflowFromRecord rebuilds a stored workflow.
+func workflowFromRecord(record models.Workflow) (*Workflow, error) {
+	var spec WorkflowSpec
+	if err := json.Unmarshal([]byte(record.Spec), &spec); err != nil {
+		return nil, fmt.Errorf("workflow %s: %w", record.WorkflowID, err)
+	}
+	wf, err := newWorkflow(spec)
+	if err != nil {
+		return nil, err
+	}
+	wf.Status = record.Status
+	wf.CreatedAt = record.CreatedAt
+	wf.FinishedAt = record.FinishedAt
+	for _, stored := range record.Steps {
+		if step, ok := wf.steps[stored.Name]; ok {
+			step.Status = stored.Status
+			step.Error = stored.Error
+			step.Outputs = stored.Outputs
+		}
+	}
+	return wf, nil
+}
+
+// skipDownstream marks every step transitively depending on name as skipped.
+func (wf *Workflow) skipDownstream(name string) {
+	for _, step := range wf.downstream(name) {
+		if step.Status == StepWaiting {
+			step.Status = StepSkipped
+			step.Error = fmt.Sprintf("upstream step %q did not succeed", name)
+			wf.skipDownstream(step.Name)
+		}
+	}
+}
+
+// updateStatus finishes the workflow once no step can make progress.
+func (wf *Workflow) updateStatus() {
+	status := WorkflowSucceeded
+	for _, step := range wf.Steps {
+		switch step.Status {
+		case StepWaiting, StepPending:
+			return
+		case StepFailed, StepSkipped:
+			status = WorkflowFailed
+		}
+	}
+	now := time.Now()
+	wf.Status = status
+	wf.FinishedAt = &now
+}
+
+// WorkflowManager tracks running workflows and the jobs that belong to them.
+type WorkflowManager struct {
+	mu sync.Mutex
+	// collection stores every workflow after each change, so running
+	// workflows survive a restart. It is nil without MongoDB, when workflows
+	// only live in memory.
+	collection *mongo.Collection
+	logger     *zap.Logger
+	workflows  map[string]*Workflow
+	jobSteps   map[string]*WorkflowStep
+	jobOwners  map[string]*Workflow
+}
+
+// NewWorkflowManager creates an empty WorkflowManager that stores workflows
+// in collection, which may be nil.
+func NewWorkflowManager(collection *mongo.Collection, logger *zap.Logger) *WorkflowManager {
+	return &WorkflowManager{
+		collection: collection,
+		logger:     logger,
+		workflows:  make(map[string]*Workflow),
+		jobSteps:   make(map[string]*WorkflowStep),
+		jobOwners:  make(map[string]*Workflow),
+	}
+}
+
+// add registers wf. Callers must hold m.mu.
+func (m *WorkflowManager) add(wf *Workflow) {
+	m.workflows[wf.ID] = wf
+	for _, step := range wf.Steps {
+		m.jobSteps[step.JobID] = step
+		m.jobOwners[step.JobID] = wf
+	}
+}
+
+// save stores the current state of wf. A failure is logged: the workflow
+// carries on in memory and is stored again with its next change. Callers
+// must hold m.mu. The write is not tied to a request, as the workflow state
+// must be stored whoever caused the change.
+func (m *WorkflowManager) save(wf *Workflow) {
+	if m.collection == nil {
+		return
+	}
+	record, err := wf.record()
+	if err == nil {
+		err = queries.SaveWorkflow(context.Background(), m.collection, record)
+	}
+	if err != nil {
+		m.logger.Error("Failed to store workflow", zap.String("workflow_id", wf.ID), zap.Error(err))
+	}
+}
+
+// Create registers and stores a workflow and returns the jobs of its root
+// steps. The workflow is rejected if check fails for the job of any step, and
+// with storage.ErrDuplicateJob if a step's job ID belongs to another workflow.
+func (m *WorkflowManager) Create(ctx context.Context, spec WorkflowSpec, check func(Job) error) (*Workflow, []Job, error) {
+	wf, err := newWorkflow(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, step := range wf.Steps {
+		if err := check(step.job); err != nil {
+			return nil, nil, fmt.Errorf("step %q: %w", step.Name, err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.workflows[wf.ID]; exists {
+		return nil, nil, fmt.Errorf("%w: %s", ErrWorkflowExists, wf.ID)
+	}
+	for _, step := range wf.Steps {
+		if _, exists := m.jobSteps[step.JobID]; exists {
+			return nil, nil, fmt.Errorf("step %q: %w: %s belongs to another workflow", step.Name, storage.ErrDuplicateJob, step.JobID)
+		}
+	}
+	jobs := wf.releaseReady()
+	if m.collection != nil {
+		record, err := wf.record()
+		if err == nil {
+			err = queries.InsertWorkflow(ctx, m.collection, record)
+		}
+		if errors.Is(err, queries.ErrDuplicateWorkflow) {
+			return nil, nil, fmt.Errorf("%w: %s", ErrWorkflowExists, wf.ID)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w %s: %v", errWorkflowStore, wf.ID, err)
+		}
+	}
+	m.add(wf)
+	return wf, jobs, nil
+}
+
+// Restore loads the running workflows from storage after a restart and
+// returns the jobs of their pending steps. The coordinator may have stopped
+// before it stored them, or before it recorded that they finished.
+func (m *WorkflowManager) Restore(ctx context.Context) ([]Job, error) {
+	if m.collection == nil {
+		return nil, nil
+	}
+	records, err := queries.FindWorkflows(ctx, m.collection, bson.M{"status": WorkflowRunning})
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []Job
+	for _, record := range records {
+		wf, err := workflowFromRecord(record)
+		if err != nil {
+			m.logger.Error("Failed to rebuild stored workflow", zap.String("workflow_id", record.WorkflowID), zap.Error(err))
+			continue
+		}
+		m.add(wf)
+		for _, step := range wf.Steps {
+			if step.Status == StepPending {
+				jobs = append(jobs, wf.stepJob(step))
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// JobFinished records the result of a workflow job and returns the jobs that
+// became ready as a result. Jobs that are not part of a workflow are ignored.
+func (m *WorkflowManager) JobFinished(jobID string, result JobResult) []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	step, ok := m.jobSteps[jobID]
+	if !ok || step.Status != StepPending {
+		return nil
+	}
+	wf := m.jobOwners[jobID]
+
+	step.Outputs = result.Outputs
+	if result.Succeeded() {
+		step.Status = StepSucceeded
+	} else {
+		step.Status = StepFailed
+		step.Error = result.Error
+		wf.skipDownstream(step.Name)
+	}
+	jobs := wf.releaseReady()
+	wf.updateStatus()
+	m.save(wf)
+	return jobs
+}
+
+// Get returns a snapshot of a workflow. Workflows that finished before the
+// coordinator started are read from storage.
+func (m *WorkflowManager) Get(ctx context.Context, id string) (Workflow, error) {
+	m.mu.Lock()
+	wf, ok := m.workflows[id]
+	if ok {
+		defer m.mu.Unlock()
+		return wf.snapshot(), nil
+	}
+	m.mu.Unlock()
+	if m.collection == nil {
+		return Workflow{}, ErrWorkflowNotFound
+	}
+	record, err := queries.GetWorkflow(ctx, m.collection, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Workflow{}, ErrWorkflowNotFound
+	}
+	if err != nil {
+		return Workflow{}, err
+	}
+	wf, err = workflowFromRecord(record)
+	if err != nil {
+		return Workflow{}, err
+	}
+	return wf.snapshot(), nil
+}
+
+// List returns snapshots of all workflows, newest first, including those in
+// storage that finished before the coordinator started.
+func (m *WorkflowManager) List(ctx context.Context) ([]Workflow, error) {
+	m.mu.Lock()
+	workflows := make([]Workflow, 0, len(m.workflows))
+	for _, wf := range m.workflows {
+		workflows = append(workflows, wf.snapshot())
+	}
+	m.mu.Unlock()
+	if m.collection != nil {
+		records, err := queries.FindWorkflows(ctx, m.collection, bson.M{"status": bson.M{"$ne": WorkflowRunning}})
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			m.mu.Lock()
+			_, loaded := m.workflows[record.WorkflowID]
+			m.mu.Unlock()
+			if loaded {
+				continue
+			}
+			wf, err := workflowFromRecord(record)
+			if err != nil {
+				m.logger.Error("Failed to rebuild stored workflow", zap.String("workflow_id", record.WorkflowID), zap.Error(err))
+				continue
+			}
+			workflows = append(workflows, wf.snapshot())
+		}
+	}
+	sort.Slice(workflows, func(i, j int) bool { return workflows[i].CreatedAt.After(workflows[j].CreatedAt) })
+	return workflows, nil
+}
+
+func (wf *Workflow) snapshot() Workflow {
+	copied := *wf
+	copied.steps = nil
+	copied.Steps = make([]*WorkflowStep, len(wf.Steps))
+	for i, step := range wf.Steps {
+		s := *step
+		copied.Steps[i] = &s
+	}
+	return copied
+}
+
+// submitWorkflowJobs stores the jobs of workflow steps that became ready,
+// like any other submission, and queues them. Jobs that were stored before
+// are left alone: recovery queues them if they are still pending.
+func (c *Coordinator) submitWorkflowJobs(jobs []Job) {
+	for _, job := range jobs {
+		payload, err := json.Marshal(job.envelope())
+		if err != nil {
+			c.jobLogger(job).Error("Failed to encode workflow job", zap.Error(err))
+			continue
+		}
+		err = c.persistJobWithRetry(jobContext(job), job, payload)
+		if isDuplicate(err) {
+			c.jobLogger(job).Info("Workflow job was already stored", zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return // coordinator stopped before the job could be stored
+		}
+		c.Submit(job)
+	}
+}
+
+// resumeWorkflowSteps makes sure the pending steps of restored workflows make
+// progress: steps whose job was never stored are submitted again, and steps
+// whose job finished without the workflow recording it are finished now.
+func (c *Coordinator) resumeWorkflowSteps(ctx context.Context, jobs []Job) error {
+	var submit []Job
+	for _, job := range jobs {
+		stored, err := c.jobs.Get(ctx, job.JobID)
+		if errors.Is(err, storage.ErrNotFound) {
+			submit = append(submit, job)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		switch stored.Status {
+		case models.JobStatusSucceeded, models.JobStatusFailed:
+			result, err := c.storedResult(ctx, stored)
+			if err != nil {
+				return err
+			}
+			submit = append(submit, c.workflows.JobFinished(job.JobID, result)...)
+		}
+	}
+	if len(submit) > 0 {
+		go c.submitWorkflowJobs(submit)
+	}
+	return nil
+}
+
+// storedResult returns the result of a finished job, with the outputs of its
+// last attempt so dependent steps can use them.
+func (c *Coordinator) storedResult(ctx context.Context, stored models.Job) (JobResult, error) {
+	result := JobResult{Status: "success"}
+	if stored.Status == models.JobStatusFailed {
+		result = JobResult{Status: "error", Error: stored.ErrorMessage}
+	}
+	attempts, err := c.jobs.Attempts(ctx, stored.JobID)
+	if err != nil {
+		return JobResult{}, err
+	}
+	if n := len(attempts); n > 0 && attempts[n-1].Status == result.Status {
+		result.Outputs = attempts[n-1].Outputs
+	}
+	return result, nil
+}
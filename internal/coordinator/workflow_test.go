@@ -0,0 +1,251 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/storage"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// testStep returns a workflow step spec with a valid job.
+func testStep(name string, dependsOn ...string) WorkflowStepSpec {
+	return WorkflowStepSpec{
+		Name:      name,
+		DependsOn: dependsOn,
+		Job:       map[string]interface{}{"dockerfile_reference": "https://example.com/" + name + ".Dockerfile"},
+	}
+}
+
+func TestNewWorkflowValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    WorkflowSpec
+		wantErr string
+	}{
+		{
+			name: "diamond",
+			spec: WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{
+				testStep("build"), testStep("test", "build"), testStep("lint", "build"), testStep("publish", "test", "lint"),
+			}},
+		},
+		{
+			name:    "missing id",
+			spec:    WorkflowSpec{Steps: []WorkflowStepSpec{testStep("build")}},
+			wantErr: "missing id",
+		},
+		{
+			name:    "no steps",
+			spec:    WorkflowSpec{ID: "wf"},
+			wantErr: "has no steps",
+		},
+		{
+			name:    "duplicate step",
+			spec:    WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{testStep("build"), testStep("build")}},
+			wantErr: "duplicate step",
+		},
+		{
+			name:    "unknown dependency",
+			spec:    WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{testStep("test", "build")}},
+			wantErr: "unknown step",
+		},
+		{
+			name:    "self dependency",
+			spec:    WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{testStep("build", "build")}},
+			wantErr: "cycle involving steps build",
+		},
+		{
+			name: "two step cycle",
+			spec: WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{
+				testStep("a", "b"), testStep("b", "a"),
+			}},
+			wantErr: "cycle involving steps a, b",
+		},
+		{
+			name: "cycle behind a root",
+			spec: WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{
+				testStep("root"), testStep("a", "root", "c"), testStep("b", "a"), testStep("c", "b"), testStep("leaf", "c"),
+			}},
+			wantErr: "cycle involving steps a, b, c, leaf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wf, err := newWorkflow(tt.spec)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("newWorkflow: %v", err)
+				}
+				if len(wf.Steps) != len(tt.spec.Steps) || wf.TenantID != defaultTenant {
+					t.Fatalf("newWorkflow = %+v, want %d steps of the default tenant", wf, len(tt.spec.Steps))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("newWorkflow error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// runWorkflow creates the diamond workflow build -> test, lint -> publish
+// plus an independent docs step, then finishes steps in order with the
+// given results. It returns the workflow afterwards.
+func runWorkflow(t *testing.T, results []stepResult) Workflow {
+	t.Helper()
+	m := NewWorkflowManager(nil, zap.NewNop())
+	spec := WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{
+		testStep("build"), testStep("test", "build"), testStep("lint", "build"), testStep("publish", "test", "lint"), testStep("docs"),
+	}}
+	_, jobs, err := m.Create(context.Background(), spec, func(Job) error { return nil })
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	released := make(map[string]bool)
+	for _, job := range jobs {
+		released[job.JobID] = true
+	}
+	for _, r := range results {
+		jobID := "wf." + r.step
+		if !released[jobID] {
+			t.Fatalf("step %s finished before it was released", r.step)
+		}
+		for _, job := range m.JobFinished(jobID, r.result) {
+			released[job.JobID] = true
+		}
+	}
+	wf, err := m.Get(context.Background(), "wf")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return wf
+}
+
+type stepResult struct {
+	step   string
+	result JobResult
+}
+
+var (
+	resultSuccess = JobResult{Status: "success"}
+	resultError   = JobResult{Status: "error", Error: "exit status 1"}
+)
+
+func TestWorkflowSkipPropagation(t *testing.T) {
+	tests := []struct {
+		name       string
+		results    []stepResult
+		wantSteps  map[string]string
+		wantStatus string
+	}{
+		{
+			name:       "all succeed",
+			results:    []stepResult{{"build", resultSuccess}, {"docs", resultSuccess}, {"test", resultSuccess}, {"lint", resultSuccess}, {"publish", resultSuccess}},
+			wantSteps:  map[string]string{"build": StepSucceeded, "test": StepSucceeded, "lint": StepSucceeded, "publish": StepSucceeded, "docs": StepSucceeded},
+			wantStatus: WorkflowSucceeded,
+		},
+		{
+			name:       "root failure skips everything downstream",
+			results:    []stepResult{{"build", resultError}},
+			wantSteps:  map[string]string{"build": StepFailed, "test": StepSkipped, "lint": StepSkipped, "publish": StepSkipped, "docs": StepPending},
+			wantStatus: WorkflowRunning,
+		},
+		{
+			name:       "independent steps still finish the workflow",
+			results:    []stepResult{{"build", resultError}, {"docs", resultSuccess}},
+			wantSteps:  map[string]string{"build": StepFailed, "test": StepSkipped, "lint": StepSkipped, "publish": StepSkipped, "docs": StepSucceeded},
+			wantStatus: WorkflowFailed,
+		},
+		{
+			name:       "sibling keeps running after a failure",
+			results:    []stepResult{{"build", resultSuccess}, {"lint", resultError}},
+			wantSteps:  map[string]string{"build": StepSucceeded, "test": StepPending, "lint": StepFailed, "publish": StepSkipped, "docs": StepPending},
+			wantStatus: WorkflowRunning,
+		},
+		{
+			name:       "failed once every step finished",
+			results:    []stepResult{{"build", resultSuccess}, {"lint", resultError}, {"test", resultSuccess}, {"docs", resultSuccess}},
+			wantSteps:  map[string]string{"build": StepSucceeded, "test": StepSucceeded, "lint": StepFailed, "publish": StepSkipped, "docs": StepSucceeded},
+			wantStatus: WorkflowFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wf := runWorkflow(t, tt.results)
+			for _, s := range wf.Steps {
+				if s.Status != tt.wantSteps[s.Name] {
+					t.Errorf("step %s is %s, want %s", s.Name, s.Status, tt.wantSteps[s.Name])
+				}
+				if s.Status == StepSkipped && s.Error == "" {
+					t.Errorf("skipped step %s has no reason", s.Name)
+				}
+			}
+			if wf.Status != tt.wantStatus {
+				t.Errorf("workflow is %s, want %s", wf.Status, tt.wantStatus)
+			}
+			if (wf.FinishedAt != nil) != (tt.wantStatus != WorkflowRunning) {
+				t.Errorf("FinishedAt = %v with status %s", wf.FinishedAt, wf.Status)
+			}
+		})
+	}
+}
+
+func TestWorkflowOutputsPassedDownstream(t *testing.T) {
+	m := NewWorkflowManager(nil, zap.NewNop())
+	spec := WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{testStep("build"), testStep("test", "build")}}
+	if _, _, err := m.Create(context.Background(), spec, func(Job) error { return nil }); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	jobs := m.JobFinished("wf.build", JobResult{Status: "success", Outputs: map[string]string{"image-tag": "v1"}})
+	if len(jobs) != 1 || jobs[0].JobID != "wf.test" {
+		t.Fatalf("JobFinished released %+v, want wf.test", jobs)
+	}
+	if got := jobs[0].Env["BUILD_IMAGE_TAG"]; got != "v1" {
+		t.Fatalf("BUILD_IMAGE_TAG = %q, want v1 (env %v)", got, jobs[0].Env)
+	}
+	if again := m.JobFinished("wf.build", resultSuccess); again != nil {
+		t.Fatalf("a second result for a finished step released %+v", again)
+	}
+}
+
+func TestWorkflowManagerCreateConflicts(t *testing.T) {
+	m := NewWorkflowManager(nil, zap.NewNop())
+	accept := func(Job) error { return nil }
+	spec := WorkflowSpec{ID: "wf", Steps: []WorkflowStepSpec{testStep("build")}}
+	if _, _, err := m.Create(context.Background(), spec, accept); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		spec  WorkflowSpec
+		check func(Job) error
+		want  error
+	}{
+		{"same id", spec, accept, ErrWorkflowExists},
+		{
+			name: "step job of another workflow",
+			spec: WorkflowSpec{ID: "other", Steps: []WorkflowStepSpec{{
+				Name: "build",
+				Job:  map[string]interface{}{"job_id": "wf.build", "dockerfile_reference": "https://example.com/Dockerfile"},
+			}}},
+			check: accept,
+			want:  storage.ErrDuplicateJob,
+		},
+		{
+			name:  "rejected by check",
+			spec:  WorkflowSpec{ID: "checked", Steps: []WorkflowStepSpec{testStep("build")}},
+			check: func(Job) error { return storage.ErrDuplicateJob },
+			want:  storage.ErrDuplicateJob,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := m.Create(context.Background(), tt.spec, tt.check); !errors.Is(err, tt.want) {
+				t.Fatalf("Create error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -2,63 +2,49 @@ package database
 
 import (
 	"context"
+	"execution-service/internal/metrics"
 	"fmt"
-	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
 )
 
-var MongoClient *mongo.Client
-
 // ConnectMongoDB initializes a connection to MongoDB
-func ConnectMongoDB(uri string) error {
-    // Create a context with a longer timeout for the connection
-    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-    defer cancel()
-
-    log.Printf("MongoDB connection string: %s", uri)
-
-    // Connect to MongoDB
-    client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
-    if (err != nil) {
-        log.Printf("Error connecting to MongoDB: %v", err)
-        return fmt.Errorf("failed to connect to MongoDB: %w", err)
-    }
-
-    // Create a separate context for the Ping operation
-    pingCtx, pingCancel := context.WithTimeout(context.Background(), 10*time.Second)
-    defer pingCancel()
+func ConnectMongoDB(uri string) (*mongo.Client, error) {
+	// Create a context with a longer timeout for the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Connect to MongoDB
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(metrics.MongoMonitor()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
 
-    // Verify the connection
-    err = client.Ping(pingCtx, nil)
-    if (err != nil) {
-        log.Printf("Error pinging MongoDB: %v", err)
-        return fmt.Errorf("failed to ping MongoDB: %w", err)
-    }
+	// Create a separate context for the Ping operation
+	pingCtx, pingCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer pingCancel()
 
-    MongoClient = client
-    return nil
-}
+	// Verify the connection
+	err = client.Ping(pingCtx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping MongoDB: %w", err)
+	}
 
-// GetCollection returns a MongoDB collection
-func GetCollection(databaseName, collectionName string) *mongo.Collection {
-    if MongoClient == nil {
-        panic("MongoClient is not initialized. Call ConnectMongoDB first.")
-    }
-    return MongoClient.Database(databaseName).Collection(collectionName)
+	return client, nil
 }
 
 // DisconnectMongoDB closes the MongoDB connection
-func DisconnectMongoDB() {
-	if MongoClient != nil {
+func DisconnectMongoDB(client *mongo.Client, logger *zap.Logger) {
+	if client != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		if err := MongoClient.Disconnect(ctx); err != nil {
-			log.Printf("Error disconnecting MongoDB: %v\n", err)
+		if err := client.Disconnect(ctx); err != nil {
+			logger.Error("Failed to disconnect from MongoDB", zap.Error(err))
 		} else {
-			log.Println("Disconnected from MongoDB!")
+			logger.Info("Disconnected from MongoDB")
 		}
 	}
-}
\ No newline at end of file
+}
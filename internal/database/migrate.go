@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// migrationLockLease is how long a node may hold the migration lock without
+// renewing it. The lock is renewed before every migration, so a single
+// migration must finish within the lease.
+const migrationLockLease = 5 * time.Minute
+
+// Migration is a one-off change to stored data, such as backfilling a new
+// field. Migrations are applied once, in version order, and recorded in the
+// migrations collection. Up should be safe to run again in case a node dies
+// before the migration is recorded.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// Index is an index that is created on every startup if it is missing. With
+// Drop set, the index named Model.Options.Name is removed instead, e.g. when
+// a TTL is turned off.
+type Index struct {
+	Collection string
+	Model      mongo.IndexModel
+	Drop       bool
+}
+
+// Migrator brings a database up to date: it applies pending migrations and
+// then creates indexes. Nodes starting at the same time take turns through a
+// lock document, so each migration runs once.
+type Migrator struct {
+	db         *mongo.Database
+	collection *mongo.Collection
+	migrations []Migration
+	indexes    []Index
+	owner      string
+	logger     *zap.Logger
+}
+
+// NewMigrator creates a migrator that records applied migrations in the
+// collection of db named collection.
+func NewMigrator(db *mongo.Database, collection string, migrations []Migration, indexes []Index, logger *zap.Logger) *Migrator {
+	hostname, _ := os.Hostname()
+	return &Migrator{
+		db:         db,
+		collection: db.Collection(collection),
+		migrations: migrations,
+		indexes:    indexes,
+		owner:      fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), primitive.NewObjectID().Hex()),
+		logger:     logger,
+	}
+}
+
+// Migrate applies pending migrations and creates indexes, waiting for the
+// lock if another node is migrating.
+func (m *Migrator) Migrate(ctx context.Context) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if err := queries.ReleaseMigrationLock(context.Background(), m.collection, m.owner); err != nil {
+			m.logger.Warn("Failed to release migration lock", zap.Error(err))
+		}
+	}()
+
+	applied, err := m.Applied(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read applied migrations: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, migration := range applied {
+		done[migration.Version] = true
+	}
+
+	migrations := slices.Clone(m.migrations)
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for _, migration := range migrations {
+		if done[migration.Version] {
+			continue
+		}
+		if err := m.lock(ctx); err != nil {
+			return err
+		}
+		m.logger.Info("Applying migration", zap.Int("version", migration.Version), zap.String("description", migration.Description))
+		start := time.Now()
+		if err := migration.Up(ctx, m.db); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+		err := queries.RecordMigration(ctx, m.collection, models.AppliedMigration{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now(),
+			Duration:    time.Since(start).String(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+		}
+		m.logger.Info("Applied migration", zap.Int("version", migration.Version), zap.Duration("duration", time.Since(start)))
+	}
+
+	for _, index := range m.indexes {
+		if err := m.ensureIndex(ctx, index); err != nil {
+			return fmt.Errorf("failed to update indexes of %s: %w", index.Collection, err)
+		}
+	}
+	return nil
+}
+
+// Applied returns the migrations recorded as applied, in version order.
+func (m *Migrator) Applied(ctx context.Context) ([]models.AppliedMigration, error) {
+	return queries.FindAppliedMigrations(ctx, m.collection)
+}
+
+func (m *Migrator) ensureIndex(ctx context.Context, index Index) error {
+	collection := m.db.Collection(index.Collection)
+	if index.Drop {
+		return queries.DropIndexIfExists(ctx, collection, *index.Model.Options.Name)
+	}
+	return queries.EnsureIndex(ctx, collection, index.Model)
+}
+
+// lock takes or renews the migration lock, polling while another node
+// holds it.
+func (m *Migrator) lock(ctx context.Context) error {
+	for waiting := false; ; waiting = true {
+		ok, err := queries.AcquireMigrationLock(ctx, m.collection, m.owner, migrationLockLease)
+		if err != nil {
+			return fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		if ok {
+			return nil
+		}
+		if !waiting {
+			m.logger.Info("Waiting for another node to finish migrating")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"context"
+	"execution-service/internal/queries"
+	"execution-service/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// JobStorageMigrator returns the migrator for the job storage collections
+// named by cfg. New migrations are appended with the next version; released
+// migrations must not be changed.
+func JobStorageMigrator(db *mongo.Database, cfg storage.MongoConfig, logger *zap.Logger) *Migrator {
+	return NewMigrator(db, cfg.MigrationsCollection, jobStorageMigrations(cfg), jobStorageIndexes(cfg), logger)
+}
+
+func jobStorageMigrations(cfg storage.MongoConfig) []Migration {
+	return []Migration{
+		{
+			Version:     1,
+			Description: "backfill job version",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				return backfill(ctx, db.Collection(cfg.JobsCollection), "version", int64(1))
+			},
+		},
+		{
+			Version:     2,
+			Description: "backfill job tenant_id",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				// Jobs stored before tenants existed belong to the default tenant.
+				return backfill(ctx, db.Collection(cfg.JobsCollection), "tenant_id", "default")
+			},
+		},
+		{
+			Version:     3,
+			Description: "drop completed_retention TTL indexes",
+			Up: func(ctx context.Context, db *mongo.Database) error {
+				// They would remove attempts and output before the retention
+				// sweeper archives them.
+				if err := queries.DropIndexIfExists(ctx, db.Collection(cfg.ExecutionsCollection), "execution_completion_time_ttl"); err != nil {
+					return err
+				}
+				return queries.DropIndexIfExists(ctx, db.Collection(cfg.LogsCollection), "created_at_ttl")
+			},
+		},
+	}
+}
+
+func jobStorageIndexes(cfg storage.MongoConfig) []Index {
+	indexes := []Index{
+		{
+			// Makes storing a redelivered job fail instead of duplicating it.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "job_id", Value: 1}},
+				Options: options.Index().SetName("job_id_1").SetUnique(true),
+			},
+		},
+		{
+			// List order, and created_at ranges.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "created_at", Value: 1}, {Key: "job_id", Value: 1}},
+				Options: options.Index().SetName("created_at_1_job_id_1"),
+			},
+		},
+		{
+			// Jobs by status, e.g. pending jobs on startup.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}},
+				Options: options.Index().SetName("status_1_created_at_1"),
+			},
+		},
+		{
+			// Finished jobs by age, for the retention sweeper.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}},
+				Options: options.Index().SetName("status_1_updated_at_1"),
+			},
+		},
+		{
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "status", Value: 1}},
+				Options: options.Index().SetName("tenant_id_1_status_1"),
+			},
+		},
+		{
+			// Sorting by update time.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "updated_at", Value: 1}, {Key: "job_id", Value: 1}},
+				Options: options.Index().SetName("updated_at_1_job_id_1"),
+			},
+		},
+		{
+			// Jobs that ran on a worker.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "worker_id", Value: 1}, {Key: "created_at", Value: 1}},
+				Options: options.Index().SetName("worker_id_1_created_at_1"),
+			},
+		},
+		{
+			// Jobs of a Dockerfile.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "dockerfile_reference", Value: 1}, {Key: "created_at", Value: 1}},
+				Options: options.Index().SetName("dockerfile_reference_1_created_at_1"),
+			},
+		},
+		{
+			// Label filters, whatever the label keys are.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "labels.$**", Value: 1}},
+				Options: options.Index().SetName("labels_wildcard"),
+			},
+		},
+		{
+			// Free-text search of error messages. Filtering on error text
+			// needs this index.
+			Collection: cfg.JobsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "error_message", Value: "text"}},
+				Options: options.Index().SetName("error_message_text"),
+			},
+		},
+		{
+			Collection: cfg.ExecutionsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "job_id", Value: 1}, {Key: "execution_completion_time", Value: 1}},
+				Options: options.Index().SetName("job_id_1_execution_completion_time_1"),
+			},
+		},
+		{
+			Collection: cfg.LogsCollection,
+			Model: mongo.IndexModel{
+				Keys:    bson.D{{Key: "job_id", Value: 1}, {Key: "created_at", Value: 1}, {Key: "seq", Value: 1}},
+				Options: options.Index().SetName("job_id_1_created_at_1_seq_1"),
+			},
+		},
+	}
+	return append(indexes,
+		ttlIndex(cfg.ExecutionsCollection, "execution_completion_time", cfg),
+		ttlIndex(cfg.LogsCollection, "created_at", cfg),
+	)
+}
+
+// ttlIndex removes documents of collection cfg.CompletedRetention after the
+// time in field. With no retention the index is dropped. Migration 3 dropped
+// these indexes unconditionally; they are managed here instead, after the
+// migrations, so an explicit completed_retention still applies. The
+// coordinator refuses a retention that would expire documents before the
+// retention sweeper archives them.
+func ttlIndex(collection, field string, cfg storage.MongoConfig) Index {
+	name := field + "_ttl"
+	return Index{
+		Collection: collection,
+		Model: mongo.IndexModel{
+			Keys:    bson.D{{Key: field, Value: 1}},
+			Options: options.Index().SetName(name).SetExpireAfterSeconds(int32(cfg.CompletedRetention.Seconds())),
+		},
+		Drop: cfg.CompletedRetention <= 0,
+	}
+}
+
+func backfill(ctx context.Context, collection *mongo.Collection, field string, value interface{}) error {
+	_, err := queries.BackfillField(ctx, collection, field, value)
+	return err
+}
@@ -0,0 +1,266 @@
+// Package jobstream fans out changes to stored jobs to in-process
+// subscribers. A Watcher follows a MongoDB change stream on the jobs
+// collection and keeps a window of recent changes, so subscribers that
+// reconnect with the token of the last change they saw continue where they
+// left off.
+package jobstream
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/storage"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrSlowSubscriber ends a subscription whose buffer filled up. The
+// subscriber can resubscribe after the last change it received.
+var ErrSlowSubscriber = errors.New("subscriber fell behind")
+
+// Filter selects the jobs a subscription receives changes for. Zero fields
+// match every job.
+type Filter struct {
+	JobID    string
+	TenantID string
+}
+
+func (f Filter) matches(change storage.JobChange) bool {
+	return (f.JobID == "" || f.JobID == change.Job.JobID) &&
+		(f.TenantID == "" || f.TenantID == change.Job.TenantID)
+}
+
+// Subscription receives the changes matching its filter, in order, until it
+// is closed or ends with an error.
+type Subscription struct {
+	changes chan storage.JobChange
+	filter  Filter
+	cancel  context.CancelFunc // stops the change stream of a catch-up subscription
+
+	mu     sync.Mutex
+	closed bool
+	err    error
+}
+
+// Changes returns the channel changes are delivered on. It is closed when
+// the subscription ends.
+func (s *Subscription) Changes() <-chan storage.JobChange {
+	return s.changes
+}
+
+// Err returns why the subscription ended, once Changes is closed.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// end closes the subscription with err, unless it already ended.
+func (s *Subscription) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.changes)
+}
+
+// Watcher follows the change stream of the jobs collection and publishes
+// every change to the matching subscriptions. It keeps the last historySize
+// changes to replay to resubscribing clients; older tokens are resumed
+// directly from MongoDB.
+type Watcher struct {
+	jobs        *storage.MongoJobRepository
+	historySize int
+	bufferSize  int
+	logger      *zap.Logger
+
+	mu      sync.Mutex
+	history []storage.JobChange
+	subs    map[*Subscription]bool
+}
+
+// NewWatcher creates a watcher on the jobs collection of jobs. Subscriptions
+// that fall more than bufferSize changes behind are ended.
+func NewWatcher(jobs *storage.MongoJobRepository, historySize, bufferSize int, logger *zap.Logger) *Watcher {
+	return &Watcher{
+		jobs:        jobs,
+		historySize: historySize,
+		bufferSize:  bufferSize,
+		logger:      logger,
+		subs:        make(map[*Subscription]bool),
+	}
+}
+
+// Run follows the change stream until ctx is done, reopening it after the
+// last change it saw when it fails. If MongoDB no longer has the changes
+// since then, every subscription is ended with storage.ErrChangeHistoryLost
+// and the history is dropped, so no subscriber silently misses changes.
+func (w *Watcher) Run(ctx context.Context) {
+	last := ""
+	for ctx.Err() == nil {
+		stream, err := w.jobs.Watch(ctx, "", "", last)
+		if errors.Is(err, storage.ErrChangeHistoryLost) {
+			w.logger.Warn("Lost changes since the last one seen, starting over", zap.Error(err))
+			w.reset(err)
+			last = ""
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				w.logger.Error("Failed to open change stream", zap.Error(err))
+				sleep(ctx, time.Second)
+			}
+			continue
+		}
+		for {
+			change, err := stream.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					w.logger.Error("Change stream failed", zap.Error(err))
+				}
+				break
+			}
+			last = change.Token
+			w.publish(change)
+		}
+		stream.Close(context.Background())
+	}
+	w.reset(ctx.Err())
+}
+
+// Subscribe subscribes to the changes matching filter. With an after token,
+// the subscription starts with the change following it; otherwise it starts
+// with the next change. A token that is no longer in the history is resumed
+// from MongoDB, which fails with storage.ErrChangeHistoryLost if the token
+// is too old. The subscription ends when ctx is done.
+func (w *Watcher) Subscribe(ctx context.Context, filter Filter, after string) (*Subscription, error) {
+	w.mu.Lock()
+	replay, ok := w.since(after)
+	if ok {
+		sub := &Subscription{
+			changes: make(chan storage.JobChange, w.bufferSize+len(replay)),
+			filter:  filter,
+		}
+		for _, change := range replay {
+			if filter.matches(change) {
+				sub.changes <- change
+			}
+		}
+		w.subs[sub] = true
+		w.mu.Unlock()
+		go func() {
+			<-ctx.Done()
+			w.Unsubscribe(sub)
+		}()
+		return sub, nil
+	}
+	w.mu.Unlock()
+	return w.catchUp(ctx, filter, after)
+}
+
+// Unsubscribe ends sub.
+func (w *Watcher) Unsubscribe(sub *Subscription) {
+	if sub.cancel != nil {
+		// The catch-up goroutine is the sender and ends the subscription.
+		sub.cancel()
+		return
+	}
+	w.mu.Lock()
+	delete(w.subs, sub)
+	w.mu.Unlock()
+	sub.end(nil)
+}
+
+// since returns the changes in the history after the one with token after.
+// Callers must hold w.mu.
+func (w *Watcher) since(after string) ([]storage.JobChange, bool) {
+	if after == "" {
+		return nil, true
+	}
+	for i := len(w.history) - 1; i >= 0; i-- {
+		if w.history[i].Token == after {
+			return w.history[i+1:], true
+		}
+	}
+	return nil, false
+}
+
+// catchUp serves a subscription from its own change stream, for tokens that
+// are older than the history or were seen by another coordinator.
+func (w *Watcher) catchUp(ctx context.Context, filter Filter, after string) (*Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := w.jobs.Watch(ctx, filter.JobID, filter.TenantID, after)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	sub := &Subscription{
+		changes: make(chan storage.JobChange, w.bufferSize),
+		filter:  filter,
+		cancel:  cancel,
+	}
+	go func() {
+		defer stream.Close(context.Background())
+		for {
+			change, err := stream.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					err = nil
+				}
+				sub.end(err)
+				return
+			}
+			select {
+			case sub.changes <- change:
+			case <-ctx.Done():
+				sub.end(nil)
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// publish adds change to the history and hands it to every matching
+// subscription, ending the ones whose buffer is full.
+func (w *Watcher) publish(change storage.JobChange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history = append(w.history, change)
+	if len(w.history) > w.historySize {
+		w.history = w.history[len(w.history)-w.historySize:]
+	}
+	for sub := range w.subs {
+		if !sub.filter.matches(change) {
+			continue
+		}
+		select {
+		case sub.changes <- change:
+		default:
+			delete(w.subs, sub)
+			sub.end(ErrSlowSubscriber)
+		}
+	}
+}
+
+// reset drops the history and ends every subscription with err.
+func (w *Watcher) reset(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.history = nil
+	for sub := range w.subs {
+		delete(w.subs, sub)
+		sub.end(err)
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,82 @@
+// Package logging builds the zap logger shared by coordinators and workers
+// and the fields that identify a job on its log lines.
+package logging
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New builds a logger from the logging config section: level (debug, info,
+// warn or error), format (json or console) and output (stdout, stderr or a
+// file path). Output of the standard library logger is redirected to it.
+func New(config *viper.Viper) (*zap.Logger, error) {
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	if name := config.GetString("logging.level"); name != "" {
+		parsed, err := zap.ParseAtomicLevel(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid logging.level: %w", err)
+		}
+		level = parsed
+	}
+
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.Level = level
+	zapConfig.Sampling = nil
+	zapConfig.DisableStacktrace = true
+	zapConfig.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	switch format := config.GetString("logging.format"); format {
+	case "", "json":
+	case "console":
+		zapConfig.Encoding = "console"
+		zapConfig.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	default:
+		return nil, fmt.Errorf("unknown logging.format %q", format)
+	}
+	if output := config.GetString("logging.output"); output != "" {
+		zapConfig.OutputPaths = []string{output}
+	}
+
+	logger, err := zapConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+	zap.RedirectStdLog(logger)
+	return logger, nil
+}
+
+// JobID returns the job_id field.
+func JobID(jobID string) zap.Field {
+	return zap.String("job_id", jobID)
+}
+
+// WorkerID returns the worker_id field.
+func WorkerID(workerID string) zap.Field {
+	return zap.String("worker_id", workerID)
+}
+
+// Attempt returns the attempt field: how often the coordinator has sent the
+// job to a worker, starting at 1.
+func Attempt(attempt int) zap.Field {
+	return zap.Int("attempt", attempt)
+}
+
+// TraceID returns the trace_id field of the trace in ctx, or a field that is
+// left out if ctx carries no trace.
+func TraceID(ctx context.Context) zap.Field {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return zap.Skip()
+	}
+	return zap.String("trace_id", spanContext.TraceID().String())
+}
+
+// ForJob returns logger with the job_id of jobID and the trace_id of ctx.
+func ForJob(logger *zap.Logger, ctx context.Context, jobID string) *zap.Logger {
+	return logger.With(JobID(jobID), TraceID(ctx))
+}
@@ -0,0 +1,146 @@
+// Package metrics defines the Prometheus metrics of coordinators and workers
+// and serves them on /metrics. Metrics of both node types share label names:
+// tenant_id, worker_id, status (a job status), reason, phase, outcome
+// ("success" or "error"), intake, method, route, code and command.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Outcomes of operations, for the outcome label.
+const (
+	OutcomeSuccess = "success"
+	OutcomeError   = "error"
+)
+
+var (
+	JobsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "execution_jobs_accepted_total",
+		Help: "Jobs accepted by the coordinator.",
+	}, []string{"tenant_id"})
+
+	JobStatusChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "execution_job_status_changes_total",
+		Help: "Job status changes recorded by the coordinator, by new status.",
+	}, []string{"status"})
+
+	JobRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "execution_job_retries_total",
+		Help: "Jobs queued again: rejected by their worker, or recovered after a restart.",
+	}, []string{"reason"})
+
+	QueueWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "execution_queue_wait_seconds",
+		Help:    "Time jobs waited in the queue until they were dispatched, after any delay.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10), // 10ms to ~44m
+	}, []string{"tenant_id"})
+
+	DispatchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "execution_dispatch_duration_seconds",
+		Help:    "Time to hand a job to a worker.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"worker_id", "outcome"})
+
+	JobPhaseDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "execution_job_phase_duration_seconds",
+		Help:    "Duration of the phases of running a job on a worker: fetch, build and run.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 3, 10), // 100ms to ~33m
+	}, []string{"phase", "outcome"})
+
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "execution_http_requests_total",
+		Help: "HTTP requests served, by route pattern.",
+	}, []string{"method", "route", "code"})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "execution_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests, by route pattern. Streaming responses count until the stream ends.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	MongoCommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "execution_mongo_command_duration_seconds",
+		Help:    "Time MongoDB commands took, by command name.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14), // 0.5ms to ~4s
+	}, []string{"command", "outcome"})
+)
+
+// Handler serves the metrics of the process.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Register registers a collector of node state, such as queue depths that
+// are read when the metrics are scraped.
+func Register(collector prometheus.Collector) error {
+	return prometheus.Register(collector)
+}
+
+// InstrumentHandler counts and times the requests served by next, labelled
+// with the pattern of the ServeMux route they matched.
+func InstrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: wr, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		// The method is a label of its own.
+		route := req.Pattern
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPRequests.WithLabelValues(req.Method, route, strconv.Itoa(recorder.status)).Inc()
+		HTTPRequestDuration.WithLabelValues(req.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusRecorder remembers the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming responses working through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// MongoMonitor returns a command monitor that records the duration of every
+// MongoDB command.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			MongoCommandDuration.WithLabelValues(e.CommandName, OutcomeSuccess).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			MongoCommandDuration.WithLabelValues(e.CommandName, OutcomeError).Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// Outcome returns the outcome label for err.
+func Outcome(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
@@ -1,26 +1,170 @@
 package models
 
 import (
-    "time"
+	"time"
 
-    "go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // ScheduledJob represents the schema for a scheduled job
 type ScheduledJob struct {
-    ID                 primitive.ObjectID `bson:"_id,omitempty"`            // MongoDB ObjectID
-    JobID              string             `bson:"job_id"`                  // Unique Job ID
-    DockerfileReference string            `bson:"dockerfile_reference"`    // Reference to the Dockerfile
-    ScheduledTime      time.Time          `bson:"scheduled_time"`          // Time when the job is scheduled
-    CronExpression     string             `bson:"cronexpression"`          // Cron expression for recurring jobs
+	ID                  primitive.ObjectID `bson:"_id,omitempty"`        // MongoDB ObjectID
+	JobID               string             `bson:"job_id"`               // Unique Job ID
+	DockerfileReference string             `bson:"dockerfile_reference"` // Reference to the Dockerfile
+	ScheduledTime       time.Time          `bson:"scheduled_time"`       // Time when the job is scheduled
+	CronExpression      string             `bson:"cronexpression"`       // Cron expression for recurring jobs
 }
 
+// ExecutedJob is one attempt at running a job on a worker.
 type ExecutedJob struct {
-    ID                 primitive.ObjectID `bson:"_id,omitempty"`            // MongoDB ObjectID
-    JobID              string             `bson:"job_id"`                  // Unique Job ID
-    DockerfileReference string            `bson:"dockerfile_reference"`    // Reference to the Dockerfile
-    ScheduledTime      time.Time          `bson:"scheduled_time"`          // Time when the job is scheduled
-    ExecutionCompletionTime time.Time `bson:"execution_completion_time"` // Time when the job execution is completed
-    Status             string             `bson:"status"`                  // Status of the job (e.g., "completed", "failed")
-    ErrorMessage       string             `bson:"error_message"`           // Error message if the job failed
-}
\ No newline at end of file
+	ID                      primitive.ObjectID `bson:"_id,omitempty" json:"-"`                                     // MongoDB ObjectID
+	JobID                   string             `bson:"job_id" json:"job_id"`                                       // Unique Job ID
+	WorkerID                string             `bson:"worker_id,omitempty" json:"worker_id,omitempty"`             // Worker that ran the attempt
+	StartedAt               time.Time          `bson:"started_at,omitempty" json:"started_at,omitempty"`           // Time when the worker started the job
+	DockerfileReference     string             `bson:"dockerfile_reference" json:"dockerfile_reference"`           // Reference to the Dockerfile
+	ScheduledTime           time.Time          `bson:"scheduled_time" json:"scheduled_time"`                       // Time when the job is scheduled
+	ExecutionCompletionTime time.Time          `bson:"execution_completion_time" json:"execution_completion_time"` // Time when the job execution is completed
+	Status                  string             `bson:"status" json:"status"`                                       // Status of the job (e.g., "completed", "failed")
+	ErrorMessage            string             `bson:"error_message" json:"error_message"`                         // Error message if the job failed
+	Outputs                 map[string]string  `bson:"outputs,omitempty" json:"outputs,omitempty"`                 // Outputs the job set on stdout
+}
+
+// LogChunk is a piece of a job's build or run output. Chunks of a job are
+// ordered by CreatedAt, then Seq.
+type LogChunk struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"` // MongoDB ObjectID
+	JobID     string             `bson:"job_id" json:"job_id"`   // Job that produced the output
+	WorkerID  string             `bson:"worker_id,omitempty" json:"worker_id,omitempty"`
+	Seq       int                `bson:"seq" json:"seq"`       // Position of the chunk in the attempt's output
+	Stream    string             `bson:"stream" json:"stream"` // "stdout" or "stderr"
+	Data      string             `bson:"data" json:"data"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Job statuses tracked by the coordinator.
+const (
+	JobStatusPending   = "pending"
+	JobStatusAssigned  = "assigned"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// Job is a job accepted by the coordinator. Payload keeps the original
+// submission so the job can be rebuilt after a restart.
+type Job struct {
+	ID                  primitive.ObjectID `bson:"_id,omitempty" json:"-"`                                 // MongoDB ObjectID
+	JobID               string             `bson:"job_id" json:"job_id"`                                   // Unique Job ID
+	TenantID            string             `bson:"tenant_id" json:"tenant_id"`                             // Tenant that owns the job
+	DockerfileReference string             `bson:"dockerfile_reference" json:"dockerfile_reference"`       // Reference to the Dockerfile
+	Status              string             `bson:"status" json:"status"`                                   // One of the JobStatus constants
+	WorkerID            string             `bson:"worker_id,omitempty" json:"worker_id,omitempty"`         // Worker the job was assigned to
+	ErrorMessage        string             `bson:"error_message,omitempty" json:"error_message,omitempty"` // Error message if the job failed
+	Payload             string             `bson:"payload" json:"payload"`                                 // Original job submission
+	Labels              map[string]string  `bson:"labels,omitempty" json:"labels,omitempty"`               // Metadata of the job message, for searching
+	NotBefore           *time.Time         `bson:"not_before,omitempty" json:"not_before,omitempty"`       // Job is not dispatched before this time
+	Version             int64              `bson:"version" json:"version"`                                 // Incremented on every state change, for optimistic concurrency
+	CreatedAt           time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt           time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// IdempotencyKey maps a producer-supplied idempotency key to the job it created.
+// Keys are unique per tenant and expire after the configured retention window.
+type IdempotencyKey struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"` // MongoDB ObjectID
+	TenantID  string             `bson:"tenant_id"`     // Tenant that submitted the job
+	Key       string             `bson:"key"`           // Idempotency key supplied by the producer
+	JobID     string             `bson:"job_id"`        // Job created by the first submission
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"` // Removed by a TTL index after this time
+}
+
+// JobEvent is a job state transition. Events are written to the outbox in the
+// same transaction as the status change and published to Kafka afterwards.
+type JobEvent struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"-"`                         // MongoDB ObjectID, orders the outbox
+	EventID        string             `bson:"event_id" json:"event_id"`                       // Unique event ID for consumer-side deduplication
+	JobID          string             `bson:"job_id" json:"job_id"`                           // Job that changed state
+	TenantID       string             `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"` // Tenant that owns the job
+	Status         string             `bson:"status" json:"status"`                           // New status, one of the JobStatus constants
+	PreviousStatus string             `bson:"previous_status,omitempty" json:"previous_status,omitempty"`
+	WorkerID       string             `bson:"worker_id,omitempty" json:"worker_id,omitempty"`         // Worker the job was assigned to
+	ErrorMessage   string             `bson:"error_message,omitempty" json:"error_message,omitempty"` // Error message if the job failed
+	OccurredAt     time.Time          `bson:"occurred_at" json:"occurred_at"`
+	PublishedAt    *time.Time         `bson:"published_at,omitempty" json:"-"`  // Set once published; a TTL index removes published events
+	TraceContext   map[string]string  `bson:"trace_context,omitempty" json:"-"` // Trace of the status change, sent in the Kafka message headers
+}
+
+// Webhook delivery statuses.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is a job event sent to a job's callback URL, with every
+// attempt made to deliver it.
+type WebhookDelivery struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"-"`         // MongoDB ObjectID
+	DeliveryID    string             `bson:"delivery_id" json:"delivery_id"` // Sent in the X-Webhook-Delivery header
+	JobID         string             `bson:"job_id" json:"job_id"`
+	URL           string             `bson:"url" json:"url"`
+	Event         JobEvent           `bson:"event" json:"event"`   // Payload of the webhook
+	Status        string             `bson:"status" json:"status"` // One of the WebhookDelivery constants
+	Attempts      []WebhookAttempt   `bson:"attempts" json:"attempts"`
+	NextAttemptAt *time.Time         `bson:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// WebhookAttempt is one HTTP request made for a WebhookDelivery.
+type WebhookAttempt struct {
+	Time       time.Time     `bson:"time" json:"time"`
+	StatusCode int           `bson:"status_code,omitempty" json:"status_code,omitempty"` // Zero if no response was received
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	Duration   time.Duration `bson:"duration" json:"duration"`
+}
+
+// QueueMessage is a job message in the MongoDB intake queue. A message is
+// invisible to other consumers while leased; if the lease expires before the
+// message is acknowledged, it is delivered again.
+type QueueMessage struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`      // MongoDB ObjectID, orders the queue
+	Value      []byte             `bson:"value"`              // Job message
+	Headers    map[string]string  `bson:"headers,omitempty"`  // e.g. Idempotency-Key
+	VisibleAt  time.Time          `bson:"visible_at"`         // Earliest time the message can be leased
+	LeaseID    string             `bson:"lease_id,omitempty"` // Set by the consumer holding the lease
+	Deliveries int                `bson:"deliveries"`         // Number of times the message was leased
+	EnqueuedAt time.Time          `bson:"enqueued_at"`
+}
+
+// AppliedMigration records a schema migration that has been applied to the
+// database.
+type AppliedMigration struct {
+	Version     int       `bson:"_id"`         // Migration version, applied in ascending order
+	Description string    `bson:"description"` // What the migration does
+	AppliedAt   time.Time `bson:"applied_at"`
+	Duration    string    `bson:"duration"` // How long the migration took
+}
+
+// Workflow is the stored state of a workflow: the submitted spec, from which
+// the steps' jobs are rebuilt, and the progress of every step.
+type Workflow struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	WorkflowID string             `bson:"workflow_id"`
+	TenantID   string             `bson:"tenant_id"`
+	Status     string             `bson:"status"` // running, succeeded or failed
+	Spec       string             `bson:"spec"`   // Submitted workflow, as JSON
+	Steps      []WorkflowStep     `bson:"steps"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at"`
+	FinishedAt *time.Time         `bson:"finished_at,omitempty"`
+}
+
+// WorkflowStep is the progress of one step of a stored Workflow.
+type WorkflowStep struct {
+	Name    string            `bson:"name"`
+	JobID   string            `bson:"job_id"`
+	Status  string            `bson:"status"`
+	Error   string            `bson:"error,omitempty"`
+	Outputs map[string]string `bson:"outputs,omitempty"`
+}
@@ -2,53 +2,578 @@ package queries
 
 import (
 	"context"
+	"errors"
 	"execution-service/internal/models"
-	"log"
+	"execution-service/internal/tracing"
+	"fmt"
+	"time"
 
-	// "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	// "go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func AddEntry(collection *mongo.Collection, entry models.ExecutedJob) error {
+func AddEntry(ctx context.Context, collection *mongo.Collection, entry models.ExecutedJob) error {
 	// Insert the entry into the collection
-	result, err := collection.InsertOne(context.TODO(),entry)
+	_, err := collection.InsertOne(ctx, entry)
+	return err
+}
+
+// ErrDuplicateJob is returned by InsertJob when a job with the same job_id exists.
+var ErrDuplicateJob = errors.New("job already exists")
+
+// InsertJob stores a newly accepted job at version 1. It returns
+// ErrDuplicateJob if the job was already stored, e.g. because a Kafka message
+// was redelivered. When outbox is not nil, a pending JobEvent is written in
+// the same transaction.
+func InsertJob(ctx context.Context, collection, outbox *mongo.Collection, job models.Job) error {
+	now := time.Now()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	job.Version = 1
+	err := withOutbox(ctx, collection, outbox, func(ctx context.Context) error {
+		if _, err := collection.InsertOne(ctx, job); err != nil {
+			return err
+		}
+		return insertEvent(ctx, outbox, models.JobEvent{
+			JobID:      job.JobID,
+			TenantID:   job.TenantID,
+			Status:     job.Status,
+			OccurredAt: now,
+		})
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateJob
+	}
+	return err
+}
+
+// GetJob returns the job with the given job_id.
+func GetJob(ctx context.Context, collection *mongo.Collection, jobID string) (models.Job, error) {
+	var job models.Job
+	err := collection.FindOne(ctx, bson.M{"job_id": jobID}).Decode(&job)
+	return job, err
+}
+
+// FindJobs returns up to limit jobs matching filter in the given order. A
+// limit of 0 returns all of them.
+func FindJobs(ctx context.Context, collection *mongo.Collection, filter bson.M, sort bson.D, limit int64) ([]models.Job, error) {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(sort).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []models.Job{}
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// UpdateJobState sets a job's status if it is still at expectedVersion and
+// increments its version. Jobs stored before versions were introduced count
+// as version 0. It returns the updated job, or mongo.ErrNoDocuments if no job
+// with that ID and version exists. When outbox
+// is not nil and the status actually changed, a JobEvent is written in the
+// same transaction.
+func UpdateJobState(ctx context.Context, collection, outbox *mongo.Collection, jobID string, expectedVersion int64, newStatus, workerID, errorMessage string) (models.Job, error) {
+	filter := bson.M{"job_id": jobID, "version": expectedVersion}
+	if expectedVersion == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"status":     newStatus,
+		"updated_at": now,
+		"version":    expectedVersion + 1,
+	}
+	if workerID != "" {
+		set["worker_id"] = workerID
+	}
+	if errorMessage != "" {
+		set["error_message"] = errorMessage
+	}
+
+	// Read the previous version of the job to tell whether the status changed
+	var previous models.Job
+	err := withOutbox(ctx, collection, outbox, func(ctx context.Context) error {
+		err := collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set},
+			options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&previous)
+		if err != nil || previous.Status == newStatus {
+			return err
+		}
+		return insertEvent(ctx, outbox, models.JobEvent{
+			JobID:          jobID,
+			TenantID:       previous.TenantID,
+			Status:         newStatus,
+			PreviousStatus: previous.Status,
+			WorkerID:       workerID,
+			ErrorMessage:   errorMessage,
+			OccurredAt:     now,
+		})
+	})
+	if err != nil {
+		return models.Job{}, err
+	}
+
+	updated := previous
+	updated.Status = newStatus
+	updated.UpdatedAt = now
+	updated.Version = expectedVersion + 1
+	if workerID != "" {
+		updated.WorkerID = workerID
+	}
+	if errorMessage != "" {
+		updated.ErrorMessage = errorMessage
+	}
+	return updated, nil
+}
+
+// FindExecutions returns the recorded attempts of a job, oldest first.
+func FindExecutions(ctx context.Context, collection *mongo.Collection, jobID string) ([]models.ExecutedJob, error) {
+	cursor, err := collection.Find(ctx, bson.M{"job_id": jobID},
+		options.Find().SetSort(bson.D{{Key: "execution_completion_time", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	executions := []models.ExecutedJob{}
+	if err := cursor.All(ctx, &executions); err != nil {
+		return nil, err
+	}
+	return executions, nil
+}
+
+// InsertLogChunk stores a piece of a job's output.
+func InsertLogChunk(ctx context.Context, collection *mongo.Collection, chunk models.LogChunk) error {
+	_, err := collection.InsertOne(ctx, chunk)
+	return err
+}
+
+// FindLogChunks returns a job's output chunks in the order they were written.
+func FindLogChunks(ctx context.Context, collection *mongo.Collection, jobID string) ([]models.LogChunk, error) {
+	cursor, err := collection.Find(ctx, bson.M{"job_id": jobID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	chunks := []models.LogChunk{}
+	if err := cursor.All(ctx, &chunks); err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
+
+// DeleteJob removes a job and reports whether it existed.
+func DeleteJob(ctx context.Context, collection *mongo.Collection, jobID string) (bool, error) {
+	result, err := collection.DeleteOne(ctx, bson.M{"job_id": jobID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// DeleteByJobID removes every document of a job, such as its attempts, log
+// chunks or webhook deliveries.
+func DeleteByJobID(ctx context.Context, collection *mongo.Collection, jobID string) error {
+	_, err := collection.DeleteMany(ctx, bson.M{"job_id": jobID})
+	return err
+}
+
+// withOutbox runs fn in a transaction when outbox is set, so the job change
+// and its event commit together. Transactions need MongoDB to run as a
+// replica set. Without an outbox fn runs on its own.
+func withOutbox(ctx context.Context, collection, outbox *mongo.Collection, fn func(ctx context.Context) error) error {
+	if outbox == nil {
+		return fn(ctx)
+	}
+	session, err := collection.Database().Client().StartSession()
 	if err != nil {
-		log.Printf("Error adding entry: %v", err)
 		return err
 	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// insertEvent adds event to the outbox with the trace context of ctx. It does
+// nothing when outbox is nil.
+func insertEvent(ctx context.Context, outbox *mongo.Collection, event models.JobEvent) error {
+	if outbox == nil {
+		return nil
+	}
+	event.ID = primitive.NewObjectID()
+	event.EventID = event.ID.Hex()
+	if trace := tracing.Inject(ctx); len(trace) > 0 {
+		event.TraceContext = trace
+	}
+	_, err := outbox.InsertOne(ctx, event)
+	return err
+}
 
-	log.Printf("Added entry with ID: %v", result.InsertedID)
+// IsReplicaSet reports whether db is served by a replica set member, which
+// transactions and change streams need.
+func IsReplicaSet(ctx context.Context, db *mongo.Database) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+	}
+	if err := db.RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+	return hello.SetName != "", nil
+}
+
+// EnsureOutboxIndexes creates the TTL index that removes events retention
+// after they were published. Unpublished events are never removed.
+func EnsureOutboxIndexes(ctx context.Context, outbox *mongo.Collection, retention time.Duration) error {
+	_, err := outbox.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "published_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds())),
+	})
+	return err
+}
+
+// FindUnpublishedEvents returns up to limit unpublished events in the order
+// they were written.
+func FindUnpublishedEvents(ctx context.Context, outbox *mongo.Collection, limit int64) ([]models.JobEvent, error) {
+	cursor, err := outbox.Find(ctx, bson.M{"published_at": bson.M{"$exists": false}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	var events []models.JobEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// MarkEventPublished records that an outbox event was published.
+func MarkEventPublished(ctx context.Context, outbox *mongo.Collection, id primitive.ObjectID) error {
+	_, err := outbox.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"published_at": time.Now()}})
+	return err
+}
+
+// EnsureIdempotencyIndexes creates the unique (tenant_id, key) index and the
+// TTL index that removes expired idempotency keys.
+func EnsureIdempotencyIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant_id", Value: 1}, {Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// ClaimIdempotencyKey records that key was used by tenantID to create jobID.
+// If the key is already held by an unexpired record, that record is returned
+// and nothing is written; otherwise the returned record is nil.
+func ClaimIdempotencyKey(ctx context.Context, collection *mongo.Collection, tenantID, key, jobID string, retention time.Duration) (*models.IdempotencyKey, error) {
+	now := time.Now()
+	filter := bson.M{"tenant_id": tenantID, "key": key}
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := collection.InsertOne(ctx, models.IdempotencyKey{
+			TenantID:  tenantID,
+			Key:       key,
+			JobID:     jobID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(retention),
+		})
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		var existing models.IdempotencyKey
+		if err := collection.FindOne(ctx, filter).Decode(&existing); err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				continue // removed in the meantime, try again
+			}
+			return nil, err
+		}
+		if existing.ExpiresAt.After(now) {
+			return &existing, nil
+		}
+		// Expired but not yet removed by the TTL monitor.
+		if _, err := collection.DeleteOne(ctx, bson.M{"_id": existing.ID}); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed to claim idempotency key %q", key)
+}
+
+// ReleaseIdempotencyKey removes a claimed key whose job could not be stored.
+func ReleaseIdempotencyKey(ctx context.Context, collection *mongo.Collection, tenantID, key, jobID string) error {
+	_, err := collection.DeleteOne(ctx, bson.M{"tenant_id": tenantID, "key": key, "job_id": jobID})
+	return err
+}
+
+// EnsureWebhookIndexes creates the indexes used to look up webhook deliveries.
+func EnsureWebhookIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "delivery_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "job_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	})
+	return err
+}
+
+// SaveWebhookDelivery inserts or replaces a webhook delivery record.
+func SaveWebhookDelivery(ctx context.Context, collection *mongo.Collection, delivery models.WebhookDelivery) error {
+	delivery.ID = primitive.NilObjectID
+	_, err := collection.ReplaceOne(ctx, bson.M{"delivery_id": delivery.DeliveryID}, delivery,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetWebhookDelivery returns the webhook delivery with the given delivery_id.
+func GetWebhookDelivery(ctx context.Context, collection *mongo.Collection, deliveryID string) (models.WebhookDelivery, error) {
+	var delivery models.WebhookDelivery
+	err := collection.FindOne(ctx, bson.M{"delivery_id": deliveryID}).Decode(&delivery)
+	return delivery, err
+}
+
+// FindWebhookDeliveries returns the webhook deliveries matching filter, oldest first.
+func FindWebhookDeliveries(ctx context.Context, collection *mongo.Collection, filter bson.M) ([]models.WebhookDelivery, error) {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []models.WebhookDelivery
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// EnsureWorkflowIndexes creates the unique workflow_id index and the index
+// used to find running workflows.
+func EnsureWorkflowIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "workflow_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+	})
+	return err
+}
+
+// ErrDuplicateWorkflow is returned by InsertWorkflow when a workflow with the
+// same workflow_id exists.
+var ErrDuplicateWorkflow = errors.New("workflow already exists")
+
+// InsertWorkflow stores a newly created workflow.
+func InsertWorkflow(ctx context.Context, collection *mongo.Collection, workflow models.Workflow) error {
+	_, err := collection.InsertOne(ctx, workflow)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateWorkflow
+	}
+	return err
+}
+
+// SaveWorkflow replaces the stored state of a workflow.
+func SaveWorkflow(ctx context.Context, collection *mongo.Collection, workflow models.Workflow) error {
+	workflow.ID = primitive.NilObjectID
+	_, err := collection.ReplaceOne(ctx, bson.M{"workflow_id": workflow.WorkflowID}, workflow,
+		options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetWorkflow returns the workflow with the given workflow_id.
+func GetWorkflow(ctx context.Context, collection *mongo.Collection, workflowID string) (models.Workflow, error) {
+	var workflow models.Workflow
+	err := collection.FindOne(ctx, bson.M{"workflow_id": workflowID}).Decode(&workflow)
+	return workflow, err
+}
+
+// FindWorkflows returns the workflows matching filter, newest first.
+func FindWorkflows(ctx context.Context, collection *mongo.Collection, filter bson.M) ([]models.Workflow, error) {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	var workflows []models.Workflow
+	if err := cursor.All(ctx, &workflows); err != nil {
+		return nil, err
+	}
+	return workflows, nil
+}
+
+// EnsureQueueIndexes creates the index used to lease the next visible message.
+func EnsureQueueIndexes(ctx context.Context, collection *mongo.Collection) error {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "visible_at", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	return err
+}
+
+// EnqueueMessage adds a message to the queue, visible from visibleAt.
+func EnqueueMessage(ctx context.Context, collection *mongo.Collection, value []byte, headers map[string]string, visibleAt time.Time) error {
+	_, err := collection.InsertOne(ctx, models.QueueMessage{
+		Value:      value,
+		Headers:    headers,
+		VisibleAt:  visibleAt,
+		EnqueuedAt: time.Now(),
+	})
+	return err
+}
+
+// LeaseMessage leases the oldest visible message for visibilityTimeout. It
+// returns mongo.ErrNoDocuments when no message is visible.
+func LeaseMessage(ctx context.Context, collection *mongo.Collection, visibilityTimeout time.Duration) (models.QueueMessage, error) {
+	now := time.Now()
+	var message models.QueueMessage
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"visible_at": bson.M{"$lte": now}},
+		bson.M{
+			"$set": bson.M{"visible_at": now.Add(visibilityTimeout), "lease_id": primitive.NewObjectID().Hex()},
+			"$inc": bson.M{"deliveries": 1},
+		},
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "visible_at", Value: 1}, {Key: "_id", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&message)
+	return message, err
+}
+
+// CountVisibleMessages returns the number of messages that are waiting to be
+// leased.
+func CountVisibleMessages(ctx context.Context, collection *mongo.Collection) (int64, error) {
+	return collection.CountDocuments(ctx, bson.M{"visible_at": bson.M{"$lte": time.Now()}})
+}
+
+// DeleteMessage removes a leased message. It does nothing if the lease was
+// lost, since another consumer may be handling the message by now.
+func DeleteMessage(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, leaseID string) (bool, error) {
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id, "lease_id": leaseID})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
+
+// indexOptionsConflict is the server error code for an index that exists
+// with the same keys but different options.
+const indexOptionsConflict = 85
+
+// EnsureIndex creates index if it does not exist. If it exists as a TTL index
+// with a different expireAfterSeconds, the expiry is changed in place, since
+// MongoDB cannot recreate an index with the same keys.
+func EnsureIndex(ctx context.Context, collection *mongo.Collection, index mongo.IndexModel) error {
+	_, err := collection.Indexes().CreateOne(ctx, index)
+	var serverErr mongo.CommandError
+	if !errors.As(err, &serverErr) || serverErr.Code != indexOptionsConflict ||
+		index.Options == nil || index.Options.Name == nil || index.Options.ExpireAfterSeconds == nil {
+		return err
+	}
+	return collection.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection.Name()},
+		{Key: "index", Value: bson.M{"name": *index.Options.Name, "expireAfterSeconds": *index.Options.ExpireAfterSeconds}},
+	}).Err()
+}
+
+// DropIndexIfExists drops the index called name, if there is one.
+func DropIndexIfExists(ctx context.Context, collection *mongo.Collection, name string) error {
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Name == name {
+			_, err := collection.Indexes().DropOne(ctx, name)
+			return err
+		}
+	}
 	return nil
 }
 
-// // UpdateJobStatus updates the status of a job in the database
-// func UpdateJobStatus(collection *mongo.Collection, jobID string, newStatus string) error {
-// 	// Create a filter to find the job by job_id
-// 	filter := bson.M{"job_id": jobID}
+// migrationLockID is the _id of the lock document in the migrations
+// collection.
+const migrationLockID = "lock"
 
-// 	// Define the update to set the new status
-// 	update := bson.M{
-// 		"$set": bson.M{
-// 			"job_status": newStatus,
-// 		},
-// 	}
+// AcquireMigrationLock takes or extends the lock that lets one node at a
+// time apply migrations. It reports false if another owner holds an
+// unexpired lock.
+func AcquireMigrationLock(ctx context.Context, collection *mongo.Collection, owner string, lease time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"_id": migrationLockID, "$or": bson.A{
+			bson.M{"owner": owner},
+			bson.M{"locked_until": bson.M{"$lt": now}},
+		}},
+		bson.M{"$set": bson.M{"owner": owner, "locked_until": now.Add(lease)}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The lock exists and belongs to someone else.
+		return false, nil
+	}
+	return err == nil, err
+}
 
-// 	// Perform the update operation
-// 	result, err := collection.UpdateOne(context.TODO(), filter, update, options.Update())
-// 	if err != nil {
-// 		log.Printf("Error updating job status for job_id %s: %v", jobID, err)
-// 		return err
-// 	}
+// ReleaseMigrationLock releases the lock if owner still holds it.
+func ReleaseMigrationLock(ctx context.Context, collection *mongo.Collection, owner string) error {
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner})
+	return err
+}
 
-// 	// Log the result
-// 	if result.MatchedCount == 0 {
-// 		log.Printf("No job found with job_id %s", jobID)
-// 	} else {
-// 		log.Printf("Updated job status for job_id %s to %s", jobID, newStatus)
-// 	}
+// FindAppliedMigrations returns the applied migrations in version order.
+func FindAppliedMigrations(ctx context.Context, collection *mongo.Collection) ([]models.AppliedMigration, error) {
+	cursor, err := collection.Find(ctx, bson.M{"applied_at": bson.M{"$exists": true}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	applied := []models.AppliedMigration{}
+	if err := cursor.All(ctx, &applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
 
-// 	return nil
-// }
+// RecordMigration marks a migration as applied.
+func RecordMigration(ctx context.Context, collection *mongo.Collection, migration models.AppliedMigration) error {
+	_, err := collection.InsertOne(ctx, migration)
+	return err
+}
 
+// BackfillField sets field to value on every document where it is missing or
+// null, and returns the number of documents changed.
+func BackfillField(ctx context.Context, collection *mongo.Collection, field string, value interface{}) (int64, error) {
+	result, err := collection.UpdateMany(ctx, bson.M{field: nil}, bson.M{"$set": bson.M{field: value}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
 
+// WatchJobs opens a change stream on the jobs collection that reports job
+// inserts, updates and replacements with the full job document. Changes are
+// limited to jobID and tenantID unless they are empty. The stream starts
+// after resumeAfter, or now if it is nil.
+func WatchJobs(ctx context.Context, collection *mongo.Collection, jobID, tenantID string, resumeAfter bson.Raw) (*mongo.ChangeStream, error) {
+	match := bson.D{{Key: "operationType", Value: bson.M{"$in": bson.A{"insert", "update", "replace"}}}}
+	if jobID != "" {
+		match = append(match, bson.E{Key: "fullDocument.job_id", Value: jobID})
+	}
+	if tenantID != "" {
+		match = append(match, bson.E{Key: "fullDocument.tenant_id", Value: tenantID})
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeAfter != nil {
+		opts.SetStartAfter(resumeAfter)
+	}
+	return collection.Watch(ctx, mongo.Pipeline{{{Key: "$match", Value: match}}}, opts)
+}
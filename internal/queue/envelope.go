@@ -0,0 +1,216 @@
+package queue
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// CurrentSchemaVersion is the job envelope version written by this service.
+// Messages without a schema_version are the legacy v0 format, a bare job
+// spec, and are upgraded when decoded.
+const CurrentSchemaVersion = 1
+
+const schemaBaseURL = "https://execution-service/schemas/"
+
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// envelopeSchemas holds the compiled schema of every supported envelope version.
+var envelopeSchemas = compileEnvelopeSchemas()
+
+// JobEnvelope is the versioned format of job messages.
+type JobEnvelope struct {
+	SchemaVersion int               `json:"schema_version"`
+	Job           JobSpec           `json:"job"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	TraceContext  map[string]string `json:"trace_context,omitempty"`
+}
+
+// JobSpec describes the job to run.
+type JobSpec struct {
+	JobID               string `json:"job_id"`
+	DockerfileReference string `json:"dockerfile_reference"`
+	TenantID            string `json:"tenant_id,omitempty"`
+	JobType             string `json:"job_type,omitempty"`
+	// NotBefore is an RFC 3339 time before which the job is not dispatched.
+	NotBefore string `json:"not_before,omitempty"`
+	// Delay is a Go duration, e.g. "90s", after which the job is dispatched.
+	Delay          string            `json:"delay,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	NodeSelector   map[string]string `json:"node_selector,omitempty"`
+	Affinity       []AffinityTerm    `json:"affinity,omitempty"`
+	AntiAffinity   []AffinityTerm    `json:"anti_affinity,omitempty"`
+	Resources      Resources         `json:"resources,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	Callback       *Callback         `json:"callback,omitempty"`
+}
+
+// AffinityTerm is a worker label match in a job spec.
+type AffinityTerm struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+	Weight   int      `json:"weight,omitempty"`
+}
+
+// Resources is the CPU and memory a job requests.
+type Resources struct {
+	CPU      float64 `json:"cpu,omitempty"`
+	MemoryMB int     `json:"memory_mb,omitempty"`
+}
+
+// Callback asks for a webhook to be POSTed to URL when the job changes to one
+// of the statuses in Events.
+type Callback struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events,omitempty"`
+}
+
+// legacyJob is the job spec plus user_id, which was used as the tenant before
+// tenant_id existed. It is the v0 message format, and user_id is still
+// accepted in the job of later versions.
+type legacyJob struct {
+	JobSpec
+	UserID string `json:"user_id"`
+}
+
+// spec returns the job spec, with user_id as the tenant if tenant_id is not set.
+func (j legacyJob) spec() JobSpec {
+	if j.TenantID == "" {
+		j.TenantID = j.UserID
+	}
+	return j.JobSpec
+}
+
+// InvalidMessageError is returned for job messages that cannot be decoded.
+// Reasons lists every problem found, each prefixed with the location in the
+// message it applies to.
+type InvalidMessageError struct {
+	SchemaVersion int
+	Reasons       []string
+}
+
+func (e *InvalidMessageError) Error() string {
+	return fmt.Sprintf("invalid v%d job message: %s", e.SchemaVersion, strings.Join(e.Reasons, "; "))
+}
+
+func compileEnvelopeSchemas() map[int]*jsonschema.Schema {
+	compiler := jsonschema.NewCompiler()
+	entries, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		data, err := schemaFiles.ReadFile("schemas/" + entry.Name())
+		if err != nil {
+			panic(err)
+		}
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+		if err != nil {
+			panic(fmt.Sprintf("schema %s: %v", entry.Name(), err))
+		}
+		if err := compiler.AddResource(schemaBaseURL+entry.Name(), doc); err != nil {
+			panic(fmt.Sprintf("schema %s: %v", entry.Name(), err))
+		}
+	}
+
+	schemas := make(map[int]*jsonschema.Schema)
+	for version := 0; version <= CurrentSchemaVersion; version++ {
+		schema, err := compiler.Compile(fmt.Sprintf("%sjob-envelope-v%d.json", schemaBaseURL, version))
+		if err != nil {
+			panic(err)
+		}
+		schemas[version] = schema
+	}
+	return schemas
+}
+
+// NewJobEnvelope wraps spec in an envelope of the current version.
+func NewJobEnvelope(spec JobSpec) JobEnvelope {
+	return JobEnvelope{SchemaVersion: CurrentSchemaVersion, Job: spec}
+}
+
+// DecodeJobEnvelope validates a job message against the schema of its version
+// and decodes it. Legacy v0 messages are upgraded to the current version.
+func DecodeJobEnvelope(data []byte) (*JobEnvelope, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, &InvalidMessageError{Reasons: []string{"malformed JSON: " + err.Error()}}
+	}
+
+	version := 0
+	if obj, ok := doc.(map[string]any); ok {
+		if raw, ok := obj["schema_version"]; ok {
+			n, ok := raw.(json.Number)
+			v, err := n.Int64()
+			if !ok || err != nil {
+				return nil, &InvalidMessageError{Reasons: []string{"/schema_version: must be an integer"}}
+			}
+			version = int(v)
+		}
+	}
+	schema, ok := envelopeSchemas[version]
+	if !ok {
+		return nil, &InvalidMessageError{
+			SchemaVersion: version,
+			Reasons:       []string{fmt.Sprintf("/schema_version: unsupported version %d, expected 0 to %d", version, CurrentSchemaVersion)},
+		}
+	}
+	if err := schema.Validate(doc); err != nil {
+		return nil, &InvalidMessageError{SchemaVersion: version, Reasons: validationReasons(err)}
+	}
+
+	if version == 0 {
+		var legacy legacyJob
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, &InvalidMessageError{Reasons: []string{err.Error()}}
+		}
+		envelope := NewJobEnvelope(legacy.spec())
+		return &envelope, nil
+	}
+
+	// The outer Job field shadows the envelope's, so user_id is decoded too.
+	var decoded struct {
+		JobEnvelope
+		Job legacyJob `json:"job"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, &InvalidMessageError{SchemaVersion: version, Reasons: []string{err.Error()}}
+	}
+	envelope := decoded.JobEnvelope
+	envelope.Job = decoded.Job.spec()
+	return &envelope, nil
+}
+
+var messagePrinter = message.NewPrinter(language.English)
+
+// validationReasons flattens a schema validation error into one reason per
+// failing leaf, formatted as "<instance location>: <message>".
+func validationReasons(err error) []string {
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var reasons []string
+	var walk func(*jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			reasons = append(reasons, "/"+strings.Join(e.InstanceLocation, "/")+": "+e.ErrorKind.LocalizedString(messagePrinter))
+			return
+		}
+		for _, cause := range e.Causes {
+			walk(cause)
+		}
+	}
+	walk(verr)
+	sort.Strings(reasons)
+	return reasons
+}
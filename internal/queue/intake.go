@@ -0,0 +1,206 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrLeaseLost is returned by Ack when a message's lease expired before it
+// was acknowledged. The message will be delivered again.
+var ErrLeaseLost = errors.New("message lease expired")
+
+// Message is a job message received from an Intake.
+type Message struct {
+	Value   []byte
+	Headers map[string]string
+	// Source describes where the message came from, for logging.
+	Source string
+	// Time is when the message was produced, if the backend knows it.
+	Time time.Time
+
+	handle any // backend-specific, used by Ack
+}
+
+// Intake is where the coordinator receives job messages from. Delivery is
+// at-least-once: a message is delivered again unless it is acknowledged,
+// so consumers must only Ack once the job is durably stored.
+type Intake interface {
+	// Receive blocks until a message is available or ctx is done.
+	Receive(ctx context.Context) (Message, error)
+	// Ack marks a received message as handled.
+	Ack(ctx context.Context, msg Message) error
+	// Publish adds a job message to the intake.
+	Publish(ctx context.Context, value []byte, headers map[string]string) error
+	Close() error
+}
+
+// LagReporter is implemented by intakes that can tell how many messages are
+// waiting to be received.
+type LagReporter interface {
+	Lag(ctx context.Context) (int64, error)
+}
+
+// KafkaIntake receives job messages from the client's topic, committing
+// offsets on Ack.
+type KafkaIntake struct {
+	client *KafkaClient
+}
+
+// NewKafkaIntake creates an Intake on client. The client stays owned by the
+// caller, so Close does not close it.
+func NewKafkaIntake(client *KafkaClient) *KafkaIntake {
+	return &KafkaIntake{client: client}
+}
+
+func (k *KafkaIntake) Receive(ctx context.Context) (Message, error) {
+	message, err := k.client.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	headers := make(map[string]string, len(message.Headers))
+	for _, header := range message.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	return Message{
+		Value:   message.Value,
+		Headers: headers,
+		Source:  fmt.Sprintf("%s/%d offset %d", message.Topic, message.Partition, message.Offset),
+		Time:    message.Time,
+		handle:  message,
+	}, nil
+}
+
+func (k *KafkaIntake) Ack(ctx context.Context, msg Message) error {
+	return k.client.CommitMessage(ctx, msg.handle.(kafka.Message))
+}
+
+func (k *KafkaIntake) Publish(ctx context.Context, value []byte, headers map[string]string) error {
+	return k.client.writeMessage(ctx, "", "", value, headers)
+}
+
+func (k *KafkaIntake) Lag(ctx context.Context) (int64, error) {
+	return k.client.Lag(), nil
+}
+
+func (k *KafkaIntake) Close() error {
+	return nil
+}
+
+// MongoIntake is a durable queue in a MongoDB collection. Received messages
+// are leased for the visibility timeout and redelivered if they are not
+// acknowledged in time, e.g. because the consumer crashed.
+type MongoIntake struct {
+	collection        *mongo.Collection
+	visibilityTimeout time.Duration
+	pollInterval      time.Duration
+}
+
+// NewMongoIntake creates an Intake on collection. Receive checks for new
+// messages every pollInterval while the queue is empty.
+func NewMongoIntake(collection *mongo.Collection, visibilityTimeout, pollInterval time.Duration) (*MongoIntake, error) {
+	if err := queries.EnsureQueueIndexes(context.Background(), collection); err != nil {
+		return nil, err
+	}
+	return &MongoIntake{
+		collection:        collection,
+		visibilityTimeout: visibilityTimeout,
+		pollInterval:      pollInterval,
+	}, nil
+}
+
+func (m *MongoIntake) Receive(ctx context.Context) (Message, error) {
+	for {
+		message, err := queries.LeaseMessage(ctx, m.collection, m.visibilityTimeout)
+		if err == nil {
+			return Message{
+				Value:   message.Value,
+				Headers: message.Headers,
+				Source:  fmt.Sprintf("%s %s delivery %d", m.collection.Name(), message.ID.Hex(), message.Deliveries),
+				Time:    message.EnqueuedAt,
+				handle:  message,
+			}, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return Message{}, err
+		}
+		select {
+		case <-time.After(m.pollInterval):
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+func (m *MongoIntake) Ack(ctx context.Context, msg Message) error {
+	message := msg.handle.(models.QueueMessage)
+	deleted, err := queries.DeleteMessage(ctx, m.collection, message.ID, message.LeaseID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *MongoIntake) Publish(ctx context.Context, value []byte, headers map[string]string) error {
+	return queries.EnqueueMessage(ctx, m.collection, value, headers, time.Now())
+}
+
+func (m *MongoIntake) Lag(ctx context.Context) (int64, error) {
+	return queries.CountVisibleMessages(ctx, m.collection)
+}
+
+func (m *MongoIntake) Close() error {
+	return nil
+}
+
+// MemoryIntake keeps job messages in an InMemoryQueue. Unacknowledged
+// messages are redelivered after the visibility timeout, but everything is
+// lost on restart, so it is only meant for tests and local development.
+type MemoryIntake struct {
+	queue *InMemoryQueue
+}
+
+// NewMemoryIntake creates an empty in-memory Intake.
+func NewMemoryIntake(visibilityTimeout time.Duration) *MemoryIntake {
+	return &MemoryIntake{queue: NewInMemoryQueue(visibilityTimeout)}
+}
+
+func (m *MemoryIntake) Receive(ctx context.Context) (Message, error) {
+	lease, err := m.queue.Dequeue(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	message := lease.Job.Payload.(Message)
+	message.Source = fmt.Sprintf("memory delivery %d", lease.Deliveries)
+	message.handle = lease.ID
+	return message, nil
+}
+
+func (m *MemoryIntake) Ack(ctx context.Context, msg Message) error {
+	if err := m.queue.Ack(ctx, msg.handle.(string)); err != nil {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *MemoryIntake) Publish(ctx context.Context, value []byte, headers map[string]string) error {
+	return m.queue.Enqueue(ctx, Job{Payload: Message{Value: value, Headers: headers, Time: time.Now()}})
+}
+
+func (m *MemoryIntake) Lag(ctx context.Context) (int64, error) {
+	n, err := m.queue.Len(ctx)
+	return int64(n), err
+}
+
+func (m *MemoryIntake) Close() error {
+	return nil
+}
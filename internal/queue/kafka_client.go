@@ -3,80 +3,170 @@ package queue
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"execution-service/internal/tracing"
+	"fmt"
+	"maps"
+	"time"
 
 	"github.com/segmentio/kafka-go"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
 )
 
 type KafkaClient struct {
 	writer *kafka.Writer
 	reader *kafka.Reader
 	topic  string
+	logger *zap.Logger
 }
 
-func NewKafkaClient(brokers []string, topic string) *KafkaClient {
-	log.Printf("Connecting to Kafka broker at %s", &brokers)
-	writer := kafka.NewWriter(kafka.WriterConfig{
-		Brokers: brokers,
-		Topic:   topic,
+// NewKafkaClient connects to topic on brokers with the default settings.
+func NewKafkaClient(brokers []string, topic string, logger *zap.Logger) (*KafkaClient, error) {
+	return NewKafkaClientWithConfig(KafkaConfig{Brokers: brokers, Topic: topic}, logger)
+}
+
+// NewKafkaClientFromConfig creates a client from the "kafka" config section.
+func NewKafkaClientFromConfig(config *viper.Viper, logger *zap.Logger) (*KafkaClient, error) {
+	cfg, err := KafkaConfigFromViper(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewKafkaClientWithConfig(cfg, logger)
+}
+
+// NewKafkaClientWithConfig creates a client for cfg. It fails if the TLS,
+// SASL, offset or compression settings are invalid. Errors of the Kafka
+// reader and writer are logged to logger.
+func NewKafkaClientWithConfig(cfg KafkaConfig, logger *zap.Logger) (*KafkaClient, error) {
+	tlsConfig, err := cfg.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := cfg.SASL.mechanism()
+	if err != nil {
+		return nil, err
+	}
+	startOffset, err := cfg.startOffset()
+	if err != nil {
+		return nil, err
+	}
+	compression, err := cfg.compression()
+	if err != nil {
+		return nil, err
+	}
+	minBytes, maxBytes, err := cfg.Consumer.fetchBytes()
+	if err != nil {
+		return nil, err
+	}
+	groupID := cfg.GroupID
+	if groupID == "" {
+		groupID = defaultGroupID
+	}
+
+	logger.Info("Connecting to Kafka", zap.Strings("brokers", cfg.Brokers), zap.String("topic", cfg.Topic), zap.String("group_id", groupID))
+	errorLogger := kafka.LoggerFunc(func(msg string, args ...interface{}) {
+		logger.Error(fmt.Sprintf(msg, args...))
 	})
+	// The writer has no fixed topic so ProduceMessage can publish to other
+	// topics than the one jobs are consumed from. Keyed messages are hashed
+	// to a partition; unkeyed ones are spread round-robin.
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(cfg.Brokers...),
+		Balancer:     &kafka.Hash{},
+		BatchSize:    cfg.Producer.BatchSize,
+		BatchBytes:   cfg.Producer.BatchBytes,
+		BatchTimeout: cfg.Producer.BatchTimeout,
+		Compression:  compression,
+		ErrorLogger:  errorLogger,
+		Transport: &kafka.Transport{
+			TLS:  tlsConfig,
+			SASL: mechanism,
+		},
+	}
 
 	reader := kafka.NewReader(kafka.ReaderConfig{
-		Brokers: brokers,
-		Topic:   topic,
-		GroupID: "job-execution-group",
+		Brokers:     cfg.Brokers,
+		Topic:       cfg.Topic,
+		GroupID:     groupID,
+		StartOffset: startOffset,
+		MinBytes:    minBytes,
+		MaxBytes:    maxBytes,
+		MaxWait:     cfg.Consumer.MaxWait,
+		ErrorLogger: errorLogger,
+		Dialer: &kafka.Dialer{
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: mechanism,
+		},
 	})
 
 	return &KafkaClient{
 		writer: writer,
 		reader: reader,
-		topic:  topic,
-	}
+		topic:  cfg.Topic,
+		logger: logger,
+	}, nil
 }
 
-func (kc *KafkaClient) ProduceMessage(ctx context.Context, message interface{}) error {
+// ProduceMessage publishes message as JSON to topic, or to the client's topic
+// when topic is empty. Messages with the same key go to the same partition,
+// so they are consumed in the order they were produced.
+func (kc *KafkaClient) ProduceMessage(ctx context.Context, topic, key string, message interface{}) error {
 	msg, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
+	return kc.writeMessage(ctx, topic, key, msg, nil)
+}
 
-	err = kc.writer.WriteMessages(ctx, kafka.Message{
-		Value: msg,
-	})
-	if err != nil {
-		return err
+// writeMessage writes value to topic, or to the client's topic when topic is
+// empty. The trace context of ctx is added to the headers unless they
+// already carry one.
+func (kc *KafkaClient) writeMessage(ctx context.Context, topic, key string, value []byte, headers map[string]string) error {
+	if topic == "" {
+		topic = kc.topic
+	}
+	headers = maps.Clone(headers)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	if _, traced := headers["traceparent"]; !traced {
+		tracing.InjectInto(ctx, headers)
 	}
 
-	return nil
-}
-
-func (kc *KafkaClient) ConsumeMessages(ctx context.Context) (<-chan []byte, error) {
-	messages := make(chan []byte)
-
-	go func() {
-		defer close(messages)
-		for {
-			msg, err := kc.reader.ReadMessage(ctx)
-			if err != nil {
-				log.Println("Error while reading message:", err)
-				return
-			}
-			messages <- msg.Value
-		}
-	}()
-
-	return messages, nil
+	kafkaMessage := kafka.Message{
+		Topic: topic,
+		Value: value,
+	}
+	if key != "" {
+		kafkaMessage.Key = []byte(key)
+	}
+	for name, headerValue := range headers {
+		kafkaMessage.Headers = append(kafkaMessage.Headers, kafka.Header{Key: name, Value: []byte(headerValue)})
+	}
+	return kc.writer.WriteMessages(ctx, kafkaMessage)
 }
 
-func (kc *KafkaClient) ConsumeMessage(ctx context.Context) (string, error) {
-	message, err := kc.reader.ReadMessage(ctx)
+// FetchMessage reads the next message without committing its offset. Call
+// CommitMessage once the message has been durably handled; until then it is
+// redelivered after a restart or consumer group rebalance.
+func (kc *KafkaClient) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	message, err := kc.reader.FetchMessage(ctx)
 	if err != nil {
-		log.Printf("Error reading message from Kafka: %v", err)
-		return "", err
+		return kafka.Message{}, err
 	}
+	return message, nil
+}
+
+// CommitMessage commits the offset of a message returned by FetchMessage.
+func (kc *KafkaClient) CommitMessage(ctx context.Context, message kafka.Message) error {
+	return kc.reader.CommitMessages(ctx, message)
+}
 
-	log.Printf("Consumed message: %s", string(message.Value))
-	return string(message.Value), nil
+// Lag returns how many messages the consumer is behind the end of the topic.
+func (kc *KafkaClient) Lag() int64 {
+	return kc.reader.Stats().Lag
 }
 
 func (kc *KafkaClient) Close() error {
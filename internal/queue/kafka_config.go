@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"github.com/spf13/viper"
+)
+
+// defaultGroupID is the consumer group used when kafka.group_id is not set.
+const defaultGroupID = "job-execution-group"
+
+// saslPasswordEnv overrides kafka.sasl.password so the secret can be kept out
+// of the config file.
+const saslPasswordEnv = "KAFKA_SASL_PASSWORD"
+
+// KafkaConfig is the "kafka" config section.
+type KafkaConfig struct {
+	Brokers []string `mapstructure:"brokers"`
+	Topic   string   `mapstructure:"topic"`
+	GroupID string   `mapstructure:"group_id"`
+	// AutoOffsetReset is where a consumer group without committed offsets
+	// starts reading: "earliest" (default) or "latest".
+	AutoOffsetReset string `mapstructure:"auto_offset_reset"`
+
+	TLS      KafkaTLSConfig      `mapstructure:"tls"`
+	SASL     KafkaSASLConfig     `mapstructure:"sasl"`
+	Producer KafkaProducerConfig `mapstructure:"producer"`
+	Consumer KafkaConsumerConfig `mapstructure:"consumer"`
+}
+
+// KafkaTLSConfig configures TLS to the brokers. Setting CertFile and KeyFile
+// enables mutual TLS.
+type KafkaTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"ca_file"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// KafkaSASLConfig configures SASL authentication. Mechanism is one of
+// "plain", "scram-sha-256" or "scram-sha-512"; empty disables SASL.
+type KafkaSASLConfig struct {
+	Mechanism string `mapstructure:"mechanism"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+}
+
+// KafkaProducerConfig tunes the writer. Zero values keep the kafka-go defaults.
+type KafkaProducerConfig struct {
+	BatchSize    int           `mapstructure:"batch_size"`
+	BatchBytes   int64         `mapstructure:"batch_bytes"`
+	BatchTimeout time.Duration `mapstructure:"batch_timeout"`
+	// Compression is one of "none", "gzip", "snappy", "lz4" or "zstd".
+	Compression string `mapstructure:"compression"`
+}
+
+// KafkaConsumerConfig tunes the reader. Zero values keep the kafka-go defaults.
+type KafkaConsumerConfig struct {
+	MinBytes int           `mapstructure:"min_bytes"`
+	MaxBytes int           `mapstructure:"max_bytes"`
+	MaxWait  time.Duration `mapstructure:"max_wait"`
+}
+
+// KafkaConfigFromViper reads the "kafka" section of config.
+func KafkaConfigFromViper(config *viper.Viper) (KafkaConfig, error) {
+	var cfg KafkaConfig
+	if err := config.UnmarshalKey("kafka", &cfg); err != nil {
+		return KafkaConfig{}, fmt.Errorf("invalid kafka config: %w", err)
+	}
+	if password := os.Getenv(saslPasswordEnv); password != "" {
+		cfg.SASL.Password = password
+	}
+	return cfg, nil
+}
+
+// startOffset maps AutoOffsetReset to a kafka-go start offset.
+func (c KafkaConfig) startOffset() (int64, error) {
+	switch strings.ToLower(c.AutoOffsetReset) {
+	case "", "earliest":
+		return kafka.FirstOffset, nil
+	case "latest":
+		return kafka.LastOffset, nil
+	}
+	return 0, fmt.Errorf("kafka.auto_offset_reset must be earliest or latest, got %q", c.AutoOffsetReset)
+}
+
+// fetchBytes returns the consumer's min and max fetch sizes with the kafka-go
+// defaults filled in.
+func (c KafkaConsumerConfig) fetchBytes() (int, int, error) {
+	minBytes, maxBytes := c.MinBytes, c.MaxBytes
+	if minBytes <= 0 {
+		minBytes = 1
+	}
+	if maxBytes <= 0 {
+		maxBytes = 1e6
+	}
+	if minBytes > maxBytes {
+		return 0, 0, fmt.Errorf("kafka.consumer.min_bytes (%d) is greater than max_bytes (%d)", minBytes, maxBytes)
+	}
+	return minBytes, maxBytes, nil
+}
+
+func (c KafkaConfig) compression() (kafka.Compression, error) {
+	if c.Producer.Compression == "" {
+		return 0, nil
+	}
+	var compression kafka.Compression
+	if err := compression.UnmarshalText([]byte(strings.ToLower(c.Producer.Compression))); err != nil {
+		return 0, fmt.Errorf("invalid kafka.producer.compression: %w", err)
+	}
+	return compression, nil
+}
+
+// tlsConfig returns the TLS settings for broker connections, or nil when TLS is disabled.
+func (c KafkaTLSConfig) tlsConfig() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in kafka CA file %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load kafka client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// mechanism returns the SASL mechanism, or nil when SASL is disabled.
+func (c KafkaSASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch strings.ToLower(c.Mechanism) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	}
+	return nil, fmt.Errorf("unsupported kafka.sasl.mechanism %q", c.Mechanism)
+}
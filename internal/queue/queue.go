@@ -1,63 +1,302 @@
 package queue
 
 import (
+	"container/heap"
+	"context"
 	"errors"
+	"strconv"
 	"sync"
+	"time"
+)
+
+// DefaultVisibilityTimeout is how long a dequeued job stays leased when the
+// queue is created without a visibility timeout.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+var (
+	// ErrEmpty is returned by Peek when no job is ready.
+	ErrEmpty = errors.New("queue is empty")
+	// ErrLeaseNotFound is returned for leases that were acknowledged,
+	// expired or never existed.
+	ErrLeaseNotFound = errors.New("lease not found or expired")
 )
 
 // Job represents a job in the queue.
 type Job struct {
-	ID       string
-	Payload  interface{}
+	ID      string
+	Payload interface{}
+}
+
+// Lease is a job handed out by Dequeue. Until the lease is acknowledged or
+// expires, the job is invisible to other consumers; an expired lease makes
+// the job ready again.
+type Lease struct {
+	ID  string
+	Job Job
+	// Deliveries is the number of times the job has been dequeued, including
+	// this one.
+	Deliveries int
+	ExpiresAt  time.Time
 }
 
-// Queue defines the interface for a job queue.
+// Queue defines the interface for a job queue. Delivery is at-least-once:
+// a dequeued job is delivered again unless its lease is acknowledged before
+// the visibility timeout.
 type Queue interface {
-	Enqueue(job Job) error
-	Dequeue() (Job, error)
-	IsEmpty() bool
+	// Enqueue adds a job that is ready immediately.
+	Enqueue(ctx context.Context, job Job) error
+	// EnqueueAfter adds a job that becomes ready after delay.
+	EnqueueAfter(ctx context.Context, job Job, delay time.Duration) error
+	// Dequeue blocks until a job is ready or ctx is done, and leases it.
+	Dequeue(ctx context.Context) (Lease, error)
+	// DequeueBatch blocks until at least one job is ready or ctx is done, and
+	// leases up to max ready jobs.
+	DequeueBatch(ctx context.Context, max int) ([]Lease, error)
+	// Ack removes a leased job from the queue.
+	Ack(ctx context.Context, leaseID string) error
+	// Nack releases a leased job so it is ready again after delay.
+	Nack(ctx context.Context, leaseID string, delay time.Duration) error
+	// ExtendLease keeps a job leased for another d from now.
+	ExtendLease(ctx context.Context, leaseID string, d time.Duration) error
+	// Peek returns the job Dequeue would return next without leasing it, or
+	// ErrEmpty if no job is ready.
+	Peek(ctx context.Context) (Job, error)
+	// Len returns the number of jobs that are not leased, including delayed ones.
+	Len(ctx context.Context) (int, error)
+}
+
+// entry is a job waiting in an InMemoryQueue.
+type entry struct {
+	job        Job
+	readyAt    time.Time
+	seq        uint64
+	deliveries int
+}
+
+// entryHeap orders entries by readyAt, then by enqueue order.
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+func (h entryHeap) Less(i, j int) bool {
+	if !h[i].readyAt.Equal(h[j].readyAt) {
+		return h[i].readyAt.Before(h[j].readyAt)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h entryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *entryHeap) Push(x any)   { *h = append(*h, x.(*entry)) }
+func (h *entryHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+type leasedEntry struct {
+	entry     *entry
+	expiresAt time.Time
 }
 
 // InMemoryQueue is an in-memory implementation of the Queue interface.
 type InMemoryQueue struct {
-	jobs []Job
-	mu   sync.Mutex
+	mu                sync.Mutex
+	visibilityTimeout time.Duration
+	waiting           entryHeap
+	leased            map[string]*leasedEntry
+	seq               uint64
+	nextLease         uint64
+	// changed is closed and replaced whenever a job may have become ready,
+	// waking blocked Dequeue calls.
+	changed chan struct{}
 }
 
-// NewInMemoryQueue creates a new instance of InMemoryQueue.
-func NewInMemoryQueue() *InMemoryQueue {
+// NewInMemoryQueue creates a new instance of InMemoryQueue. Dequeued jobs are
+// leased for visibilityTimeout, or DefaultVisibilityTimeout if it is zero.
+func NewInMemoryQueue(visibilityTimeout time.Duration) *InMemoryQueue {
+	if visibilityTimeout <= 0 {
+		visibilityTimeout = DefaultVisibilityTimeout
+	}
 	return &InMemoryQueue{
-		jobs: make([]Job, 0),
+		visibilityTimeout: visibilityTimeout,
+		leased:            make(map[string]*leasedEntry),
+		changed:           make(chan struct{}),
 	}
 }
 
 // Enqueue adds a job to the queue.
-func (q *InMemoryQueue) Enqueue(job Job) error {
+func (q *InMemoryQueue) Enqueue(ctx context.Context, job Job) error {
+	return q.EnqueueAfter(ctx, job, 0)
+}
+
+// EnqueueAfter adds a job to the queue that becomes ready after delay.
+func (q *InMemoryQueue) EnqueueAfter(ctx context.Context, job Job, delay time.Duration) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	q.jobs = append(q.jobs, job)
+	q.seq++
+	heap.Push(&q.waiting, &entry{job: job, readyAt: time.Now().Add(delay), seq: q.seq})
+	q.broadcast()
 	return nil
 }
 
-// Dequeue removes and returns the next job from the queue.
-func (q *InMemoryQueue) Dequeue() (Job, error) {
+// Dequeue leases the next ready job, waiting for one if necessary.
+func (q *InMemoryQueue) Dequeue(ctx context.Context) (Lease, error) {
+	leases, err := q.DequeueBatch(ctx, 1)
+	if err != nil {
+		return Lease{}, err
+	}
+	return leases[0], nil
+}
+
+// DequeueBatch leases up to max ready jobs, waiting for at least one.
+func (q *InMemoryQueue) DequeueBatch(ctx context.Context, max int) ([]Lease, error) {
+	if max <= 0 {
+		max = 1
+	}
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		q.expireLeases(now)
+		var leases []Lease
+		for len(leases) < max && len(q.waiting) > 0 && !q.waiting[0].readyAt.After(now) {
+			leases = append(leases, q.lease(heap.Pop(&q.waiting).(*entry), now))
+		}
+		if len(leases) > 0 {
+			q.mu.Unlock()
+			return leases, nil
+		}
+		wait := q.nextChange(now)
+		changed := q.changed
+		q.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+// Ack removes a leased job from the queue.
+func (q *InMemoryQueue) Ack(ctx context.Context, leaseID string) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	if len(q.jobs) == 0 {
-		return Job{}, errors.New("queue is empty")
+	if _, err := q.activeLease(leaseID, time.Now()); err != nil {
+		return err
 	}
+	delete(q.leased, leaseID)
+	return nil
+}
 
-	job := q.jobs[0]
-	q.jobs = q.jobs[1:]
-	return job, nil
+// Nack makes a leased job ready again after delay.
+func (q *InMemoryQueue) Nack(ctx context.Context, leaseID string, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	leased, err := q.activeLease(leaseID, now)
+	if err != nil {
+		return err
+	}
+	delete(q.leased, leaseID)
+	leased.entry.readyAt = now.Add(delay)
+	heap.Push(&q.waiting, leased.entry)
+	q.broadcast()
+	return nil
+}
+
+// ExtendLease keeps a job leased for another d from now.
+func (q *InMemoryQueue) ExtendLease(ctx context.Context, leaseID string, d time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	leased, err := q.activeLease(leaseID, now)
+	if err != nil {
+		return err
+	}
+	leased.expiresAt = now.Add(d)
+	return nil
 }
 
-// IsEmpty checks if the queue is empty.
-func (q *InMemoryQueue) IsEmpty() bool {
+// Peek returns the next ready job without leasing it.
+func (q *InMemoryQueue) Peek(ctx context.Context) (Job, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	return len(q.jobs) == 0
-}
\ No newline at end of file
+	now := time.Now()
+	q.expireLeases(now)
+	if len(q.waiting) == 0 || q.waiting[0].readyAt.After(now) {
+		return Job{}, ErrEmpty
+	}
+	return q.waiting[0].job, nil
+}
+
+// Len returns the number of jobs that are not leased.
+func (q *InMemoryQueue) Len(ctx context.Context) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expireLeases(time.Now())
+	return len(q.waiting), nil
+}
+
+// lease hands out e. The caller must hold q.mu.
+func (q *InMemoryQueue) lease(e *entry, now time.Time) Lease {
+	q.nextLease++
+	id := strconv.FormatUint(q.nextLease, 10)
+	e.deliveries++
+	expiresAt := now.Add(q.visibilityTimeout)
+	q.leased[id] = &leasedEntry{entry: e, expiresAt: expiresAt}
+	return Lease{ID: id, Job: e.job, Deliveries: e.deliveries, ExpiresAt: expiresAt}
+}
+
+// activeLease returns the lease with the given ID if it has not expired. The
+// caller must hold q.mu.
+func (q *InMemoryQueue) activeLease(leaseID string, now time.Time) (*leasedEntry, error) {
+	leased, ok := q.leased[leaseID]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	if !now.Before(leased.expiresAt) {
+		q.expireLeases(now)
+		return nil, ErrLeaseNotFound
+	}
+	return leased, nil
+}
+
+// expireLeases makes the jobs of expired leases ready again. The caller must
+// hold q.mu.
+func (q *InMemoryQueue) expireLeases(now time.Time) {
+	for id, leased := range q.leased {
+		if !now.Before(leased.expiresAt) {
+			delete(q.leased, id)
+			leased.entry.readyAt = leased.expiresAt
+			heap.Push(&q.waiting, leased.entry)
+		}
+	}
+}
+
+// nextChange returns how long until a delayed job becomes ready or a lease
+// expires. The caller must hold q.mu.
+func (q *InMemoryQueue) nextChange(now time.Time) time.Duration {
+	next := time.Hour
+	if len(q.waiting) > 0 {
+		next = min(next, q.waiting[0].readyAt.Sub(now))
+	}
+	for _, leased := range q.leased {
+		next = min(next, leased.expiresAt.Sub(now))
+	}
+	return max(next, time.Millisecond)
+}
+
+// broadcast wakes every blocked Dequeue. The caller must hold q.mu.
+func (q *InMemoryQueue) broadcast() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
@@ -0,0 +1,51 @@
+package queue_test
+
+import (
+	"context"
+	"execution-service/internal/database"
+	"execution-service/internal/queue"
+	"execution-service/internal/queue/queuetest"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInMemoryQueue(t *testing.T) {
+	queuetest.Run(t, func(t *testing.T, visibilityTimeout time.Duration) queue.Queue {
+		return queue.NewInMemoryQueue(visibilityTimeout)
+	})
+}
+
+func TestMemoryIntake(t *testing.T) {
+	queuetest.RunIntake(t, func(t *testing.T, visibilityTimeout time.Duration) queue.Intake {
+		return queue.NewMemoryIntake(visibilityTimeout)
+	})
+}
+
+// TestMongoIntake runs against the MongoDB at MONGO_URI, in a collection that
+// is dropped afterwards. It is skipped when MONGO_URI is not set.
+func TestMongoIntake(t *testing.T) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+	client, err := database.ConnectMongoDB(uri)
+	if err != nil {
+		t.Fatalf("ConnectMongoDB: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	db := client.Database("execution_service_test")
+
+	n := 0
+	queuetest.RunIntake(t, func(t *testing.T, visibilityTimeout time.Duration) queue.Intake {
+		n++
+		collection := db.Collection(fmt.Sprintf("job_queue_%d_%d", time.Now().UnixNano(), n))
+		t.Cleanup(func() { collection.Drop(context.Background()) })
+		intake, err := queue.NewMongoIntake(collection, visibilityTimeout, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("NewMongoIntake: %v", err)
+		}
+		return intake
+	})
+}
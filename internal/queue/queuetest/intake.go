@@ -0,0 +1,132 @@
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/queue"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// IntakeFactory returns a new, empty intake whose received messages are
+// leased for visibilityTimeout.
+type IntakeFactory func(t *testing.T, visibilityTimeout time.Duration) queue.Intake
+
+// RunIntake runs the conformance suite against intakes created by newIntake.
+func RunIntake(t *testing.T, newIntake IntakeFactory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, newIntake IntakeFactory)
+	}{
+		{"PublishReceive", testPublishReceive},
+		{"ReceiveHonorsContext", testReceiveContext},
+		{"AckRemovesMessage", testAckMessage},
+		{"UnackedMessageRedelivered", testRedeliver},
+		{"Lag", testLag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newIntake)
+		})
+	}
+}
+
+func publish(t *testing.T, in queue.Intake, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		value := fmt.Sprintf(`{"job_id":"job-%d"}`, i)
+		if err := in.Publish(timeout(t), []byte(value), map[string]string{"n": fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Publish(%s): %v", value, err)
+		}
+	}
+}
+
+func receive(t *testing.T, in queue.Intake) queue.Message {
+	t.Helper()
+	msg, err := in.Receive(timeout(t))
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	return msg
+}
+
+func testPublishReceive(t *testing.T, newIntake IntakeFactory) {
+	in := newIntake(t, time.Minute)
+	publish(t, in, 3)
+	for i := 0; i < 3; i++ {
+		msg := receive(t, in)
+		want := fmt.Sprintf(`{"job_id":"job-%d"}`, i)
+		if string(msg.Value) != want || msg.Headers["n"] != fmt.Sprint(i) {
+			t.Fatalf("Receive = %s %v, want %s with header n=%d", msg.Value, msg.Headers, want, i)
+		}
+		if err := in.Ack(timeout(t), msg); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+}
+
+func testReceiveContext(t *testing.T, newIntake IntakeFactory) {
+	in := newIntake(t, time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	msg, err := in.Receive(ctx)
+	if err == nil {
+		t.Fatalf("Receive returned %s from an empty intake", msg.Value)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Receive error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func testAckMessage(t *testing.T, newIntake IntakeFactory) {
+	in := newIntake(t, visibilityTimeout)
+	publish(t, in, 1)
+	if err := in.Ack(timeout(t), receive(t, in)); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*visibilityTimeout)
+	defer cancel()
+	if msg, err := in.Receive(ctx); err == nil {
+		t.Fatalf("acknowledged message %s was delivered again", msg.Value)
+	}
+}
+
+func testRedeliver(t *testing.T, newIntake IntakeFactory) {
+	in := newIntake(t, visibilityTimeout)
+	publish(t, in, 1)
+	first := receive(t, in)
+	start := time.Now()
+	second := receive(t, in)
+	if waited := time.Since(start); waited < visibilityTimeout/2 {
+		t.Fatalf("message redelivered after %s, before its lease expired", waited)
+	}
+	if string(second.Value) != string(first.Value) {
+		t.Fatalf("redelivered %s, want %s", second.Value, first.Value)
+	}
+	if err := in.Ack(timeout(t), first); !errors.Is(err, queue.ErrLeaseLost) {
+		t.Fatalf("Ack of expired lease error = %v, want ErrLeaseLost", err)
+	}
+	if err := in.Ack(timeout(t), second); err != nil {
+		t.Fatalf("Ack of current lease: %v", err)
+	}
+}
+
+func testLag(t *testing.T, newIntake IntakeFactory) {
+	in := newIntake(t, time.Minute)
+	reporter, ok := in.(queue.LagReporter)
+	if !ok {
+		t.Skip("intake does not report lag")
+	}
+	lag := func(want int64) {
+		t.Helper()
+		if n, err := reporter.Lag(timeout(t)); err != nil || n != want {
+			t.Fatalf("Lag = %d, %v, want %d", n, err, want)
+		}
+	}
+	lag(0)
+	publish(t, in, 2)
+	lag(2)
+	receive(t, in)
+	lag(1)
+}
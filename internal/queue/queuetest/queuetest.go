@@ -0,0 +1,407 @@
+// Package queuetest is a conformance suite for queue.Queue implementations.
+// A backend's tests call Run with a constructor for empty queues:
+//
+//	func TestInMemoryQueue(t *testing.T) {
+//		queuetest.Run(t, func(t *testing.T, visibilityTimeout time.Duration) queue.Queue {
+//			return queue.NewInMemoryQueue(visibilityTimeout)
+//		})
+//	}
+//
+// RunIntake is the same for queue.Intake implementations.
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/queue"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a new, empty queue whose leases last visibilityTimeout.
+type Factory func(t *testing.T, visibilityTimeout time.Duration) queue.Queue
+
+// visibilityTimeout is the lease duration used by tests that let leases expire.
+const visibilityTimeout = 200 * time.Millisecond
+
+// Run runs the conformance suite against queues created by newQueue.
+func Run(t *testing.T, newQueue Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, newQueue Factory)
+	}{
+		{"FIFO", testFIFO},
+		{"DequeueBlocksUntilEnqueue", testDequeueBlocks},
+		{"DequeueHonorsContext", testDequeueContext},
+		{"AckRemovesJob", testAck},
+		{"AckUnknownLease", testAckUnknown},
+		{"NackRedelivers", testNack},
+		{"NackWithDelay", testNackDelay},
+		{"ExpiredLeaseRedelivers", testLeaseExpiry},
+		{"ExtendLease", testExtendLease},
+		{"EnqueueAfter", testEnqueueAfter},
+		{"Peek", testPeek},
+		{"Len", testLen},
+		{"DequeueBatch", testDequeueBatch},
+		{"ConcurrentConsumers", testConcurrentConsumers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newQueue)
+		})
+	}
+}
+
+func timeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func job(i int) queue.Job {
+	return queue.Job{ID: fmt.Sprintf("job-%d", i), Payload: fmt.Sprintf("payload-%d", i)}
+}
+
+func mustEnqueue(t *testing.T, q queue.Queue, jobs ...queue.Job) {
+	t.Helper()
+	for _, j := range jobs {
+		if err := q.Enqueue(timeout(t), j); err != nil {
+			t.Fatalf("Enqueue(%s): %v", j.ID, err)
+		}
+	}
+}
+
+func mustDequeue(t *testing.T, q queue.Queue) queue.Lease {
+	t.Helper()
+	lease, err := q.Dequeue(timeout(t))
+	if err != nil {
+		t.Fatalf("Dequeue: %v", err)
+	}
+	return lease
+}
+
+// expectEmpty checks that nothing can be dequeued within wait.
+func expectEmpty(t *testing.T, q queue.Queue, wait time.Duration) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	if lease, err := q.Dequeue(ctx); err == nil {
+		t.Fatalf("Dequeue returned %s, want no ready job", lease.Job.ID)
+	} else if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dequeue error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func testFIFO(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	mustEnqueue(t, q, job(1), job(2), job(3))
+	for i := 1; i <= 3; i++ {
+		lease := mustDequeue(t, q)
+		if lease.Job.ID != job(i).ID {
+			t.Fatalf("Dequeue returned %s, want %s", lease.Job.ID, job(i).ID)
+		}
+		if lease.Job.Payload != job(i).Payload {
+			t.Fatalf("payload = %v, want %v", lease.Job.Payload, job(i).Payload)
+		}
+		if lease.Deliveries != 1 {
+			t.Fatalf("Deliveries = %d, want 1", lease.Deliveries)
+		}
+	}
+}
+
+func testDequeueBlocks(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	result := make(chan queue.Lease, 1)
+	go func() {
+		lease, err := q.Dequeue(timeout(t))
+		if err == nil {
+			result <- lease
+		}
+		close(result)
+	}()
+
+	select {
+	case lease := <-result:
+		t.Fatalf("Dequeue returned %s from an empty queue", lease.Job.ID)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mustEnqueue(t, q, job(1))
+	select {
+	case lease, ok := <-result:
+		if !ok || lease.Job.ID != job(1).ID {
+			t.Fatalf("blocked Dequeue did not return the enqueued job")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("blocked Dequeue was not woken by Enqueue")
+	}
+}
+
+func testDequeueContext(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := q.Dequeue(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Dequeue error = %v, want context.Canceled", err)
+	}
+	if _, err := q.DequeueBatch(ctx, 5); !errors.Is(err, context.Canceled) {
+		t.Fatalf("DequeueBatch error = %v, want context.Canceled", err)
+	}
+}
+
+func testAck(t *testing.T, newQueue Factory) {
+	q := newQueue(t, visibilityTimeout)
+	mustEnqueue(t, q, job(1))
+	lease := mustDequeue(t, q)
+	if err := q.Ack(timeout(t), lease.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	expectEmpty(t, q, 2*visibilityTimeout)
+	if err := q.Ack(timeout(t), lease.ID); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Fatalf("second Ack error = %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func testAckUnknown(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	if err := q.Ack(timeout(t), "no-such-lease"); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Fatalf("Ack error = %v, want ErrLeaseNotFound", err)
+	}
+	if err := q.Nack(timeout(t), "no-such-lease", 0); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Fatalf("Nack error = %v, want ErrLeaseNotFound", err)
+	}
+	if err := q.ExtendLease(timeout(t), "no-such-lease", time.Minute); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Fatalf("ExtendLease error = %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func testNack(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	mustEnqueue(t, q, job(1))
+	first := mustDequeue(t, q)
+	if err := q.Nack(timeout(t), first.ID, 0); err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+	second := mustDequeue(t, q)
+	if second.Job.ID != job(1).ID || second.Deliveries != 2 {
+		t.Fatalf("redelivered %s with Deliveries %d, want %s with 2", second.Job.ID, second.Deliveries, job(1).ID)
+	}
+	if err := q.Ack(timeout(t), first.ID); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Fatalf("Ack of nacked lease error = %v, want ErrLeaseNotFound", err)
+	}
+}
+
+func testNackDelay(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	mustEnqueue(t, q, job(1))
+	lease := mustDequeue(t, q)
+	if err := q.Nack(timeout(t), lease.ID, 300*time.Millisecond); err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+	expectEmpty(t, q, 100*time.Millisecond)
+	if lease := mustDequeue(t, q); lease.Job.ID != job(1).ID {
+		t.Fatalf("Dequeue returned %s, want %s", lease.Job.ID, job(1).ID)
+	}
+}
+
+func testLeaseExpiry(t *testing.T, newQueue Factory) {
+	q := newQueue(t, visibilityTimeout)
+	mustEnqueue(t, q, job(1))
+	first := mustDequeue(t, q)
+	if time.Until(first.ExpiresAt) > visibilityTimeout {
+		t.Fatalf("lease expires in %s, want at most %s", time.Until(first.ExpiresAt), visibilityTimeout)
+	}
+
+	start := time.Now()
+	second := mustDequeue(t, q)
+	if waited := time.Since(start); waited < visibilityTimeout/2 {
+		t.Fatalf("job redelivered after %s, before its lease expired", waited)
+	}
+	if second.Job.ID != job(1).ID || second.Deliveries != 2 {
+		t.Fatalf("redelivered %s with Deliveries %d, want %s with 2", second.Job.ID, second.Deliveries, job(1).ID)
+	}
+	if err := q.Ack(timeout(t), first.ID); !errors.Is(err, queue.ErrLeaseNotFound) {
+		t.Fatalf("Ack of expired lease error = %v, want ErrLeaseNotFound", err)
+	}
+	if err := q.Ack(timeout(t), second.ID); err != nil {
+		t.Fatalf("Ack of current lease: %v", err)
+	}
+}
+
+func testExtendLease(t *testing.T, newQueue Factory) {
+	q := newQueue(t, visibilityTimeout)
+	mustEnqueue(t, q, job(1))
+	lease := mustDequeue(t, q)
+	for i := 0; i < 3; i++ {
+		time.Sleep(visibilityTimeout / 2)
+		if err := q.ExtendLease(timeout(t), lease.ID, visibilityTimeout); err != nil {
+			t.Fatalf("ExtendLease: %v", err)
+		}
+	}
+	expectEmpty(t, q, visibilityTimeout/2)
+	if err := q.Ack(timeout(t), lease.ID); err != nil {
+		t.Fatalf("Ack after extending: %v", err)
+	}
+}
+
+func testEnqueueAfter(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	if err := q.EnqueueAfter(timeout(t), job(1), 300*time.Millisecond); err != nil {
+		t.Fatalf("EnqueueAfter: %v", err)
+	}
+	mustEnqueue(t, q, job(2))
+	if lease := mustDequeue(t, q); lease.Job.ID != job(2).ID {
+		t.Fatalf("Dequeue returned %s, want the ready job %s", lease.Job.ID, job(2).ID)
+	}
+	if _, err := q.Peek(timeout(t)); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("Peek of delayed job error = %v, want ErrEmpty", err)
+	}
+	start := time.Now()
+	if lease := mustDequeue(t, q); lease.Job.ID != job(1).ID {
+		t.Fatalf("Dequeue returned %s, want %s", lease.Job.ID, job(1).ID)
+	}
+	if waited := time.Since(start); waited < 150*time.Millisecond {
+		t.Fatalf("delayed job was ready after %s", waited)
+	}
+}
+
+func testPeek(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	if _, err := q.Peek(timeout(t)); !errors.Is(err, queue.ErrEmpty) {
+		t.Fatalf("Peek of empty queue error = %v, want ErrEmpty", err)
+	}
+	mustEnqueue(t, q, job(1), job(2))
+	for i := 0; i < 2; i++ {
+		peeked, err := q.Peek(timeout(t))
+		if err != nil || peeked.ID != job(1).ID {
+			t.Fatalf("Peek = %s, %v, want %s", peeked.ID, err, job(1).ID)
+		}
+	}
+	if lease := mustDequeue(t, q); lease.Job.ID != job(1).ID {
+		t.Fatalf("Dequeue after Peek returned %s, want %s", lease.Job.ID, job(1).ID)
+	}
+	if peeked, err := q.Peek(timeout(t)); err != nil || peeked.ID != job(2).ID {
+		t.Fatalf("Peek = %s, %v, want %s", peeked.ID, err, job(2).ID)
+	}
+}
+
+func testLen(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	checkLen := func(want int) {
+		t.Helper()
+		if n, err := q.Len(timeout(t)); err != nil || n != want {
+			t.Fatalf("Len = %d, %v, want %d", n, err, want)
+		}
+	}
+	checkLen(0)
+	mustEnqueue(t, q, job(1), job(2))
+	if err := q.EnqueueAfter(timeout(t), job(3), time.Minute); err != nil {
+		t.Fatalf("EnqueueAfter: %v", err)
+	}
+	checkLen(3)
+	lease := mustDequeue(t, q)
+	checkLen(2)
+	if err := q.Nack(timeout(t), lease.ID, 0); err != nil {
+		t.Fatalf("Nack: %v", err)
+	}
+	checkLen(3)
+	lease = mustDequeue(t, q)
+	if err := q.Ack(timeout(t), lease.ID); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	checkLen(2)
+}
+
+func testDequeueBatch(t *testing.T, newQueue Factory) {
+	q := newQueue(t, time.Minute)
+	for i := 1; i <= 5; i++ {
+		mustEnqueue(t, q, job(i))
+	}
+	leases, err := q.DequeueBatch(timeout(t), 3)
+	if err != nil {
+		t.Fatalf("DequeueBatch: %v", err)
+	}
+	if len(leases) != 3 {
+		t.Fatalf("DequeueBatch returned %d jobs, want 3", len(leases))
+	}
+	for i, lease := range leases {
+		if lease.Job.ID != job(i+1).ID {
+			t.Fatalf("batch[%d] = %s, want %s", i, lease.Job.ID, job(i+1).ID)
+		}
+	}
+	leases, err = q.DequeueBatch(timeout(t), 10)
+	if err != nil {
+		t.Fatalf("DequeueBatch: %v", err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("DequeueBatch returned %d jobs, want the 2 remaining", len(leases))
+	}
+	seen := make(map[string]bool)
+	for _, lease := range leases {
+		if seen[lease.ID] {
+			t.Fatalf("lease ID %s handed out twice", lease.ID)
+		}
+		seen[lease.ID] = true
+	}
+}
+
+func testConcurrentConsumers(t *testing.T, newQueue Factory) {
+	const producers, consumers, perProducer = 4, 4, 50
+	q := newQueue(t, time.Minute)
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				if err := q.Enqueue(timeout(t), job(p*perProducer+i)); err != nil {
+					t.Errorf("Enqueue: %v", err)
+				}
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	ctx, cancel := context.WithCancel(timeout(t))
+	defer cancel()
+	var consumersWG sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		consumersWG.Add(1)
+		go func() {
+			defer consumersWG.Done()
+			for {
+				lease, err := q.Dequeue(ctx)
+				if err != nil {
+					return
+				}
+				if err := q.Ack(ctx, lease.ID); err != nil {
+					t.Errorf("Ack: %v", err)
+				}
+				mu.Lock()
+				received[lease.Job.ID]++
+				done := len(received) == producers*perProducer
+				mu.Unlock()
+				if done {
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	consumersWG.Wait()
+
+	if len(received) != producers*perProducer {
+		t.Fatalf("received %d distinct jobs, want %d", len(received), producers*perProducer)
+	}
+	for id, n := range received {
+		if n != 1 {
+			t.Fatalf("job %s delivered %d times, want once", id, n)
+		}
+	}
+}
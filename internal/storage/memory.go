@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"execution-service/internal/models"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryJobRepository is a JobRepository that keeps everything in memory.
+// Nothing survives a restart, so it is meant for tests and local runs.
+type MemoryJobRepository struct {
+	mu       sync.Mutex
+	jobs     map[string]models.Job
+	attempts map[string][]models.ExecutedJob
+	logs     map[string][]models.LogChunk
+}
+
+// NewMemoryJobRepository creates an empty in-memory repository.
+func NewMemoryJobRepository() *MemoryJobRepository {
+	return &MemoryJobRepository{
+		jobs:     make(map[string]models.Job),
+		attempts: make(map[string][]models.ExecutedJob),
+		logs:     make(map[string][]models.LogChunk),
+	}
+}
+
+func (r *MemoryJobRepository) Create(ctx context.Context, job models.Job) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.jobs[job.JobID]; ok {
+		return ErrDuplicateJob
+	}
+	now := time.Now()
+	job.ID = primitive.NewObjectID()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	job.Version = 1
+	r.jobs[job.JobID] = cloneJob(job)
+	return nil
+}
+
+func (r *MemoryJobRepository) Get(ctx context.Context, jobID string) (models.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return models.Job{}, ErrNotFound
+	}
+	return cloneJob(job), nil
+}
+
+func (r *MemoryJobRepository) UpdateState(ctx context.Context, jobID string, update StateUpdate) (models.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return models.Job{}, ErrNotFound
+	}
+	if job.Version != update.ExpectedVersion {
+		return models.Job{}, ErrVersionConflict
+	}
+	job.Status = update.Status
+	if update.WorkerID != "" {
+		job.WorkerID = update.WorkerID
+	}
+	if update.ErrorMessage != "" {
+		job.ErrorMessage = update.ErrorMessage
+	}
+	job.Version++
+	job.UpdatedAt = time.Now()
+	r.jobs[jobID] = job
+	return cloneJob(job), nil
+}
+
+func (r *MemoryJobRepository) List(ctx context.Context, filter JobFilter, page Page) (JobPage, error) {
+	after, err := decodeCursor(page.Sort, page.Cursor)
+	if err != nil {
+		return JobPage{}, err
+	}
+
+	r.mu.Lock()
+	var jobs []models.Job
+	for _, job := range r.jobs {
+		if filter.matches(job) && (after == nil || page.Sort.compare(after.Time, after.JobID, job) < 0) {
+			jobs = append(jobs, cloneJob(job))
+		}
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(jobs, func(a, b models.Job) int {
+		return page.Sort.compare(page.Sort.sortTime(a), a.JobID, b)
+	})
+	return newJobPage(jobs, page), nil
+}
+
+func (r *MemoryJobRepository) AppendAttempt(ctx context.Context, attempt models.ExecutedJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempt.ID = primitive.NewObjectID()
+	r.attempts[attempt.JobID] = append(r.attempts[attempt.JobID], attempt)
+	return nil
+}
+
+func (r *MemoryJobRepository) Attempts(ctx context.Context, jobID string) ([]models.ExecutedJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	attempts := slices.Clone(r.attempts[jobID])
+	slices.SortStableFunc(attempts, func(a, b models.ExecutedJob) int {
+		return a.ExecutionCompletionTime.Compare(b.ExecutionCompletionTime)
+	})
+	return append([]models.ExecutedJob{}, attempts...), nil
+}
+
+func (r *MemoryJobRepository) AppendLogChunk(ctx context.Context, chunk models.LogChunk) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chunk.ID = primitive.NewObjectID()
+	r.logs[chunk.JobID] = append(r.logs[chunk.JobID], chunk)
+	return nil
+}
+
+func (r *MemoryJobRepository) Logs(ctx context.Context, jobID string) ([]models.LogChunk, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	chunks := slices.Clone(r.logs[jobID])
+	slices.SortStableFunc(chunks, func(a, b models.LogChunk) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.Seq, b.Seq))
+	})
+	return append([]models.LogChunk{}, chunks...), nil
+}
+
+func (r *MemoryJobRepository) Delete(ctx context.Context, jobID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.jobs[jobID]; !ok {
+		return ErrNotFound
+	}
+	delete(r.attempts, jobID)
+	delete(r.logs, jobID)
+	delete(r.jobs, jobID)
+	return nil
+}
+
+// cloneJob copies job so callers cannot change stored jobs through NotBefore
+// or Labels.
+func cloneJob(job models.Job) models.Job {
+	if job.NotBefore != nil {
+		notBefore := *job.NotBefore
+		job.NotBefore = &notBefore
+	}
+	job.Labels = maps.Clone(job.Labels)
+	return job
+}
+
+// matches reports whether job passes the filter.
+func (f JobFilter) matches(job models.Job) bool {
+	for key, value := range f.Labels {
+		if actual, ok := job.Labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	message := strings.ToLower(job.ErrorMessage)
+	for _, word := range errorWords(f.ErrorText) {
+		if !strings.Contains(message, word) {
+			return false
+		}
+	}
+	return (f.TenantID == "" || job.TenantID == f.TenantID) &&
+		(f.Status == "" || job.Status == f.Status) &&
+		(f.WorkerID == "" || job.WorkerID == f.WorkerID) &&
+		(f.DockerfileReference == "" || job.DockerfileReference == f.DockerfileReference) &&
+		(f.CreatedAfter.IsZero() || !job.CreatedAt.Before(f.CreatedAfter)) &&
+		(f.CreatedBefore.IsZero() || job.CreatedAt.Before(f.CreatedBefore)) &&
+		(f.UpdatedAfter.IsZero() || !job.UpdatedAt.Before(f.UpdatedAfter)) &&
+		(f.UpdatedBefore.IsZero() || job.UpdatedAt.Before(f.UpdatedBefore)) &&
+		!slices.Contains(f.ExcludeTenants, job.TenantID)
+}
+
+// compare orders the position (t, jobID) against job the way List returns
+// jobs in s.
+func (s Sort) compare(t time.Time, jobID string, job models.Job) int {
+	c := cmp.Or(t.Compare(s.sortTime(job)), cmp.Compare(jobID, job.JobID))
+	if s.Descending {
+		return -c
+	}
+	return c
+}
+
+// newJobPage returns the first page.Limit jobs, with a cursor if there are
+// more.
+func newJobPage(jobs []models.Job, page Page) JobPage {
+	if jobs == nil {
+		jobs = []models.Job{}
+	}
+	limit := page.limit()
+	if len(jobs) <= limit {
+		return JobPage{Jobs: jobs}
+	}
+	return JobPage{Jobs: jobs[:limit], NextCursor: encodeCursor(page.Sort, jobs[limit-1])}
+}
@@ -0,0 +1,13 @@
+package storage_test
+
+import (
+	"execution-service/internal/storage"
+	"execution-service/internal/storage/storagetest"
+	"testing"
+)
+
+func TestMemoryJobRepository(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.JobRepository {
+		return storage.NewMemoryJobRepository()
+	})
+}
@@ -0,0 +1,293 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"execution-service/internal/models"
+	"execution-service/internal/queries"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoConfig names the MongoDB database and collections used for jobs.
+type MongoConfig struct {
+	Database             string `mapstructure:"database"`
+	JobsCollection       string `mapstructure:"jobs_collection"`
+	ExecutionsCollection string `mapstructure:"executions_collection"`
+	LogsCollection       string `mapstructure:"logs_collection"`
+	MigrationsCollection string `mapstructure:"migrations_collection"`
+	// CompletedRetention is how long attempts and output are kept after a
+	// job finished. Zero keeps them forever.
+	CompletedRetention time.Duration `mapstructure:"completed_retention"`
+}
+
+// MongoConfigFromViper reads the storage.mongo section, defaulting to the
+// names the service has always used.
+func MongoConfigFromViper(config *viper.Viper) (MongoConfig, error) {
+	cfg := MongoConfig{
+		Database:             "hackathon",
+		JobsCollection:       "jobs",
+		ExecutionsCollection: "executed_jobs",
+		LogsCollection:       "job_logs",
+		MigrationsCollection: "schema_migrations",
+	}
+	if err := config.UnmarshalKey("storage.mongo", &cfg); err != nil {
+		return MongoConfig{}, err
+	}
+	return cfg, nil
+}
+
+// MongoJobRepository is a JobRepository backed by MongoDB. Attempts are kept
+// in the executions collection and output in the logs collection, so a job
+// document stays small however often it is retried.
+type MongoJobRepository struct {
+	jobs       *mongo.Collection
+	executions *mongo.Collection
+	logs       *mongo.Collection
+	outbox     *mongo.Collection
+}
+
+// NewMongoJobRepository creates a repository on the collections of db named
+// by cfg.
+func NewMongoJobRepository(db *mongo.Database, cfg MongoConfig) *MongoJobRepository {
+	return &MongoJobRepository{
+		jobs:       db.Collection(cfg.JobsCollection),
+		executions: db.Collection(cfg.ExecutionsCollection),
+		logs:       db.Collection(cfg.LogsCollection),
+	}
+}
+
+// SetOutbox makes Create and UpdateState write a models.JobEvent to outbox in
+// the same transaction as the job change. Transactions need MongoDB to run as
+// a replica set.
+func (r *MongoJobRepository) SetOutbox(outbox *mongo.Collection) {
+	r.outbox = outbox
+}
+
+func (r *MongoJobRepository) Create(ctx context.Context, job models.Job) error {
+	err := queries.InsertJob(ctx, r.jobs, r.outbox, job)
+	if errors.Is(err, queries.ErrDuplicateJob) {
+		return ErrDuplicateJob
+	}
+	return err
+}
+
+func (r *MongoJobRepository) Get(ctx context.Context, jobID string) (models.Job, error) {
+	job, err := queries.GetJob(ctx, r.jobs, jobID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return models.Job{}, ErrNotFound
+	}
+	return job, err
+}
+
+func (r *MongoJobRepository) UpdateState(ctx context.Context, jobID string, update StateUpdate) (models.Job, error) {
+	job, err := queries.UpdateJobState(ctx, r.jobs, r.outbox, jobID, update.ExpectedVersion, update.Status, update.WorkerID, update.ErrorMessage)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Either the job does not exist or its version moved on.
+		if _, err := r.Get(ctx, jobID); err != nil {
+			return models.Job{}, err
+		}
+		return models.Job{}, ErrVersionConflict
+	}
+	return job, err
+}
+
+func (r *MongoJobRepository) List(ctx context.Context, filter JobFilter, page Page) (JobPage, error) {
+	after, err := decodeCursor(page.Sort, page.Cursor)
+	if err != nil {
+		return JobPage{}, err
+	}
+
+	query := bson.M{}
+	if filter.TenantID != "" {
+		query["tenant_id"] = filter.TenantID
+	}
+	if filter.Status != "" {
+		query["status"] = filter.Status
+	}
+	if filter.WorkerID != "" {
+		query["worker_id"] = filter.WorkerID
+	}
+	if filter.DockerfileReference != "" {
+		query["dockerfile_reference"] = filter.DockerfileReference
+	}
+	for key, value := range filter.Labels {
+		query["labels."+key] = value
+	}
+	if timeRange := mongoTimeRange(filter.CreatedAfter, filter.CreatedBefore); timeRange != nil {
+		query["created_at"] = timeRange
+	}
+	if timeRange := mongoTimeRange(filter.UpdatedAfter, filter.UpdatedBefore); timeRange != nil {
+		query["updated_at"] = timeRange
+	}
+	if len(filter.ExcludeTenants) > 0 {
+		tenant := bson.M{"$nin": filter.ExcludeTenants}
+		if filter.TenantID != "" {
+			tenant["$eq"] = filter.TenantID
+		}
+		query["tenant_id"] = tenant
+	}
+	if words := errorWords(filter.ErrorText); len(words) > 0 {
+		// Quoted words must all be present; unquoted ones would match any.
+		search := make([]string, len(words))
+		for i, word := range words {
+			search[i] = strconv.Quote(word)
+		}
+		query["$text"] = bson.M{"$search": strings.Join(search, " ")}
+	}
+
+	field := page.Sort.field()
+	direction, next := 1, "$gt"
+	if page.Sort.Descending {
+		direction, next = -1, "$lt"
+	}
+	if after != nil {
+		query["$or"] = bson.A{
+			bson.M{field: bson.M{next: after.Time}},
+			bson.M{field: after.Time, "job_id": bson.M{next: after.JobID}},
+		}
+	}
+
+	// Fetch one extra job to tell whether there is another page.
+	jobs, err := queries.FindJobs(ctx, r.jobs, query,
+		bson.D{{Key: field, Value: direction}, {Key: "job_id", Value: direction}}, int64(page.limit()+1))
+	if err != nil {
+		return JobPage{}, err
+	}
+	return newJobPage(jobs, page), nil
+}
+
+// mongoTimeRange returns a condition for times in [after, before), or nil if
+// both are zero.
+func mongoTimeRange(after, before time.Time) bson.M {
+	timeRange := bson.M{}
+	if !after.IsZero() {
+		timeRange["$gte"] = after
+	}
+	if !before.IsZero() {
+		timeRange["$lt"] = before
+	}
+	if len(timeRange) == 0 {
+		return nil
+	}
+	return timeRange
+}
+
+func (r *MongoJobRepository) AppendAttempt(ctx context.Context, attempt models.ExecutedJob) error {
+	return queries.AddEntry(ctx, r.executions, attempt)
+}
+
+func (r *MongoJobRepository) Attempts(ctx context.Context, jobID string) ([]models.ExecutedJob, error) {
+	return queries.FindExecutions(ctx, r.executions, jobID)
+}
+
+func (r *MongoJobRepository) AppendLogChunk(ctx context.Context, chunk models.LogChunk) error {
+	return queries.InsertLogChunk(ctx, r.logs, chunk)
+}
+
+func (r *MongoJobRepository) Logs(ctx context.Context, jobID string) ([]models.LogChunk, error) {
+	return queries.FindLogChunks(ctx, r.logs, jobID)
+}
+
+func (r *MongoJobRepository) Delete(ctx context.Context, jobID string) error {
+	for _, collection := range []*mongo.Collection{r.logs, r.executions} {
+		if err := queries.DeleteByJobID(ctx, collection, jobID); err != nil {
+			return err
+		}
+	}
+	deleted, err := queries.DeleteJob(ctx, r.jobs, jobID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// JobChange is a change to a stored job, as reported by a change stream.
+type JobChange struct {
+	// Token identifies the change; a stream opened after it continues with
+	// the next change.
+	Token     string     `json:"-"`
+	Operation string     `json:"operation"` // insert, update or replace
+	Job       models.Job `json:"job"`
+	Time      time.Time  `json:"time"`
+}
+
+// JobChangeStream is a MongoDB change stream on the jobs collection.
+type JobChangeStream struct {
+	stream *mongo.ChangeStream
+}
+
+// Watch opens a change stream for the jobs matching jobID and tenantID,
+// either of which may be empty to match every job. It starts after the
+// change with token after, or with the next change if after is empty, and
+// fails with ErrChangeHistoryLost if after is too old or invalid. Change
+// streams need MongoDB to run as a replica set.
+func (r *MongoJobRepository) Watch(ctx context.Context, jobID, tenantID, after string) (*JobChangeStream, error) {
+	var resumeAfter bson.Raw
+	if after != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(after)
+		if err != nil || bson.Raw(raw).Validate() != nil {
+			return nil, ErrChangeHistoryLost
+		}
+		resumeAfter = raw
+	}
+	stream, err := queries.WatchJobs(ctx, r.jobs, jobID, tenantID, resumeAfter)
+	if err != nil {
+		return nil, changeStreamError(err)
+	}
+	return &JobChangeStream{stream: stream}, nil
+}
+
+// Next waits for the next change. Updates of jobs that were deleted before
+// their document could be read are skipped.
+func (s *JobChangeStream) Next(ctx context.Context) (JobChange, error) {
+	for s.stream.Next(ctx) {
+		var event struct {
+			OperationType string              `bson:"operationType"`
+			ClusterTime   primitive.Timestamp `bson:"clusterTime"`
+			FullDocument  *models.Job         `bson:"fullDocument"`
+		}
+		if err := s.stream.Decode(&event); err != nil {
+			return JobChange{}, err
+		}
+		if event.FullDocument == nil {
+			continue
+		}
+		return JobChange{
+			Token:     base64.RawURLEncoding.EncodeToString(s.stream.ResumeToken()),
+			Operation: event.OperationType,
+			Job:       *event.FullDocument,
+			Time:      time.Unix(int64(event.ClusterTime.T), 0).UTC(),
+		}, nil
+	}
+	if err := s.stream.Err(); err != nil {
+		return JobChange{}, changeStreamError(err)
+	}
+	return JobChange{}, ctx.Err()
+}
+
+func (s *JobChangeStream) Close(ctx context.Context) error {
+	return s.stream.Close(ctx)
+}
+
+// changeStreamError maps the server errors for resume tokens that can no
+// longer be used to ErrChangeHistoryLost.
+func changeStreamError(err error) error {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && (serverErr.HasErrorCode(286) || serverErr.HasErrorCode(280)) {
+		// ChangeStreamHistoryLost and ChangeStreamFatalError.
+		return fmt.Errorf("%w: %v", ErrChangeHistoryLost, err)
+	}
+	return err
+}
@@ -0,0 +1,46 @@
+package storage_test
+
+import (
+	"context"
+	"execution-service/internal/database"
+	"execution-service/internal/storage"
+	"execution-service/internal/storage/storagetest"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// TestMongoJobRepository runs against the MongoDB at MONGO_URI, each test in a
+// database of its own that is dropped afterwards. It is skipped when
+// MONGO_URI is not set.
+func TestMongoJobRepository(t *testing.T) {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+	client, err := database.ConnectMongoDB(uri)
+	if err != nil {
+		t.Fatalf("ConnectMongoDB: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+
+	n := 0
+	storagetest.Run(t, func(t *testing.T) storage.JobRepository {
+		n++
+		cfg, err := storage.MongoConfigFromViper(viper.New())
+		if err != nil {
+			t.Fatalf("MongoConfigFromViper: %v", err)
+		}
+		cfg.Database = fmt.Sprintf("execution_service_test_%d_%d", time.Now().UnixNano(), n)
+		db := client.Database(cfg.Database)
+		t.Cleanup(func() { db.Drop(context.Background()) })
+		if err := database.JobStorageMigrator(db, cfg, zap.NewNop()).Migrate(context.Background()); err != nil {
+			t.Fatalf("Migrate: %v", err)
+		}
+		return storage.NewMongoJobRepository(db, cfg)
+	})
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"execution-service/internal/models"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the tables on first use. Times are stored as Unix
+// nanoseconds.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id                   TEXT NOT NULL,
+	job_id               TEXT PRIMARY KEY,
+	tenant_id            TEXT NOT NULL,
+	dockerfile_reference TEXT NOT NULL,
+	status               TEXT NOT NULL,
+	worker_id            TEXT NOT NULL DEFAULT '',
+	error_message        TEXT NOT NULL DEFAULT '',
+	payload              TEXT NOT NULL,
+	not_before           INTEGER,
+	version              INTEGER NOT NULL,
+	created_at           INTEGER NOT NULL,
+	updated_at           INTEGER NOT NULL,
+	labels               TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS jobs_created_at ON jobs (created_at, job_id);
+CREATE INDEX IF NOT EXISTS jobs_status_created_at ON jobs (status, created_at, job_id);
+CREATE INDEX IF NOT EXISTS jobs_status_updated_at ON jobs (status, updated_at);
+CREATE INDEX IF NOT EXISTS jobs_updated_at ON jobs (updated_at, job_id);
+CREATE TABLE IF NOT EXISTS executed_jobs (
+	id                        TEXT PRIMARY KEY,
+	job_id                    TEXT NOT NULL,
+	worker_id                 TEXT NOT NULL,
+	started_at                INTEGER NOT NULL,
+	dockerfile_reference      TEXT NOT NULL,
+	scheduled_time            INTEGER NOT NULL,
+	execution_completion_time INTEGER NOT NULL,
+	status                    TEXT NOT NULL,
+	error_message             TEXT NOT NULL,
+	outputs                   TEXT NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS executed_jobs_job_id ON executed_jobs (job_id, execution_completion_time);
+CREATE TABLE IF NOT EXISTS job_logs (
+	id         TEXT PRIMARY KEY,
+	job_id     TEXT NOT NULL,
+	worker_id  TEXT NOT NULL,
+	seq        INTEGER NOT NULL,
+	stream     TEXT NOT NULL,
+	data       TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS job_logs_job_id ON job_logs (job_id, created_at, seq);
+`
+
+const jobColumns = `id, job_id, tenant_id, dockerfile_reference, status, worker_id, error_message, payload, not_before, version, created_at, updated_at, labels`
+
+// sqliteColumns are columns added after the jobs table was first released,
+// which CREATE TABLE IF NOT EXISTS does not add to existing databases.
+var sqliteColumns = []struct{ table, column, definition string }{
+	{"jobs", "labels", `TEXT NOT NULL DEFAULT '{}'`},
+	{"executed_jobs", "outputs", `TEXT NOT NULL DEFAULT '{}'`},
+}
+
+// SQLiteJobRepository is a JobRepository in an embedded SQLite database, for
+// single-node deployments and local runs that should survive restarts.
+type SQLiteJobRepository struct {
+	db *sql.DB
+}
+
+// OpenSQLiteJobRepository opens or creates the database at path. A path of
+// ":memory:" keeps the database in memory.
+func OpenSQLiteJobRepository(path string) (*SQLiteJobRepository, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; a single connection avoids
+	// SQLITE_BUSY errors and keeps ":memory:" databases from splitting up.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addSQLiteColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteJobRepository{db: db}, nil
+}
+
+// addSQLiteColumns adds the sqliteColumns that an existing database lacks.
+func addSQLiteColumns(db *sql.DB) error {
+	for _, c := range sqliteColumns {
+		var exists bool
+		err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` ` + c.definition); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *SQLiteJobRepository) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLiteJobRepository) Create(ctx context.Context, job models.Job) error {
+	now := time.Now().UnixNano()
+	var notBefore any
+	if job.NotBefore != nil {
+		notBefore = job.NotBefore.UnixNano()
+	}
+	labels, err := json.Marshal(job.Labels)
+	if err != nil {
+		return err
+	}
+	if job.Labels == nil {
+		labels = []byte("{}")
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO jobs (`+jobColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?, ?)`,
+		primitive.NewObjectID().Hex(), job.JobID, job.TenantID, job.DockerfileReference, job.Status,
+		job.WorkerID, job.ErrorMessage, job.Payload, notBefore, now, now, string(labels))
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrDuplicateJob
+	}
+	return err
+}
+
+func (r *SQLiteJobRepository) Get(ctx context.Context, jobID string) (models.Job, error) {
+	return scanJob(r.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE job_id = ?`, jobID))
+}
+
+func (r *SQLiteJobRepository) UpdateState(ctx context.Context, jobID string, update StateUpdate) (models.Job, error) {
+	job, err := scanJob(r.db.QueryRowContext(ctx, `UPDATE jobs SET
+		status = ?,
+		worker_id = CASE WHEN ? = '' THEN worker_id ELSE ? END,
+		error_message = CASE WHEN ? = '' THEN error_message ELSE ? END,
+		version = version + 1,
+		updated_at = ?
+		WHERE job_id = ? AND version = ?
+		RETURNING `+jobColumns,
+		update.Status, update.WorkerID, update.WorkerID, update.ErrorMessage, update.ErrorMessage,
+		time.Now().UnixNano(), jobID, update.ExpectedVersion))
+	if errors.Is(err, ErrNotFound) {
+		// Either the job does not exist or its version moved on.
+		if _, err := r.Get(ctx, jobID); err != nil {
+			return models.Job{}, err
+		}
+		return models.Job{}, ErrVersionConflict
+	}
+	return job, err
+}
+
+func (r *SQLiteJobRepository) List(ctx context.Context, filter JobFilter, page Page) (JobPage, error) {
+	after, err := decodeCursor(page.Sort, page.Cursor)
+	if err != nil {
+		return JobPage{}, err
+	}
+
+	var where []string
+	var args []any
+	add := func(clause string, values ...any) {
+		where = append(where, clause)
+		args = append(args, values...)
+	}
+	if filter.TenantID != "" {
+		add("tenant_id = ?", filter.TenantID)
+	}
+	if filter.Status != "" {
+		add("status = ?", filter.Status)
+	}
+	if filter.WorkerID != "" {
+		add("worker_id = ?", filter.WorkerID)
+	}
+	if filter.DockerfileReference != "" {
+		add("dockerfile_reference = ?", filter.DockerfileReference)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		add("created_at >= ?", filter.CreatedAfter.UnixNano())
+	}
+	if !filter.CreatedBefore.IsZero() {
+		add("created_at < ?", filter.CreatedBefore.UnixNano())
+	}
+	if !filter.UpdatedAfter.IsZero() {
+		add("updated_at >= ?", filter.UpdatedAfter.UnixNano())
+	}
+	if !filter.UpdatedBefore.IsZero() {
+		add("updated_at < ?", filter.UpdatedBefore.UnixNano())
+	}
+	for key, value := range filter.Labels {
+		add("json_extract(labels, ?) = ?", `$."`+strings.ReplaceAll(key, `"`, `\"`)+`"`, value)
+	}
+	for _, word := range errorWords(filter.ErrorText) {
+		add("instr(lower(error_message), ?) > 0", word)
+	}
+	if len(filter.ExcludeTenants) > 0 {
+		add("tenant_id NOT IN (?"+strings.Repeat(", ?", len(filter.ExcludeTenants)-1)+")", toArgs(filter.ExcludeTenants)...)
+	}
+	// The sort field is one of the Sort constants, never user input.
+	field := page.Sort.field()
+	direction, next := "ASC", ">"
+	if page.Sort.Descending {
+		direction, next = "DESC", "<"
+	}
+	if after != nil {
+		nanos := after.Time.UnixNano()
+		add("("+field+" "+next+" ? OR ("+field+" = ? AND job_id "+next+" ?))", nanos, nanos, after.JobID)
+	}
+	query := `SELECT ` + jobColumns + ` FROM jobs`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	// Fetch one extra job to tell whether there is another page.
+	query += ` ORDER BY ` + field + ` ` + direction + `, job_id ` + direction + ` LIMIT ?`
+	args = append(args, page.limit()+1)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return JobPage{}, err
+	}
+	defer rows.Close()
+	var jobs []models.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return JobPage{}, err
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return JobPage{}, err
+	}
+	return newJobPage(jobs, page), nil
+}
+
+func (r *SQLiteJobRepository) AppendAttempt(ctx context.Context, attempt models.ExecutedJob) error {
+	outputs, err := json.Marshal(attempt.Outputs)
+	if err != nil {
+		return err
+	}
+	if attempt.Outputs == nil {
+		outputs = []byte("{}")
+	}
+	_, err = r.db.ExecContext(ctx, `INSERT INTO executed_jobs (id, job_id, worker_id, started_at, dockerfile_reference,
+		scheduled_time, execution_completion_time, status, error_message, outputs) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		primitive.NewObjectID().Hex(), attempt.JobID, attempt.WorkerID, toNanos(attempt.StartedAt),
+		attempt.DockerfileReference, toNanos(attempt.ScheduledTime), toNanos(attempt.ExecutionCompletionTime),
+		attempt.Status, attempt.ErrorMessage, string(outputs))
+	return err
+}
+
+func (r *SQLiteJobRepository) Attempts(ctx context.Context, jobID string) ([]models.ExecutedJob, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, job_id, worker_id, started_at, dockerfile_reference,
+		scheduled_time, execution_completion_time, status, error_message, outputs
+		FROM executed_jobs WHERE job_id = ? ORDER BY execution_completion_time, rowid`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []models.ExecutedJob{}
+	for rows.Next() {
+		var attempt models.ExecutedJob
+		var id, outputs string
+		var started, scheduled, completed int64
+		if err := rows.Scan(&id, &attempt.JobID, &attempt.WorkerID, &started, &attempt.DockerfileReference,
+			&scheduled, &completed, &attempt.Status, &attempt.ErrorMessage, &outputs); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(outputs), &attempt.Outputs); err != nil {
+			return nil, fmt.Errorf("invalid outputs of job %s: %w", attempt.JobID, err)
+		}
+		if len(attempt.Outputs) == 0 {
+			attempt.Outputs = nil
+		}
+		attempt.ID, _ = primitive.ObjectIDFromHex(id)
+		attempt.StartedAt = fromNanos(started)
+		attempt.ScheduledTime = fromNanos(scheduled)
+		attempt.ExecutionCompletionTime = fromNanos(completed)
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+func (r *SQLiteJobRepository) AppendLogChunk(ctx context.Context, chunk models.LogChunk) error {
+	_, err := r.db.ExecContext(ctx, `INSERT INTO job_logs (id, job_id, worker_id, seq, stream, data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		primitive.NewObjectID().Hex(), chunk.JobID, chunk.WorkerID, chunk.Seq, chunk.Stream, chunk.Data,
+		toNanos(chunk.CreatedAt))
+	return err
+}
+
+func (r *SQLiteJobRepository) Logs(ctx context.Context, jobID string) ([]models.LogChunk, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, job_id, worker_id, seq, stream, data, created_at
+		FROM job_logs WHERE job_id = ? ORDER BY created_at, seq, rowid`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chunks := []models.LogChunk{}
+	for rows.Next() {
+		var chunk models.LogChunk
+		var id string
+		var created int64
+		if err := rows.Scan(&id, &chunk.JobID, &chunk.WorkerID, &chunk.Seq, &chunk.Stream, &chunk.Data, &created); err != nil {
+			return nil, err
+		}
+		chunk.ID, _ = primitive.ObjectIDFromHex(id)
+		chunk.CreatedAt = fromNanos(created)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+func (r *SQLiteJobRepository) Delete(ctx context.Context, jobID string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"job_logs", "executed_jobs"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE job_id = ?`, jobID); err != nil {
+			return err
+		}
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM jobs WHERE job_id = ?`, jobID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// scanJob reads a row of jobColumns.
+func scanJob(row interface{ Scan(...any) error }) (models.Job, error) {
+	var job models.Job
+	var id string
+	var notBefore sql.NullInt64
+	var created, updated int64
+	var labels string
+	err := row.Scan(&id, &job.JobID, &job.TenantID, &job.DockerfileReference, &job.Status, &job.WorkerID,
+		&job.ErrorMessage, &job.Payload, &notBefore, &job.Version, &created, &updated, &labels)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Job{}, ErrNotFound
+	}
+	if err != nil {
+		return models.Job{}, err
+	}
+	job.ID, _ = primitive.ObjectIDFromHex(id)
+	if notBefore.Valid {
+		t := fromNanos(notBefore.Int64)
+		job.NotBefore = &t
+	}
+	job.CreatedAt = fromNanos(created)
+	job.UpdatedAt = fromNanos(updated)
+	if err := json.Unmarshal([]byte(labels), &job.Labels); err != nil {
+		return models.Job{}, fmt.Errorf("invalid labels of job %s: %w", job.JobID, err)
+	}
+	if len(job.Labels) == 0 {
+		job.Labels = nil
+	}
+	return job, nil
+}
+
+func toArgs(values []string) []any {
+	args := make([]any, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
+
+// toNanos converts t to Unix nanoseconds, keeping the zero time as 0.
+func toNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
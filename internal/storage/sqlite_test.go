@@ -0,0 +1,19 @@
+package storage_test
+
+import (
+	"execution-service/internal/storage"
+	"execution-service/internal/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteJobRepository(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.JobRepository {
+		jobs, err := storage.OpenSQLiteJobRepository(filepath.Join(t.TempDir(), "jobs.db"))
+		if err != nil {
+			t.Fatalf("OpenSQLiteJobRepository: %v", err)
+		}
+		t.Cleanup(func() { jobs.Close() })
+		return jobs
+	})
+}
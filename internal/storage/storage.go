@@ -0,0 +1,205 @@
+// Package storage persists jobs, their execution attempts and their output.
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"execution-service/internal/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no job with the given ID exists.
+	ErrNotFound = errors.New("job not found")
+	// ErrDuplicateJob is returned by Create when a job with the same ID exists.
+	ErrDuplicateJob = errors.New("job already exists")
+	// ErrVersionConflict is returned by UpdateState when the job changed since
+	// it was read.
+	ErrVersionConflict = errors.New("job was modified concurrently")
+	// ErrInvalidCursor is returned by List for a cursor it did not create or
+	// that belongs to another sort.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrChangeHistoryLost is returned when a change stream cannot resume
+	// after a token, because it is invalid or older than the change history
+	// MongoDB keeps.
+	ErrChangeHistoryLost = errors.New("change history since the resume token is no longer available")
+)
+
+// DefaultPageSize and MaxPageSize bound how many jobs List returns at once.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// JobRepository stores jobs and their history.
+type JobRepository interface {
+	// Create stores a new job at version 1.
+	Create(ctx context.Context, job models.Job) error
+	// Get returns the job with the given ID.
+	Get(ctx context.Context, jobID string) (models.Job, error)
+	// UpdateState changes a job's status if its version is still
+	// update.ExpectedVersion, and returns the updated job.
+	UpdateState(ctx context.Context, jobID string, update StateUpdate) (models.Job, error)
+	// List returns jobs matching filter in page.Sort order, one page at a
+	// time.
+	List(ctx context.Context, filter JobFilter, page Page) (JobPage, error)
+	// AppendAttempt records an attempt at running a job.
+	AppendAttempt(ctx context.Context, attempt models.ExecutedJob) error
+	// Attempts returns a job's attempts, oldest first.
+	Attempts(ctx context.Context, jobID string) ([]models.ExecutedJob, error)
+	// AppendLogChunk stores a piece of a job's output.
+	AppendLogChunk(ctx context.Context, chunk models.LogChunk) error
+	// Logs returns a job's output in the order it was written.
+	Logs(ctx context.Context, jobID string) ([]models.LogChunk, error)
+	// Delete removes a job with its attempts and output. The job goes last,
+	// so a failed Delete can be retried.
+	Delete(ctx context.Context, jobID string) error
+}
+
+// StateUpdate is a status change applied by UpdateState. Empty WorkerID and
+// ErrorMessage leave the stored values unchanged.
+type StateUpdate struct {
+	Status       string
+	WorkerID     string
+	ErrorMessage string
+	// ExpectedVersion is the version the job was read at. Jobs stored before
+	// versions were introduced are at version 0.
+	ExpectedVersion int64
+}
+
+// JobFilter selects jobs for List. Zero fields match every job.
+type JobFilter struct {
+	TenantID            string
+	Status              string
+	WorkerID            string
+	DockerfileReference string
+	// Labels matches jobs that have all of these labels.
+	Labels        map[string]string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	// UpdatedBefore matches jobs last changed before this time; for finished
+	// jobs that is when they finished.
+	UpdatedBefore  time.Time
+	ExcludeTenants []string
+	// ErrorText matches jobs whose error message contains every word of it,
+	// ignoring case.
+	ErrorText string
+}
+
+// Sort fields for List.
+const (
+	SortByCreatedAt = "created_at"
+	SortByUpdatedAt = "updated_at"
+)
+
+// Sort is the order of List results. Jobs with the same time are ordered by
+// job ID in the same direction.
+type Sort struct {
+	Field      string // SortByCreatedAt (the default) or SortByUpdatedAt
+	Descending bool
+}
+
+// ParseSort parses a sort parameter such as "created_at" or "-updated_at",
+// where a leading "-" sorts in descending order.
+func ParseSort(s string) (Sort, error) {
+	sort := Sort{Field: strings.TrimPrefix(s, "-"), Descending: strings.HasPrefix(s, "-")}
+	switch sort.Field {
+	case "":
+		sort.Field = SortByCreatedAt
+	case SortByCreatedAt, SortByUpdatedAt:
+	default:
+		return Sort{}, fmt.Errorf("cannot sort by %q", sort.Field)
+	}
+	return sort, nil
+}
+
+func (s Sort) field() string {
+	if s.Field == "" {
+		return SortByCreatedAt
+	}
+	return s.Field
+}
+
+func (s Sort) String() string {
+	if s.Descending {
+		return "-" + s.field()
+	}
+	return s.field()
+}
+
+// sortTime returns the time job is sorted by.
+func (s Sort) sortTime(job models.Job) time.Time {
+	if s.field() == SortByUpdatedAt {
+		return job.UpdatedAt
+	}
+	return job.CreatedAt
+}
+
+// Page selects a page of List results. Cursor is the NextCursor of the
+// previous page, or empty for the first page, and only valid with the same
+// Sort.
+type Page struct {
+	Limit  int
+	Cursor string
+	Sort   Sort
+}
+
+// JobPage is a page of List results. NextCursor is empty on the last page.
+type JobPage struct {
+	Jobs       []models.Job `json:"jobs"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// limit returns the page size, applying the default and maximum.
+func (p Page) limit() int {
+	if p.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return min(p.Limit, MaxPageSize)
+}
+
+// cursor is the position after the last job of a page: its sort time and
+// job ID, and the sort they were taken in.
+type cursor struct {
+	Sort  string
+	Time  time.Time
+	JobID string
+}
+
+func encodeCursor(sort Sort, job models.Job) string {
+	raw := sort.String() + ":" + strconv.FormatInt(sort.sortTime(job).UnixNano(), 10) + ":" + job.JobID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor decodes the cursor s of a page listed in sort.
+func decodeCursor(sort Sort, s string) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidCursor
+	}
+	if parts[0] != sort.String() {
+		return nil, fmt.Errorf("%w: it was created for sort %q, not %q", ErrInvalidCursor, parts[0], sort.String())
+	}
+	n, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return &cursor{Sort: parts[0], Time: time.Unix(0, n).UTC(), JobID: parts[2]}, nil
+}
+
+// errorWords splits an ErrorText filter into lower-case words.
+func errorWords(text string) []string {
+	return strings.Fields(strings.ToLower(text))
+}
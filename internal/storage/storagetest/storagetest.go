@@ -0,0 +1,663 @@
+// Package storagetest is a conformance suite for storage.JobRepository
+// implementations. A backend's tests call Run with a constructor for empty
+// repositories:
+//
+//	func TestMemoryJobRepository(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.JobRepository {
+//			return storage.NewMemoryJobRepository()
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"execution-service/internal/models"
+	"execution-service/internal/storage"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Factory returns a new, empty repository.
+type Factory func(t *testing.T) storage.JobRepository
+
+// Run runs the conformance suite against repositories created by newRepository.
+func Run(t *testing.T, newRepository Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, r storage.JobRepository)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateDuplicate", testCreateDuplicate},
+		{"GetMissing", testGetMissing},
+		{"UpdateState", testUpdateState},
+		{"UpdateStateKeepsUnsetFields", testUpdateStateKeepsFields},
+		{"UpdateStateVersionConflict", testUpdateStateConflict},
+		{"UpdateStateMissing", testUpdateStateMissing},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"ListFilters", testListFilters},
+		{"ListCreatedRange", testListCreatedRange},
+		{"ListUpdatedBefore", testListUpdatedBefore},
+		{"ListExcludeTenants", testListExcludeTenants},
+		{"ListLabels", testListLabels},
+		{"ListErrorText", testListErrorText},
+		{"ListUpdatedRange", testListUpdatedRange},
+		{"ListPagination", testListPagination},
+		{"ListSortDescending", testListSortDescending},
+		{"ListSortByUpdatedAt", testListSortByUpdatedAt},
+		{"ListCursorOfOtherSort", testListCursorOfOtherSort},
+		{"ListInvalidCursor", testListInvalidCursor},
+		{"Attempts", testAttempts},
+		{"Logs", testLogs},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepository(t))
+		})
+	}
+}
+
+func timeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func job(id string) models.Job {
+	return models.Job{
+		JobID:               id,
+		TenantID:            "tenant-a",
+		DockerfileReference: "https://example.com/Dockerfile",
+		Status:              models.JobStatusPending,
+		Payload:             fmt.Sprintf(`{"job_id":%q}`, id),
+	}
+}
+
+func mustCreate(t *testing.T, r storage.JobRepository, jobs ...models.Job) {
+	t.Helper()
+	for _, j := range jobs {
+		if err := r.Create(timeout(t), j); err != nil {
+			t.Fatalf("Create(%s): %v", j.JobID, err)
+		}
+	}
+}
+
+func mustGet(t *testing.T, r storage.JobRepository, jobID string) models.Job {
+	t.Helper()
+	got, err := r.Get(timeout(t), jobID)
+	if err != nil {
+		t.Fatalf("Get(%s): %v", jobID, err)
+	}
+	return got
+}
+
+// sameTime compares times at the millisecond precision every backend keeps.
+func sameTime(a, b time.Time) bool {
+	return a.Sub(b).Abs() < time.Millisecond
+}
+
+func jobIDs(jobs []models.Job) []string {
+	ids := make([]string, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.JobID
+	}
+	return ids
+}
+
+func testCreateAndGet(t *testing.T, r storage.JobRepository) {
+	before := time.Now().Truncate(time.Millisecond)
+	want := job("a")
+	notBefore := time.Now().Add(time.Hour)
+	want.NotBefore = &notBefore
+	mustCreate(t, r, want)
+
+	got := mustGet(t, r, "a")
+	if got.JobID != want.JobID || got.TenantID != want.TenantID || got.DockerfileReference != want.DockerfileReference ||
+		got.Status != want.Status || got.Payload != want.Payload {
+		t.Fatalf("Get returned %+v, want the fields of %+v", got, want)
+	}
+	if got.Version != 1 {
+		t.Errorf("Version = %d, want 1", got.Version)
+	}
+	if got.CreatedAt.Before(before) || got.CreatedAt.After(time.Now()) {
+		t.Errorf("CreatedAt = %v, want the time of Create", got.CreatedAt)
+	}
+	if got.NotBefore == nil || !sameTime(*got.NotBefore, notBefore) {
+		t.Errorf("NotBefore = %v, want %v", got.NotBefore, notBefore)
+	}
+}
+
+func testCreateDuplicate(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"))
+	duplicate := job("a")
+	duplicate.TenantID = "tenant-b"
+	if err := r.Create(timeout(t), duplicate); !errors.Is(err, storage.ErrDuplicateJob) {
+		t.Fatalf("Create of an existing job = %v, want ErrDuplicateJob", err)
+	}
+	if got := mustGet(t, r, "a"); got.TenantID != "tenant-a" {
+		t.Errorf("duplicate Create changed the job: %+v", got)
+	}
+}
+
+func testGetMissing(t *testing.T, r storage.JobRepository) {
+	if _, err := r.Get(timeout(t), "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Get of a missing job = %v, want ErrNotFound", err)
+	}
+}
+
+func testUpdateState(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"))
+	updated, err := r.UpdateState(timeout(t), "a", storage.StateUpdate{
+		Status:          models.JobStatusAssigned,
+		WorkerID:        "worker-1",
+		ExpectedVersion: 1,
+	})
+	if err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	if updated.Status != models.JobStatusAssigned || updated.WorkerID != "worker-1" || updated.Version != 2 {
+		t.Errorf("UpdateState returned %+v, want assigned to worker-1 at version 2", updated)
+	}
+	got := mustGet(t, r, "a")
+	if got.Status != models.JobStatusAssigned || got.WorkerID != "worker-1" || got.Version != 2 {
+		t.Errorf("Get after UpdateState = %+v, want assigned to worker-1 at version 2", got)
+	}
+	if got.UpdatedAt.Before(got.CreatedAt) {
+		t.Errorf("UpdatedAt %v is before CreatedAt %v", got.UpdatedAt, got.CreatedAt)
+	}
+}
+
+func testUpdateStateKeepsFields(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"))
+	if _, err := r.UpdateState(timeout(t), "a", storage.StateUpdate{
+		Status: models.JobStatusAssigned, WorkerID: "worker-1", ExpectedVersion: 1,
+	}); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	got, err := r.UpdateState(timeout(t), "a", storage.StateUpdate{
+		Status: models.JobStatusFailed, ErrorMessage: "exit status 1", ExpectedVersion: 2,
+	})
+	if err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	if got.WorkerID != "worker-1" || got.ErrorMessage != "exit status 1" || got.Status != models.JobStatusFailed {
+		t.Errorf("UpdateState returned %+v, want failed on worker-1 with the error", got)
+	}
+}
+
+func testUpdateStateConflict(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"))
+	if _, err := r.UpdateState(timeout(t), "a", storage.StateUpdate{Status: models.JobStatusAssigned, ExpectedVersion: 1}); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+	_, err := r.UpdateState(timeout(t), "a", storage.StateUpdate{Status: models.JobStatusFailed, ExpectedVersion: 1})
+	if !errors.Is(err, storage.ErrVersionConflict) {
+		t.Fatalf("UpdateState at a stale version = %v, want ErrVersionConflict", err)
+	}
+	if got := mustGet(t, r, "a"); got.Status != models.JobStatusAssigned || got.Version != 2 {
+		t.Errorf("stale UpdateState changed the job: %+v", got)
+	}
+}
+
+func testUpdateStateMissing(t *testing.T, r storage.JobRepository) {
+	_, err := r.UpdateState(timeout(t), "missing", storage.StateUpdate{Status: models.JobStatusAssigned, ExpectedVersion: 1})
+	if !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("UpdateState of a missing job = %v, want ErrNotFound", err)
+	}
+}
+
+// testConcurrentUpdates checks that read-modify-write loops never lose an
+// update.
+func testConcurrentUpdates(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"))
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				current, err := r.Get(timeout(t), "a")
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = r.UpdateState(timeout(t), "a", storage.StateUpdate{
+					Status:          models.JobStatusAssigned,
+					WorkerID:        fmt.Sprintf("worker-%d", i),
+					ExpectedVersion: current.Version,
+				})
+				if errors.Is(err, storage.ErrVersionConflict) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+				}
+				return
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent UpdateState: %v", err)
+	}
+	if got := mustGet(t, r, "a"); got.Version != 1+writers {
+		t.Errorf("Version = %d after %d updates, want %d", got.Version, writers, 1+writers)
+	}
+}
+
+func testListFilters(t *testing.T, r storage.JobRepository) {
+	a, b, c := job("a"), job("b"), job("c")
+	b.TenantID = "tenant-b"
+	c.DockerfileReference = "https://example.com/other/Dockerfile"
+	mustCreate(t, r, a, b, c)
+	if _, err := r.UpdateState(timeout(t), "c", storage.StateUpdate{
+		Status: models.JobStatusAssigned, WorkerID: "worker-2", ExpectedVersion: 1,
+	}); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+
+	tests := []struct {
+		filter storage.JobFilter
+		want   []string
+	}{
+		{storage.JobFilter{}, []string{"a", "b", "c"}},
+		{storage.JobFilter{TenantID: "tenant-a"}, []string{"a", "c"}},
+		{storage.JobFilter{Status: models.JobStatusPending}, []string{"a", "b"}},
+		{storage.JobFilter{WorkerID: "worker-2"}, []string{"c"}},
+		{storage.JobFilter{DockerfileReference: c.DockerfileReference}, []string{"c"}},
+		{storage.JobFilter{TenantID: "tenant-b", Status: models.JobStatusAssigned}, []string{}},
+	}
+	for _, tt := range tests {
+		page, err := r.List(timeout(t), tt.filter, storage.Page{})
+		if err != nil {
+			t.Fatalf("List(%+v): %v", tt.filter, err)
+		}
+		if got := jobIDs(page.Jobs); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("List(%+v) = %v, want %v", tt.filter, got, tt.want)
+		}
+		if page.NextCursor != "" {
+			t.Errorf("List(%+v) returned a cursor for a single page", tt.filter)
+		}
+	}
+}
+
+func testListCreatedRange(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("old"))
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	mustCreate(t, r, job("new"))
+
+	after, err := r.List(timeout(t), storage.JobFilter{CreatedAfter: start}, storage.Page{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := jobIDs(after.Jobs); fmt.Sprint(got) != "[new]" {
+		t.Errorf("List created after %v = %v, want [new]", start, got)
+	}
+	before, err := r.List(timeout(t), storage.JobFilter{CreatedBefore: start}, storage.Page{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := jobIDs(before.Jobs); fmt.Sprint(got) != "[old]" {
+		t.Errorf("List created before %v = %v, want [old]", start, got)
+	}
+}
+
+func testListUpdatedBefore(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"), job("b"))
+	time.Sleep(20 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := r.UpdateState(timeout(t), "b", storage.StateUpdate{
+		Status: models.JobStatusSucceeded, ExpectedVersion: 1,
+	}); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+
+	page, err := r.List(timeout(t), storage.JobFilter{UpdatedBefore: cutoff}, storage.Page{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := jobIDs(page.Jobs); fmt.Sprint(got) != "[a]" {
+		t.Errorf("List updated before %v = %v, want [a]", cutoff, got)
+	}
+}
+
+func testListExcludeTenants(t *testing.T, r storage.JobRepository) {
+	a, b, c := job("a"), job("b"), job("c")
+	b.TenantID = "tenant-b"
+	c.TenantID = "tenant-c"
+	mustCreate(t, r, a, b, c)
+
+	tests := []struct {
+		filter storage.JobFilter
+		want   []string
+	}{
+		{storage.JobFilter{ExcludeTenants: []string{"tenant-b"}}, []string{"a", "c"}},
+		{storage.JobFilter{ExcludeTenants: []string{"tenant-b", "tenant-c"}}, []string{"a"}},
+		{storage.JobFilter{TenantID: "tenant-c", ExcludeTenants: []string{"tenant-b"}}, []string{"c"}},
+		{storage.JobFilter{TenantID: "tenant-b", ExcludeTenants: []string{"tenant-b"}}, []string{}},
+	}
+	for _, tt := range tests {
+		page, err := r.List(timeout(t), tt.filter, storage.Page{})
+		if err != nil {
+			t.Fatalf("List(%+v): %v", tt.filter, err)
+		}
+		if got := jobIDs(page.Jobs); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("List(%+v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func testListLabels(t *testing.T, r storage.JobRepository) {
+	a, b, c := job("a"), job("b"), job("c")
+	a.Labels = map[string]string{"source": "ci", "branch": "main"}
+	b.Labels = map[string]string{"source": "ci", "branch": "dev"}
+	mustCreate(t, r, a, b, c)
+
+	if got := mustGet(t, r, "a"); fmt.Sprint(got.Labels) != fmt.Sprint(a.Labels) {
+		t.Errorf("Labels = %v, want %v", got.Labels, a.Labels)
+	}
+	tests := []struct {
+		labels map[string]string
+		want   []string
+	}{
+		{map[string]string{"source": "ci"}, []string{"a", "b"}},
+		{map[string]string{"source": "ci", "branch": "main"}, []string{"a"}},
+		{map[string]string{"branch": "release"}, []string{}},
+	}
+	for _, tt := range tests {
+		page, err := r.List(timeout(t), storage.JobFilter{Labels: tt.labels}, storage.Page{})
+		if err != nil {
+			t.Fatalf("List(labels %v): %v", tt.labels, err)
+		}
+		if got := jobIDs(page.Jobs); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("List(labels %v) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func testListErrorText(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"), job("b"), job("c"))
+	for id, message := range map[string]string{
+		"a": "docker build failed: network unreachable",
+		"b": "container exited with code 137",
+	} {
+		if _, err := r.UpdateState(timeout(t), id, storage.StateUpdate{
+			Status: models.JobStatusFailed, ErrorMessage: message, ExpectedVersion: 1,
+		}); err != nil {
+			t.Fatalf("UpdateState: %v", err)
+		}
+	}
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"network", []string{"a"}},
+		{"Docker NETWORK", []string{"a"}},
+		{"docker exited", []string{}},
+		{"container", []string{"b"}},
+	}
+	for _, tt := range tests {
+		page, err := r.List(timeout(t), storage.JobFilter{ErrorText: tt.text}, storage.Page{})
+		if err != nil {
+			t.Fatalf("List(error %q): %v", tt.text, err)
+		}
+		if got := jobIDs(page.Jobs); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("List(error %q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func testListUpdatedRange(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"), job("b"))
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := r.UpdateState(timeout(t), "a", storage.StateUpdate{
+		Status: models.JobStatusAssigned, ExpectedVersion: 1,
+	}); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+
+	page, err := r.List(timeout(t), storage.JobFilter{UpdatedAfter: start}, storage.Page{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if got := jobIDs(page.Jobs); fmt.Sprint(got) != "[a]" {
+		t.Errorf("List updated after %v = %v, want [a]", start, got)
+	}
+}
+
+func testListPagination(t *testing.T, r storage.JobRepository) {
+	const total = 25
+	var want []string
+	for i := range total {
+		id := fmt.Sprintf("job-%02d", i)
+		mustCreate(t, r, job(id))
+		want = append(want, id)
+	}
+
+	var got []string
+	page := storage.Page{Limit: 10}
+	for pages := 1; ; pages++ {
+		result, err := r.List(timeout(t), storage.JobFilter{}, page)
+		if err != nil {
+			t.Fatalf("List page %d: %v", pages, err)
+		}
+		if len(result.Jobs) > page.Limit {
+			t.Fatalf("List page %d returned %d jobs, limit %d", pages, len(result.Jobs), page.Limit)
+		}
+		got = append(got, jobIDs(result.Jobs)...)
+		if result.NextCursor == "" {
+			if pages != 3 {
+				t.Errorf("listed %d jobs in %d pages of 10, want 3 pages", total, pages)
+			}
+			break
+		}
+		if pages > total {
+			t.Fatal("List keeps returning cursors")
+		}
+		page.Cursor = result.NextCursor
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paged through %v, want %v", got, want)
+	}
+}
+
+// listAll pages through List in sort, two jobs at a time.
+func listAll(t *testing.T, r storage.JobRepository, sort storage.Sort) []string {
+	t.Helper()
+	var got []string
+	page := storage.Page{Limit: 2, Sort: sort}
+	for pages := 0; ; pages++ {
+		result, err := r.List(timeout(t), storage.JobFilter{}, page)
+		if err != nil {
+			t.Fatalf("List(%v): %v", sort, err)
+		}
+		got = append(got, jobIDs(result.Jobs)...)
+		if result.NextCursor == "" {
+			return got
+		}
+		if pages > 100 {
+			t.Fatal("List keeps returning cursors")
+		}
+		page.Cursor = result.NextCursor
+	}
+}
+
+func testListSortDescending(t *testing.T, r storage.JobRepository) {
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		mustCreate(t, r, job(id))
+		time.Sleep(2 * time.Millisecond)
+	}
+	got := listAll(t, r, storage.Sort{Field: storage.SortByCreatedAt, Descending: true})
+	if fmt.Sprint(got) != "[e d c b a]" {
+		t.Errorf("listed newest first: %v, want [e d c b a]", got)
+	}
+}
+
+func testListSortByUpdatedAt(t *testing.T, r storage.JobRepository) {
+	for _, id := range []string{"a", "b", "c"} {
+		mustCreate(t, r, job(id))
+		time.Sleep(2 * time.Millisecond)
+	}
+	for _, id := range []string{"b", "a"} {
+		if _, err := r.UpdateState(timeout(t), id, storage.StateUpdate{
+			Status: models.JobStatusAssigned, ExpectedVersion: 1,
+		}); err != nil {
+			t.Fatalf("UpdateState: %v", err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if got := listAll(t, r, storage.Sort{Field: storage.SortByUpdatedAt}); fmt.Sprint(got) != "[c b a]" {
+		t.Errorf("listed by update time: %v, want [c b a]", got)
+	}
+	if got := listAll(t, r, storage.Sort{Field: storage.SortByUpdatedAt, Descending: true}); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("listed by update time, newest first: %v, want [a b c]", got)
+	}
+}
+
+func testListCursorOfOtherSort(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"), job("b"), job("c"))
+	page, err := r.List(timeout(t), storage.JobFilter{}, storage.Page{Limit: 1})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	_, err = r.List(timeout(t), storage.JobFilter{}, storage.Page{
+		Limit: 1, Cursor: page.NextCursor, Sort: storage.Sort{Field: storage.SortByCreatedAt, Descending: true},
+	})
+	if !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Fatalf("List with the cursor of another sort returned %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testListInvalidCursor(t *testing.T, r storage.JobRepository) {
+	if _, err := r.List(timeout(t), storage.JobFilter{}, storage.Page{Cursor: "not a cursor"}); !errors.Is(err, storage.ErrInvalidCursor) {
+		t.Fatalf("List with an invalid cursor returned %v, want ErrInvalidCursor", err)
+	}
+}
+
+func testAttempts(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"), job("b"))
+	start := time.Now()
+	for i, status := range []string{"error", "success"} {
+		var outputs map[string]string
+		if status == "success" {
+			outputs = map[string]string{"digest": "sha256:1"}
+		}
+		err := r.AppendAttempt(timeout(t), models.ExecutedJob{
+			JobID:                   "a",
+			WorkerID:                fmt.Sprintf("worker-%d", i),
+			StartedAt:               start.Add(time.Duration(i) * time.Second),
+			ExecutionCompletionTime: start.Add(time.Duration(i)*time.Second + 500*time.Millisecond),
+			Status:                  status,
+			Outputs:                 outputs,
+		})
+		if err != nil {
+			t.Fatalf("AppendAttempt: %v", err)
+		}
+	}
+
+	attempts, err := r.Attempts(timeout(t), "a")
+	if err != nil {
+		t.Fatalf("Attempts: %v", err)
+	}
+	if len(attempts) != 2 || attempts[0].Status != "error" || attempts[1].Status != "success" {
+		t.Fatalf("Attempts = %+v, want the error then the success", attempts)
+	}
+	if attempts[1].WorkerID != "worker-1" || !sameTime(attempts[1].StartedAt, start.Add(time.Second)) {
+		t.Errorf("second attempt = %+v, want worker-1 started at %v", attempts[1], start.Add(time.Second))
+	}
+	if attempts[0].Outputs != nil || attempts[1].Outputs["digest"] != "sha256:1" {
+		t.Errorf("attempt outputs = %v, %v, want none, then digest=sha256:1", attempts[0].Outputs, attempts[1].Outputs)
+	}
+	if others, err := r.Attempts(timeout(t), "b"); err != nil || len(others) != 0 {
+		t.Errorf("Attempts of a job that never ran = %v, %v, want none", others, err)
+	}
+}
+
+func testLogs(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"))
+	start := time.Now()
+	for i, data := range []string{"building\n", "running\n", "done\n"} {
+		err := r.AppendLogChunk(timeout(t), models.LogChunk{
+			JobID:     "a",
+			WorkerID:  "worker-1",
+			Seq:       i + 1,
+			Stream:    "stdout",
+			Data:      data,
+			CreatedAt: start.Add(time.Duration(i) * time.Millisecond * 10),
+		})
+		if err != nil {
+			t.Fatalf("AppendLogChunk: %v", err)
+		}
+	}
+
+	chunks, err := r.Logs(timeout(t), "a")
+	if err != nil {
+		t.Fatalf("Logs: %v", err)
+	}
+	var output string
+	for _, chunk := range chunks {
+		output += chunk.Data
+	}
+	if output != "building\nrunning\ndone\n" {
+		t.Errorf("Logs = %q, want the chunks in order", output)
+	}
+	if none, err := r.Logs(timeout(t), "b"); err != nil || len(none) != 0 {
+		t.Errorf("Logs of a job without output = %v, %v, want none", none, err)
+	}
+}
+
+func testDelete(t *testing.T, r storage.JobRepository) {
+	mustCreate(t, r, job("a"), job("b"))
+	for _, id := range []string{"a", "b"} {
+		if err := r.AppendAttempt(timeout(t), models.ExecutedJob{JobID: id, Status: "success"}); err != nil {
+			t.Fatalf("AppendAttempt: %v", err)
+		}
+		if err := r.AppendLogChunk(timeout(t), models.LogChunk{JobID: id, Seq: 1, Stream: "stdout", Data: "done\n"}); err != nil {
+			t.Fatalf("AppendLogChunk: %v", err)
+		}
+	}
+
+	if err := r.Delete(timeout(t), "a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := r.Get(timeout(t), "a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get after Delete returned %v, want ErrNotFound", err)
+	}
+	if attempts, err := r.Attempts(timeout(t), "a"); err != nil || len(attempts) != 0 {
+		t.Errorf("Attempts after Delete = %v, %v, want none", attempts, err)
+	}
+	if chunks, err := r.Logs(timeout(t), "a"); err != nil || len(chunks) != 0 {
+		t.Errorf("Logs after Delete = %v, %v, want none", chunks, err)
+	}
+
+	// Other jobs are untouched.
+	mustGet(t, r, "b")
+	if attempts, err := r.Attempts(timeout(t), "b"); err != nil || len(attempts) != 1 {
+		t.Errorf("Attempts of another job = %v, %v, want one", attempts, err)
+	}
+	if chunks, err := r.Logs(timeout(t), "b"); err != nil || len(chunks) != 1 {
+		t.Errorf("Logs of another job = %v, %v, want one chunk", chunks, err)
+	}
+
+	// A deleted job ID can be used again.
+	mustCreate(t, r, job("a"))
+}
+
+func testDeleteMissing(t *testing.T, r storage.JobRepository) {
+	if err := r.Delete(timeout(t), "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("Delete of a missing job returned %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,185 @@
+// Package tracing sets up OpenTelemetry tracing and carries trace context
+// across HTTP calls, Kafka messages and the coordinator's queues.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys shared by the spans of coordinators and workers.
+const (
+	JobIDKey    = attribute.Key("job.id")
+	TenantIDKey = attribute.Key("job.tenant_id")
+	WorkerIDKey = attribute.Key("worker.id")
+	StatusKey   = attribute.Key("job.status")
+)
+
+// Setup configures the global tracer provider from the tracing config
+// section and returns a function that flushes and stops it. Trace context is
+// propagated in W3C traceparent and baggage headers whether or not tracing
+// is enabled, so a disabled node does not break the traces of others.
+func Setup(config *viper.Viper, nodeType, nodeID string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !config.GetBool("tracing.enabled") {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var closeFile func() error
+	switch backend := config.GetString("tracing.exporter"); backend {
+	case "", "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint := config.GetString("tracing.otlp.endpoint"); endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if config.GetBool("tracing.otlp.insecure") {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		otlp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		exporter = otlp
+	case "file":
+		path := config.GetString("tracing.file.path")
+		if path == "" {
+			path = "traces.jsonl"
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(&syncWriter{w: file}))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		exporter = stdout
+		closeFile = file.Close
+	default:
+		return nil, fmt.Errorf("unknown tracing.exporter %q", backend)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "execution-service"),
+		attribute.String("service.instance.id", nodeID),
+		attribute.String("node.type", nodeType),
+	))
+	if err != nil {
+		return nil, err
+	}
+	ratio := 1.0
+	if config.IsSet("tracing.sample_ratio") {
+		ratio = config.GetFloat64("tracing.sample_ratio")
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeFile != nil {
+			if closeErr := closeFile(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// syncWriter serializes writes to the trace file.
+type syncWriter struct {
+	mu sync.Mutex
+	w  *os.File
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// Start starts a span with the service's tracer.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer("execution-service").Start(ctx, name, opts...)
+}
+
+// End records err on span, if there is one, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Inject returns the trace context of ctx as a map, e.g. to keep it with a
+// queued job or send it in Kafka headers.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// InjectInto adds the trace context of ctx to headers, leaving headers that
+// are already set alone.
+func InjectInto(ctx context.Context, headers map[string]string) {
+	for key, value := range Inject(ctx) {
+		if _, ok := headers[key]; !ok {
+			headers[key] = value
+		}
+	}
+}
+
+// Extract returns ctx with the trace context in carrier, such as a job's
+// TraceContext or a message's headers.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// InjectHTTP adds the trace context of ctx to the headers of an outgoing
+// request.
+func InjectHTTP(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Detach returns a context that carries the span of ctx but is not canceled
+// with it, for work that outlives the request that started it.
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// Handler starts a server span for every request served by next, continuing
+// the trace in the request headers. Spans are named after the ServeMux route
+// the request matched.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := Start(ctx, "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", req.Method), attribute.String("url.path", req.URL.Path)))
+		defer span.End()
+		req = req.WithContext(ctx)
+		next.ServeHTTP(wr, req)
+		if req.Pattern != "" {
+			span.SetName(req.Pattern)
+			span.SetAttributes(attribute.String("http.route", req.Pattern))
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Labels set on every job container, so containers that outlive the worker
+// process can be traced back to their job.
+const (
+	jobIDLabel    = "execution-service.job-id"
+	workerIDLabel = "execution-service.worker-id"
+)
+
+// JobContainer is a running container started by the worker for a job.
+type JobContainer struct {
+	ID    string
+	JobID string
+}
+
+// containerLabelArgs returns the docker run arguments that label a job's
+// container.
+func (w *Worker) containerLabelArgs(jobID string) []string {
+	return []string{"--label", jobIDLabel + "=" + jobID, "--label", workerIDLabel + "=" + w.ID}
+}
+
+// JobContainers lists the running containers this worker started for jobs,
+// including those started before the worker last restarted.
+func (w *Worker) JobContainers() ([]JobContainer, error) {
+	out, err := exec.Command("docker", "ps",
+		"--filter", "label="+workerIDLabel+"="+w.ID,
+		"--format", fmt.Sprintf("{{.ID}}\t{{.Label %q}}", jobIDLabel)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	containers := make([]JobContainer, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		id, jobID, ok := strings.Cut(line, "\t")
+		if !ok || jobID == "" {
+			continue
+		}
+		containers = append(containers, JobContainer{ID: id, JobID: jobID})
+	}
+	return containers, nil
+}
+
+// RemoveJobContainer kills and removes a job container. Only containers
+// listed by JobContainers can be removed.
+func (w *Worker) RemoveJobContainer(id string) (bool, error) {
+	containers, err := w.JobContainers()
+	if err != nil {
+		return false, err
+	}
+	for _, container := range containers {
+		if container.ID != id {
+			continue
+		}
+		if out, err := exec.Command("docker", "rm", "-f", id).CombinedOutput(); err != nil {
+			return true, fmt.Errorf("failed to remove container %s: %v: %s", id, err, strings.TrimSpace(string(out)))
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"context"
+	"execution-service/internal/models"
+	"execution-service/internal/storage"
+	"io"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// logChunkSize is how much output is buffered per stream before it is
+// stored as a chunk.
+const logChunkSize = 16 * 1024
+
+// jobLog stores a job's build and run output in the job repository in
+// chunks. A jobLog without a repository discards everything.
+type jobLog struct {
+	jobs     storage.JobRepository
+	jobID    string
+	workerID string
+	logger   *zap.Logger
+
+	mu      sync.Mutex
+	seq     int
+	pending map[string][]byte // stream -> unstored output
+}
+
+func newJobLog(jobs storage.JobRepository, jobID, workerID string, logger *zap.Logger) *jobLog {
+	return &jobLog{jobs: jobs, jobID: jobID, workerID: workerID, logger: logger, pending: make(map[string][]byte)}
+}
+
+// Stream returns a writer for one output stream, "stdout" or "stderr".
+func (l *jobLog) Stream(name string) io.Writer {
+	return logStream{log: l, name: name}
+}
+
+type logStream struct {
+	log  *jobLog
+	name string
+}
+
+func (s logStream) Write(p []byte) (int, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+	if s.log.jobs == nil {
+		return len(p), nil
+	}
+	s.log.pending[s.name] = append(s.log.pending[s.name], p...)
+	if len(s.log.pending[s.name]) >= logChunkSize {
+		s.log.flush(s.name)
+	}
+	return len(p), nil
+}
+
+// Close stores any output that is still buffered.
+func (l *jobLog) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, stream := range []string{"stdout", "stderr"} {
+		l.flush(stream)
+	}
+}
+
+// flush stores the buffered output of stream. The caller must hold l.mu.
+// Output that cannot be stored is logged and dropped rather than failing
+// the job.
+func (l *jobLog) flush(stream string) {
+	data := l.pending[stream]
+	if len(data) == 0 {
+		return
+	}
+	delete(l.pending, stream)
+	l.seq++
+	err := l.jobs.AppendLogChunk(context.TODO(), models.LogChunk{
+		JobID:     l.jobID,
+		WorkerID:  l.workerID,
+		Seq:       l.seq,
+		Stream:    stream,
+		Data:      string(data),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		l.logger.Error("Failed to store job output", zap.String("stream", stream), zap.Error(err))
+	}
+}
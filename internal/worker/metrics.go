@@ -0,0 +1,36 @@
+package worker
+
+import (
+	"execution-service/internal/metrics"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	runningJobsDesc = prometheus.NewDesc("execution_worker_running_jobs",
+		"Jobs running on the worker.", []string{"worker_id"}, nil)
+	slotsDesc = prometheus.NewDesc("execution_worker_slots",
+		"Jobs the worker runs concurrently.", []string{"worker_id"}, nil)
+)
+
+// metricsCollector reports the worker's running jobs when metrics are
+// scraped.
+type metricsCollector struct {
+	w *Worker
+}
+
+func (m metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- runningJobsDesc
+	ch <- slotsDesc
+}
+
+func (m metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(runningJobsDesc, prometheus.GaugeValue, float64(len(m.w.RunningJobs())), m.w.ID)
+	ch <- prometheus.MustNewConstMetric(slotsDesc, prometheus.GaugeValue, float64(m.w.Slots), m.w.ID)
+}
+
+// observePhase records how long a phase of running a job took.
+func observePhase(phase string, started time.Time, err error) {
+	metrics.JobPhaseDuration.WithLabelValues(phase, metrics.Outcome(err)).Observe(time.Since(started).Seconds())
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+const (
+	// outputPrefix marks a container stdout line that sets a job output, as in
+	// "::set-output name=version::1.4.2".
+	outputPrefix = "::set-output name="
+
+	maxOutputs        = 32
+	maxOutputValueLen = 1024
+)
+
+// outputCollector is an io.Writer that picks job outputs out of container
+// stdout. Outputs are meant for small values passed between workflow steps,
+// so the number and size of outputs are capped.
+type outputCollector struct {
+	mu      sync.Mutex
+	partial []byte
+	outputs map[string]string
+}
+
+func newOutputCollector() *outputCollector {
+	return &outputCollector{outputs: make(map[string]string)}
+}
+
+func (c *outputCollector) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partial = append(c.partial, p...)
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		c.parseLine(string(c.partial[:i]))
+		c.partial = c.partial[i+1:]
+	}
+	// Very long lines can never be valid outputs; do not buffer them forever.
+	if len(c.partial) > len(outputPrefix)+maxOutputValueLen*2 {
+		c.partial = c.partial[:0]
+	}
+	return len(p), nil
+}
+
+func (c *outputCollector) parseLine(line string) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasPrefix(line, outputPrefix) {
+		return
+	}
+	name, value, ok := strings.Cut(strings.TrimPrefix(line, outputPrefix), "::")
+	if !ok || name == "" {
+		return
+	}
+	if _, exists := c.outputs[name]; !exists && len(c.outputs) >= maxOutputs {
+		return
+	}
+	if len(value) > maxOutputValueLen {
+		value = value[:maxOutputValueLen]
+	}
+	c.outputs[name] = value
+}
+
+// Outputs returns the outputs collected so far.
+func (c *outputCollector) Outputs() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.partial) > 0 {
+		c.parseLine(string(c.partial))
+		c.partial = c.partial[:0]
+	}
+	outputs := make(map[string]string, len(c.outputs))
+	for name, value := range c.outputs {
+		outputs[name] = value
+	}
+	return outputs
+}
@@ -1,47 +1,167 @@
 package worker
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"execution-service/internal/database"
+	"execution-service/internal/logging"
+	"execution-service/internal/metrics"
 	"execution-service/internal/models"
-	"execution-service/internal/queries"
+	"execution-service/internal/storage"
+	"execution-service/internal/tracing"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
-
 type Worker struct {
 	ID      string
 	Address string
-	JobID  	string
+	Labels  map[string]string
+	// Slots is the number of jobs the worker runs concurrently.
+	Slots int
+	// CoordinatorAddress is the coordinator's API base URL. When set, the
+	// worker reports finished jobs so their slots are reused immediately.
+	CoordinatorAddress string
+	// CoordinatorToken is sent with completion reports when the coordinator
+	// requires a worker token.
+	CoordinatorToken string
+
+	// repository records attempts and output. It is nil when the worker
+	// runs without storage.
+	repository storage.JobRepository
+	logger     *zap.Logger
+
+	mu     sync.Mutex
+	jobs   map[string]time.Time // running job ID -> start time
+	images map[string]time.Time // Dockerfile reference -> last successful build
 }
 
-func NewWorker(config *viper.Viper) *Worker {
+// workerTokenEnv overrides node.coordinator_token so the token can be kept
+// out of the config file.
+const workerTokenEnv = "WORKER_TOKEN"
+
+// NewWorker creates a worker that records job attempts and output in jobs,
+// which may be nil.
+func NewWorker(config *viper.Viper, jobs storage.JobRepository, logger *zap.Logger) *Worker {
+	slots := config.GetInt("node.slots")
+	if slots <= 0 {
+		slots = 1
+	}
+	id := config.GetString("node.id")
+	logger = logger.With(logging.WorkerID(id))
+	token := config.GetString("node.coordinator_token")
+	if env := os.Getenv(workerTokenEnv); env != "" {
+		token = env
+	}
 	return &Worker{
-		ID:      config.GetString("node.id"),
-		Address: config.GetString("node.address"),
+		ID:                 id,
+		Address:            config.GetString("node.address"),
+		Labels:             detectLabels(config.GetStringMapString("node.labels"), logger),
+		Slots:              slots,
+		CoordinatorAddress: config.GetString("node.coordinator_address"),
+		CoordinatorToken:   token,
+		repository:         jobs,
+		logger:             logger,
+		jobs:               make(map[string]time.Time),
+		images:             make(map[string]time.Time),
+	}
+}
+
+// reserveSlot marks jobID as running if the worker has a free slot.
+func (w *Worker) reserveSlot(jobID string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, running := w.jobs[jobID]; running || len(w.jobs) >= w.Slots {
+		return false
+	}
+	w.jobs[jobID] = time.Now()
+	return true
+}
+
+func (w *Worker) releaseSlot(jobID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.jobs, jobID)
+}
+
+// RunningJobs returns the IDs of the jobs currently running on the worker.
+func (w *Worker) RunningJobs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	jobIDs := make([]string, 0, len(w.jobs))
+	for jobID := range w.jobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	sort.Strings(jobIDs)
+	return jobIDs
+}
+
+// CachedImages returns the Dockerfile references whose images are built on this worker.
+func (w *Worker) CachedImages() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	refs := make([]string, 0, len(w.images))
+	for ref := range w.images {
+		refs = append(refs, ref)
 	}
+	sort.Strings(refs)
+	return refs
+}
+
+// detectLabels returns the labels the worker advertises to the coordinator:
+// the host architecture, OS and Docker version, overlaid with the labels from
+// the "node.labels" config (region, disk size, custom tags, ...).
+func detectLabels(configured map[string]string, logger *zap.Logger) map[string]string {
+	labels := map[string]string{
+		"arch": runtime.GOARCH,
+		"os":   runtime.GOOS,
+	}
+	out, err := exec.Command("docker", "version", "--format", "{{.Server.Version}}").Output()
+	if err != nil {
+		logger.Warn("Failed to detect Docker version", zap.Error(err))
+	} else {
+		labels["docker-version"] = strings.TrimSpace(string(out))
+	}
+	for key, value := range configured {
+		labels[key] = value
+	}
+	return labels
 }
 
 func (w *Worker) Start() error {
-	log.Printf("Worker %s: Starting on %s", w.ID, w.Address)
+	w.logger.Info("Worker starting", zap.String("address", w.Address))
 
 	// Define HTTP handlers
 	http.HandleFunc("/execute", w.handleExecuteJob)
 	http.HandleFunc("/health", w.handleHealthRequest)
 	http.HandleFunc("/job", w.handleJobRequest)
+	http.HandleFunc("/info", w.handleInfoRequest)
+	http.HandleFunc("GET /containers", w.handleListContainers)
+	http.HandleFunc("DELETE /containers/{id}", w.handleRemoveContainer)
+	http.Handle("GET /metrics", metrics.Handler())
+	if err := metrics.Register(metricsCollector{w}); err != nil {
+		w.logger.Warn("Failed to register worker metrics", zap.Error(err))
+	}
 
 	// Start the HTTP server
 	go func() {
-		if err := http.ListenAndServe(w.Address, nil); err != nil {
-			log.Fatalf("Worker %s: Failed to start HTTP server: %v", w.ID, err)
+		if err := http.ListenAndServe(w.Address, metrics.InstrumentHandler(tracing.Handler(http.DefaultServeMux))); err != nil {
+			w.logger.Fatal("Failed to start HTTP server", zap.Error(err))
 		}
 	}()
 
@@ -49,7 +169,7 @@ func (w *Worker) Start() error {
 }
 
 func (w *Worker) Stop() error {
-	log.Printf("Worker %s: Stopping", w.ID)
+	w.logger.Info("Worker stopping")
 	// TODO: Implement graceful shutdown logic if needed
 	return nil
 }
@@ -59,7 +179,6 @@ func (w *Worker) GetID() string {
 }
 
 func (w *Worker) handleExecuteJob(wr http.ResponseWriter, req *http.Request) {
-	log.Printf("Worker %s: Received job execution request", w.ID)
 	if req.Method != http.MethodPost {
 		http.Error(wr, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -69,134 +188,270 @@ func (w *Worker) handleExecuteJob(wr http.ResponseWriter, req *http.Request) {
 	var jobPayload map[string]interface{}
 	if err := json.NewDecoder(req.Body).Decode(&jobPayload); err != nil {
 		http.Error(wr, "Failed to parse job payload", http.StatusBadRequest)
-		w.JobID = ""
 		return
 	}
 	jobID, ok := jobPayload["JobID"].(string)
 	if !ok {
 		http.Error(wr, "Invalid job payload", http.StatusBadRequest)
-		w.JobID = ""
 		return
 	}
 
-	log.Printf("Worker %s: Received job: %v", w.ID, jobPayload)
+	if !w.reserveSlot(jobID) {
+		http.Error(wr, "Worker has no free slots", http.StatusServiceUnavailable)
+		return
+	}
 
-	// Execute the job
+	w.jobLogger(req.Context(), jobPayload).Info("Received job")
+
+	// Execute the job in the background so the coordinator is not blocked for
+	// the duration of the job. The job stays in the trace of the request.
 	wr.WriteHeader(http.StatusOK)
 	wr.Write([]byte("Job execution started successfully"))
-	if err := w.ExecuteJob(jobPayload); err != nil {
-		// http.Error(wr, "Failed to execute job", http.StatusInternalServerError)
-		if !ok {
-			log.Printf("Worker %s: Invalid job_id in payload", w.ID)
-			http.Error(wr, "Invalid job_id in payload", http.StatusBadRequest)
-			w.JobID = ""
-		}
-		markJobCompleted(jobID, "error", err.Error())
+	go w.runJob(tracing.Detach(req.Context()), jobID, jobPayload)
+}
+
+func (w *Worker) runJob(ctx context.Context, jobID string, jobPayload map[string]interface{}) {
+	ctx, span := tracing.Start(ctx, "job.execute",
+		trace.WithAttributes(tracing.JobIDKey.String(jobID), tracing.WorkerIDKey.String(w.ID)))
+	started := time.Now()
+	dockerfileReference, _ := jobPayload["DockerfileReference"].(string)
+	outputs, err := w.ExecuteJob(ctx, jobPayload)
+	defer tracing.End(span, err)
+	// The attempt is recorded before the slot is released: once the worker
+	// stops reporting the job, the coordinator looks for its attempt.
+	if err != nil {
+		result := JobResult{Status: "error", Error: err.Error(), Outputs: outputs}
+		w.recordAttempt(ctx, jobID, dockerfileReference, started, result)
+		w.releaseSlot(jobID)
+		w.notifyCoordinator(ctx, jobID, result)
 		return
 	}
-	log.Printf("Worker %s: Job %s executed successfully with proof", w.ID, jobID)
 
-	markJobCompleted(jobID, "success", "")
-	log.Printf("Worker %s: Job %s executed successfully", w.ID, jobID)
-	w.JobID = ""
+	result := JobResult{Status: "success", Outputs: outputs}
+	w.recordAttempt(ctx, jobID, dockerfileReference, started, result)
+	w.releaseSlot(jobID)
+	w.jobLogger(ctx, jobPayload).Info("Job executed successfully", zap.Duration("duration", time.Since(started)))
+	w.notifyCoordinator(ctx, jobID, result)
 }
 
-func (w *Worker) ExecuteJob(jobPayload map[string]interface{}) error {
-	// Simulate the job execution
-	log.Printf("Worker %s: Executing job with payload: %v", w.ID, jobPayload)
+// ExecuteJob builds and runs the job's Dockerfile and returns the outputs the
+// container set on stdout. Each phase is traced as a child span of ctx.
+func (w *Worker) ExecuteJob(ctx context.Context, jobPayload map[string]interface{}) (map[string]string, error) {
+	logger := w.jobLogger(ctx, jobPayload)
+	logger.Debug("Executing job", zap.Any("payload", jobPayload))
 
-	// Sleep for a random amount of milliseconds to simulate processing
 	// Fetch the Dockerfile from the Firebase S3 bucket
 	dockerFileURL := jobPayload["DockerfileReference"].(string)
-	log.Print("Worker %s: Fetching Dockerfile from URL: %s", w.ID, dockerFileURL)
+	logger.Info("Fetching Dockerfile", zap.String("url", dockerFileURL))
 	// Fetch the Dockerfile from the provided URL
+	fetchStarted := time.Now()
+	_, fetchSpan := tracing.Start(ctx, "job.fetch")
 	resp, err := http.Get(dockerFileURL)
+	fetchErr := err
+	if err == nil && resp.StatusCode != http.StatusOK {
+		fetchErr = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	observePhase("fetch", fetchStarted, fetchErr)
+	tracing.End(fetchSpan, fetchErr)
 	if err != nil {
-		log.Printf("Worker %s: Failed to fetch Dockerfile from URL: %v", w.ID, err)
-		return err
+		logger.Error("Failed to fetch Dockerfile", zap.Error(err))
+		return nil, err
 	}
 	defer resp.Body.Close()
-	log.Printf("Worker %s: Received response from Dockerfile URL: %d", w.ID, resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Worker %s: Received non-OK response while fetching Dockerfile: %d", w.ID, resp.StatusCode)
-		return err
+		logger.Error("Failed to fetch Dockerfile", zap.Int("status_code", resp.StatusCode))
+		return nil, fmt.Errorf("failed to fetch Dockerfile: %s", resp.Status)
 	}
-	log.Print("Worker %s: Successfully fetched Dockerfile from URL", w.ID)
-	log.Print("creating temporary file for Dockerfile")
 	// Save the Dockerfile to a temporary location
 	tempFile, err := os.CreateTemp("", "dockerfile-*.Dockerfile")
 	if err != nil {
-		log.Printf("Worker %s: Failed to create temporary file for Dockerfile: %v", w.ID, err)
-		return err
+		logger.Error("Failed to create temporary file for Dockerfile", zap.Error(err))
+		return nil, err
 	}
 	defer os.Remove(tempFile.Name())
 
 	_, err = io.Copy(tempFile, resp.Body)
 	if err != nil {
-		log.Printf("Worker %s: Failed to save Dockerfile to temporary file: %v", w.ID, err)
-		return err
+		logger.Error("Failed to save Dockerfile to temporary file", zap.Error(err))
+		return nil, err
 	}
 
 	// Close the file to ensure it's written to disk
 	if err := tempFile.Close(); err != nil {
-		log.Printf("Worker %s: Failed to close temporary Dockerfile: %v", w.ID, err)
-		return err
+		logger.Error("Failed to close temporary Dockerfile", zap.Error(err))
+		return nil, err
 	}
-	log.Printf("Worker %s: Dockerfile saved to temporary file: %s", w.ID, tempFile.Name())
 	// Execute the Dockerfile
 	// Use the Docker CLI to build and run the Dockerfile
-	dockerImageName := "job-image-" + jobPayload["JobID"].(string)
+	dockerImageName := imageName(dockerFileURL)
+
+	// Keep the build and run output with the job
+	jobID, _ := jobPayload["JobID"].(string)
+	output := newJobLog(w.repository, jobID, w.ID, logger)
+	defer output.Close()
 
 	// Build the Docker image
 	buildCmd := exec.Command("docker", "build", "-t", dockerImageName, "-f", tempFile.Name(), ".")
-	buildCmd.Stdout = os.Stdout
-	buildCmd.Stderr = os.Stderr
+	buildCmd.Stdout = io.MultiWriter(os.Stdout, output.Stream("stdout"))
+	buildCmd.Stderr = io.MultiWriter(os.Stderr, output.Stream("stderr"))
 
-	// log.Printf("Worker %s: Building Docker image %s", w.ID, dockerImageName)
-	if err := buildCmd.Run(); err != nil {
-		log.Printf("Worker %s: Failed to build Docker image: %v", w.ID, err)
-		return err
+	logger.Info("Building Docker image", zap.String("image", dockerImageName))
+	buildStarted := time.Now()
+	_, buildSpan := tracing.Start(ctx, "job.build")
+	err = buildCmd.Run()
+	observePhase("build", buildStarted, err)
+	tracing.End(buildSpan, err)
+	if err != nil {
+		logger.Error("Failed to build Docker image", zap.Error(err))
+		return nil, err
 	}
 
-	// Run the Docker container
-	runCmd := exec.Command("docker", "run", "--rm", dockerImageName)
-	runCmd.Stdout = os.Stdout
-	runCmd.Stderr = os.Stderr
-
-	log.Printf("Worker %s: Running Docker container for image %s", w.ID, dockerImageName)
-	if err := runCmd.Run(); err != nil {
-		log.Printf("Worker %s: Failed to run Docker container: %v", w.ID, err)
-		return err
+	// Run the Docker container, passing the job's environment and collecting
+	// the outputs it sets on stdout
+	runArgs := append([]string{"run", "--rm"}, w.containerLabelArgs(jobID)...)
+	if env, ok := jobPayload["Env"].(map[string]interface{}); ok {
+		for key, value := range env {
+			runArgs = append(runArgs, "-e", fmt.Sprintf("%s=%v", key, value))
+		}
 	}
+	runArgs = append(runArgs, dockerImageName)
+	outputs := newOutputCollector()
+	runCmd := exec.Command("docker", runArgs...)
+	runCmd.Stdout = io.MultiWriter(os.Stdout, outputs, output.Stream("stdout"))
+	runCmd.Stderr = io.MultiWriter(os.Stderr, output.Stream("stderr"))
 
-	log.Printf("Worker %s: Successfully executed Dockerfile", w.ID)
+	logger.Info("Running Docker container", zap.String("image", dockerImageName))
+	runStarted := time.Now()
+	_, runSpan := tracing.Start(ctx, "job.run")
+	err = runCmd.Run()
+	observePhase("run", runStarted, err)
+	tracing.End(runSpan, err)
+	if err != nil {
+		logger.Error("Failed to run Docker container", zap.Error(err))
+		return outputs.Outputs(), err
+	}
 
-	log.Printf("Worker %s: Successfully fetched and saved Dockerfile to %s", w.ID, tempFile.Name())
+	w.mu.Lock()
+	w.images[dockerFileURL] = time.Now()
+	w.mu.Unlock()
 
 	// Example: You could use a library like "github.com/docker/docker/client" to interact with Docker
-	log.Printf("Worker %s: Job execution completed", w.ID)
 
-	return nil
+	return outputs.Outputs(), nil
+}
+
+// JobResult is reported to the coordinator when a job finishes.
+type JobResult struct {
+	Status  string            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// Completion reports are retried with exponential backoff, so a coordinator
+// that restarts while a job finishes still receives its result.
+const (
+	reportAttempts       = 8
+	initialReportBackoff = time.Second
+	maxReportBackoff     = 30 * time.Second
+)
+
+// notifyCoordinator tells the coordinator that jobID finished and its slot is
+// free. Failed reports are retried until the coordinator answers or
+// reportAttempts are used up; after that the coordinator finds the result
+// from the recorded attempt.
+func (w *Worker) notifyCoordinator(ctx context.Context, jobID string, result JobResult) {
+	if w.CoordinatorAddress == "" {
+		return
+	}
+	logger := logging.ForJob(w.logger, ctx, jobID)
+	body, err := json.Marshal(result)
+	if err != nil {
+		logger.Error("Failed to encode job result", zap.Error(err))
+		return
+	}
+	url := fmt.Sprintf("%s/workers/%s/jobs/%s/complete", w.CoordinatorAddress, neturl.PathEscape(w.ID), neturl.PathEscape(jobID))
+	backoff := initialReportBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.reportResult(ctx, url, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == reportAttempts {
+			logger.Error("Failed to report job completion", zap.Int("attempts", attempt), zap.Error(err))
+			return
+		}
+		logger.Warn("Failed to report job completion, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxReportBackoff)
+	}
+}
+
+// reportResult posts a job result to url. It reports whether a failed
+// request may succeed when retried.
+func (w *Worker) reportResult(ctx context.Context, url string, body []byte) (bool, error) {
+	ctx, span := tracing.Start(ctx, "job.report", trace.WithSpanKind(trace.SpanKindClient))
+	retry, err := func() (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if w.CoordinatorToken != "" {
+			req.Header.Set("Authorization", "Bearer "+w.CoordinatorToken)
+		}
+		tracing.InjectHTTP(ctx, req.Header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return true, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return resp.StatusCode >= 500, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return false, nil
+	}()
+	tracing.End(span, err)
+	return retry, err
 }
 
-func markJobCompleted(job_id string, status string, error string) {
-	// This function should update the job status in the database
-	// You can use the database queries package to perform this operation
-	log.Printf("status: %s", status)
-	collection := database.GetCollection("hackathon", "executed_jobs")
-	err := queries.AddEntry(collection, models.ExecutedJob{
-		ID:                      primitive.NewObjectID(),
-		JobID:                   job_id,
-		ScheduledTime:           time.Now(),
-		DockerfileReference:     "",
+// jobLogger returns the worker's logger with the job's ID, attempt and trace.
+func (w *Worker) jobLogger(ctx context.Context, jobPayload map[string]interface{}) *zap.Logger {
+	jobID, _ := jobPayload["JobID"].(string)
+	logger := logging.ForJob(w.logger, ctx, jobID)
+	if attempt, ok := jobPayload["Attempt"].(float64); ok && attempt > 0 {
+		logger = logger.With(logging.Attempt(int(attempt)))
+	}
+	return logger
+}
+
+// imageName returns the image tag for a Dockerfile reference. Tagging by
+// reference rather than job lets later jobs reuse the cached image.
+func imageName(dockerfileReference string) string {
+	sum := sha256.Sum256([]byte(dockerfileReference))
+	return "job-image-" + hex.EncodeToString(sum[:])[:16]
+}
+
+// recordAttempt stores the outcome of running a job.
+func (w *Worker) recordAttempt(ctx context.Context, jobID, dockerfileReference string, started time.Time, result JobResult) {
+	if w.repository == nil {
+		return
+	}
+	ctx, span := tracing.Start(ctx, "job.record_attempt", trace.WithAttributes(tracing.StatusKey.String(result.Status)))
+	logger := logging.ForJob(w.logger, ctx, jobID)
+	logger.Debug("Recording attempt", zap.String("status", result.Status))
+	err := w.repository.AppendAttempt(ctx, models.ExecutedJob{
+		JobID:                   jobID,
+		WorkerID:                w.ID,
+		StartedAt:               started,
+		DockerfileReference:     dockerfileReference,
+		ScheduledTime:           started,
 		ExecutionCompletionTime: time.Now(),
-		Status:                  status,
-		ErrorMessage:            error,
+		Status:                  result.Status,
+		ErrorMessage:            result.Error,
+		Outputs:                 result.Outputs,
 	})
-	
-	log.Printf("Worker: Marking job %s as completed with status: %s", job_id, status)
+	tracing.End(span, err)
 	if err != nil {
-		log.Printf("Error updating job status: %v", err)
+		logger.Error("Failed to record attempt", zap.Error(err))
 	}
-
 }
@@ -3,8 +3,9 @@ package worker
 import (
 	"encoding/json"
 	"net/http"
-)
 
+	"go.uber.org/zap"
+)
 
 func (w *Worker) handleHealthRequest(wr http.ResponseWriter, req *http.Request) {
 	wr.WriteHeader(http.StatusOK)
@@ -13,8 +14,16 @@ func (w *Worker) handleHealthRequest(wr http.ResponseWriter, req *http.Request)
 
 func (w *Worker) handleJobRequest(wr http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodGet {
-		jobID := w.JobID // Assuming getJobID() is a method that retrieves the current job ID
-		response := map[string]string{"JobID": jobID}
+		jobIDs := w.RunningJobs()
+		jobID := ""
+		if len(jobIDs) > 0 {
+			jobID = jobIDs[0]
+		}
+		response := map[string]interface{}{
+			"JobID":  jobID,
+			"JobIDs": jobIDs,
+			"Slots":  w.Slots,
+		}
 		wr.Header().Set("Content-Type", "application/json")
 		wr.WriteHeader(http.StatusOK)
 		json.NewEncoder(wr).Encode(response)
@@ -22,4 +31,49 @@ func (w *Worker) handleJobRequest(wr http.ResponseWriter, req *http.Request) {
 	}
 	wr.WriteHeader(http.StatusMethodNotAllowed)
 	wr.Write([]byte("Method not allowed"))
-}
\ No newline at end of file
+}
+
+func (w *Worker) handleInfoRequest(wr http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		wr.WriteHeader(http.StatusMethodNotAllowed)
+		wr.Write([]byte("Method not allowed"))
+		return
+	}
+	response := map[string]interface{}{
+		"ID":           w.ID,
+		"Labels":       w.Labels,
+		"Slots":        w.Slots,
+		"CachedImages": w.CachedImages(),
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusOK)
+	json.NewEncoder(wr).Encode(response)
+}
+
+// handleListContainers lists the worker's job containers, so the coordinator
+// can find ones that are no longer tracked as running jobs.
+func (w *Worker) handleListContainers(wr http.ResponseWriter, req *http.Request) {
+	containers, err := w.JobContainers()
+	if err != nil {
+		w.logger.Error("Failed to list containers", zap.Error(err))
+		http.Error(wr, "Failed to list containers", http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(http.StatusOK)
+	json.NewEncoder(wr).Encode(containers)
+}
+
+func (w *Worker) handleRemoveContainer(wr http.ResponseWriter, req *http.Request) {
+	found, err := w.RemoveJobContainer(req.PathValue("id"))
+	if err != nil {
+		w.logger.Error("Failed to remove container", zap.String("container_id", req.PathValue("id")), zap.Error(err))
+		http.Error(wr, "Failed to remove container", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(wr, "Container not found", http.StatusNotFound)
+		return
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}